@@ -1,166 +1,380 @@
 package search
 
 import (
-	"fmt"
-	"io"
+	"errors"
+	"log"
 	"math"
-	"os"
-	"os/exec"
+	"shazam/internal/audio"
 	"shazam/internal/db"
 	"shazam/internal/fingerprint"
 	"sort"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-audio/wav"
-	"gorm.io/gorm"
 )
 
-// Constants (ensure these are defined as they were in your original code)
 const (
 	MIN_MATCH_THRESHOLD = 5
-	OFFSET_BIN_SIZE_MS  = 32
-	TOP_N_RESULTS       = 3
+	// OFFSET_BIN_SIZE_MS is the default width of the offset histogram bins.
+	OFFSET_BIN_SIZE_MS = 32
+	TOP_N_RESULTS      = 3
+	// MIN_CONFIDENCE is the default confidence a match must reach.
+	MIN_CONFIDENCE = 0.5
+	// MAX_CANDIDATES and MIN_CANDIDATE_HITS bound the songs scored per
+	// query; see MatchHashes.
+	MAX_CANDIDATES     = 10
+	MIN_CANDIDATE_HITS = MIN_MATCH_THRESHOLD
+	// MAX_SPEED_CHANGE is the default speed range searched with ratio
+	// hashes.
+	MAX_SPEED_CHANGE = 0.1
 
 	// New constants for secondary validation tolerances
 	// FreqTolerance: Max allowed difference in Hz for AnchorFreq and TargetFreq
 	// Example: Allowing up to 2 Hz difference.
 	FREQ_TOLERANCE = 2.0 // Hz
 
-	// TimeDeltaTolerance: Max allowed difference in seconds for TimeDelta
-	// Example: Allowing up to 20 milliseconds (0.02 seconds) difference.
+	// TIME_DELTA_TOLERANCE is the largest difference in TimeDelta, in
+	// seconds, between a query and a catalog fingerprint that vote together.
 	TIME_DELTA_TOLERANCE = 0.02 // Seconds (equivalent to 20ms)
 )
 
+// ErrIncompatibleConfig is returned when every candidate song was indexed
+// with a different fingerprint configuration than the query.
+var ErrIncompatibleConfig = errors.New("query fingerprint config does not match any candidate song")
+
 // MatchedSongOptimized represents a potential song match with its score, confidence, and time offset.
 type MatchedSongOptimized struct {
-	SongID      string
-	Score       int // Number of hash matches that align at a common time offset
-	MatchCount  int // Score / SecondBestScore (or Score if no second best)
-	MatchOffset int // The most common time offset in milliseconds for the song
+	Song        db.Song
+	Score       int // Blend of MatchCount and the peak of the time delta histogram
+	MatchCount  int // Number of hash matches that align at MatchOffset
+	MatchOffset int // Time offset of the query within the song, in milliseconds; negative if the query starts before it
+	Votes       int // Number of hash matches at any offset
+	// TrackStart and TrackEnd are the part of the song, in milliseconds,
+	// that the query covers, clipped to the song.
+	TrackStart int
+	TrackEnd   int
+	// Speed is how fast the query plays relative to the song: 1.05 means
+	// 5% faster. It is always 1 unless the catalog uses ratio hashes.
+	Speed float64
+
+	// Ratio is MatchCount over the best MatchCount of any other song.
+	Ratio float64
+	// Coverage is the fraction of query fingerprints aligned at MatchOffset.
+	Coverage float64
+	// Significance is -log10 of the probability that Votes random hits
+	// would pile up MatchCount high in some offset bin.
+	Significance float64
+	// Confidence in [0, 1] combines Significance and Ratio; see confidence.
+	Confidence float64
 }
 
-func MatchHashes(queryFingerprints []db.Fingerprint, DB *gorm.DB) ([]MatchedSongOptimized, error) {
+// MatchHashes scores the songs sharing hashes with queryFingerprints. cfg must
+// be the config the query was fingerprinted with; songs indexed under any
+// other config are not compared.
+//
+// Candidates are selected in two stages. Songs are first ranked by how many
+// of their fingerprints share a hash with the query, counted in the store;
+// only the mc.MaxCandidates best with at least mc.MinCandidateHits hits are
+// kept. The postings of those songs alone are then loaded and scored by
+// offset alignment.
+func MatchHashes(queryFingerprints []db.Fingerprint, cfg fingerprint.FingerprintConfig, mc MatchConfig, store db.FingerprintStore) ([]MatchedSongOptimized, error) {
 	queryLength := len(queryFingerprints)
-	thresholdForQuery := (queryLength)
 	if queryLength == 0 {
 		return nil, nil
 	}
 
-	const freqThreshold = 20.0
-	const timeDeltaThreshold = 20.0
-	const timeDeltaWeight = 0.3
-	const countWeight = 0.7
-
-	histogram := make(map[string]map[int]int)
-	timedeltaHistogram := make(map[string]map[int]int)
-	queryHashMap := make(map[string][]db.Fingerprint)
-	sliceOfHash := make([]string, 0, len(queryFingerprints))
+	queryHashMap, sliceOfHash := indexQuery(queryFingerprints)
 
-	for _, qfp := range queryFingerprints {
-		hashHex := qfp.Hash
-		sliceOfHash = append(sliceOfHash, hashHex)
-		queryHashMap[hashHex] = append(queryHashMap[hashHex], qfp)
+	hits, err := store.HitsPerSong(sliceOfHash)
+	if err != nil {
+		return nil, err
+	}
+	ranked := rankCandidates(hits, mc.MinCandidateHits)
+	if len(ranked) == 0 {
+		return []MatchedSongOptimized{}, nil
 	}
 
-	allFingerPrints := []db.Fingerprint{}
-
-	type SongCount struct {
-		SongID string
-		Count  int
+	songs, songIDs, err := compatibleCandidates(store, ranked, cfg, mc.MaxCandidates)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Qualified songs: %d of %d with hits\n", len(songIDs), len(hits))
+	if len(songIDs) == 0 {
+		return nil, ErrIncompatibleConfig
 	}
 
-	var qualifiedSongs []SongCount
-	err := DB.
-		Table("fingerprints").
-		Select("song_id, COUNT(*) as count").
-		Where("hash IN ?", sliceOfHash).
-		Group("song_id").
-		Having("COUNT(*) >= ?", thresholdForQuery).
-		Scan(&qualifiedSongs).Error
+	allFingerPrints, err := store.LookupHashesForSongs(sliceOfHash, songIDs)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("Qualified songs: ", len(qualifiedSongs))
 
-	songIDs := make([]string, 0, len(qualifiedSongs))
-	for _, entry := range qualifiedSongs {
-		songIDs = append(songIDs, entry.SongID)
+	v := newVoter(cfg, mc)
+	for _, afp := range allFingerPrints {
+		v.add(afp, queryHashMap[afp.Hash])
 	}
+	return v.matches(songs, queryLength, queryDuration(queryFingerprints)), nil
+}
 
-	if len(songIDs) == 0 {
-		return []MatchedSongOptimized{}, nil
+// rankCandidates returns the songs with at least minHits hits, most hits
+// first and by ID among equals.
+func rankCandidates(hits map[uint]int, minHits int) []uint {
+	ranked := make([]uint, 0, len(hits))
+	for songID, count := range hits {
+		if count >= minHits {
+			ranked = append(ranked, songID)
+		}
 	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if hits[a] != hits[b] {
+			return hits[a] > hits[b]
+		}
+		return a < b
+	})
+	return ranked
+}
 
-	results := DB.
-		Where("hash IN ?", sliceOfHash).
-		Find(&allFingerPrints)
-	if results.Error != nil {
-		return nil, results.Error
+// compatibleCandidates walks ranked and returns up to limit songs indexed
+// under cfg, with their IDs in rank order. Songs under another config are
+// passed over rather than counted, so they cannot crowd out real
+// candidates.
+func compatibleCandidates(store songSource, ranked []uint, cfg fingerprint.FingerprintConfig, limit int) (map[uint]db.Song, []uint, error) {
+	songs := make(map[uint]db.Song, limit)
+	songIDs := make([]uint, 0, limit)
+	for len(ranked) > 0 && len(songIDs) < limit {
+		batch := ranked[:min(len(ranked), limit-len(songIDs))]
+		ranked = ranked[len(batch):]
+
+		found, err := store.Songs(batch)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, songID := range batch {
+			if song, ok := found[songID]; ok && song.ConfigID == cfg.ID() {
+				songs[songID] = song
+				songIDs = append(songIDs, songID)
+			}
+		}
 	}
+	return songs, songIDs, nil
+}
 
-	for _, afp := range allFingerPrints {
-		qfps := queryHashMap[afp.Hash]
-		for _, qfp := range qfps {
-			freqDiffQuery := math.Abs(qfp.AnchorFreq - qfp.TargetFreq)
-			freqDiffDB := math.Abs(afp.AnchorFreq - afp.TargetFreq)
-			if math.Abs(freqDiffQuery-freqDiffDB) <= freqThreshold {
-				if math.Abs(afp.TimeDelta-qfp.TimeDelta) <= timeDeltaThreshold {
-					offset := int(afp.AnchorTime - qfp.AnchorTime)
-					timedelta := int(afp.TimeDelta - qfp.TimeDelta)
-					if _, ok := histogram[afp.SongID]; !ok {
-						histogram[afp.SongID] = make(map[int]int)
-					}
-					histogram[afp.SongID][offset]++
-
-					if _, ok := timedeltaHistogram[afp.SongID]; !ok {
-						timedeltaHistogram[afp.SongID] = make(map[int]int)
-					}
-					timedeltaHistogram[afp.SongID][timedelta]++
+// queryDuration returns the span of audio queryFingerprints cover, in
+// seconds.
+func queryDuration(queryFingerprints []db.Fingerprint) float64 {
+	duration := 0.0
+	for _, qfp := range queryFingerprints {
+		duration = max(duration, qfp.AnchorTime+qfp.TimeDelta)
+	}
+	return duration
+}
+
+// indexQuery groups query fingerprints by hash and lists the distinct hashes
+// in first-seen order.
+func indexQuery(queryFingerprints []db.Fingerprint) (map[int32][]db.Fingerprint, []int32) {
+	queryHashMap := make(map[int32][]db.Fingerprint)
+	sliceOfHash := make([]int32, 0, len(queryFingerprints))
+	for _, qfp := range queryFingerprints {
+		if _, seen := queryHashMap[qfp.Hash]; !seen {
+			sliceOfHash = append(sliceOfHash, qfp.Hash)
+		}
+		queryHashMap[qfp.Hash] = append(queryHashMap[qfp.Hash], qfp)
+	}
+	return queryHashMap, sliceOfHash
+}
+
+// voter accumulates the evidence of catalog fingerprints matching a query's
+// and turns it into scored songs.
+type voter interface {
+	// add casts the votes of catalog fingerprint afp against the query
+	// fingerprints sharing its hash.
+	add(afp db.Fingerprint, qfps []db.Fingerprint)
+	// matches scores every song with votes against a query of queryLength
+	// fingerprints spanning queryDuration seconds, best first.
+	matches(songs map[uint]db.Song, queryLength int, queryDuration float64) []MatchedSongOptimized
+}
+
+// newVoter returns the voter for the hash mode of cfg.
+func newVoter(cfg fingerprint.FingerprintConfig, mc MatchConfig) voter {
+	if cfg.RatioHashes() {
+		return newScaleVotes(cfg, mc)
+	}
+	return newVotes(mc.OffsetBinMs)
+}
+
+// votes is the per-song histogram of time offsets (and time delta
+// differences) between matching query and catalog fingerprints. A true match
+// piles its votes up at a single offset.
+type votes struct {
+	binMs              int
+	histogram          map[uint]map[int]int
+	offsetSums         map[uint]map[int]float64 // exact offsets per bin, summed
+	timedeltaHistogram map[uint]map[int]int
+}
+
+func newVotes(binMs int) *votes {
+	return &votes{
+		binMs:              binMs,
+		histogram:          make(map[uint]map[int]int),
+		offsetSums:         make(map[uint]map[int]float64),
+		timedeltaHistogram: make(map[uint]map[int]int),
+	}
+}
+
+func (v *votes) add(afp db.Fingerprint, qfps []db.Fingerprint) {
+	const freqThreshold = 20.0
+
+	for _, qfp := range qfps {
+		freqDiffQuery := math.Abs(qfp.AnchorFreq - qfp.TargetFreq)
+		freqDiffDB := math.Abs(afp.AnchorFreq - afp.TargetFreq)
+		if math.Abs(freqDiffQuery-freqDiffDB) <= freqThreshold {
+			if math.Abs(afp.TimeDelta-qfp.TimeDelta) <= TIME_DELTA_TOLERANCE {
+				offset := afp.AnchorTime - qfp.AnchorTime
+				bin := offsetBin(offset, v.binMs)
+				timedelta := int(afp.TimeDelta - qfp.TimeDelta)
+				if _, ok := v.histogram[afp.SongID]; !ok {
+					v.histogram[afp.SongID] = make(map[int]int)
+					v.offsetSums[afp.SongID] = make(map[int]float64)
+				}
+				v.histogram[afp.SongID][bin]++
+				v.offsetSums[afp.SongID][bin] += offset
+
+				if _, ok := v.timedeltaHistogram[afp.SongID]; !ok {
+					v.timedeltaHistogram[afp.SongID] = make(map[int]int)
 				}
+				v.timedeltaHistogram[afp.SongID][timedelta]++
 			}
 		}
 	}
+}
+
+func (v *votes) matches(songs map[uint]db.Song, queryLength int, queryDuration float64) []MatchedSongOptimized {
+	const timeDeltaWeight = 0.3
+	const countWeight = 0.7
 
 	finalMatches := []MatchedSongOptimized{}
-	for songID, offsetMap := range histogram {
-		bestOffset := 0
-		maxCount := 0
-		for offset, count := range offsetMap {
-			if count > maxCount {
-				maxCount = count
-				bestOffset = offset
-			}
+	for songID, offsetMap := range v.histogram {
+		bestBin, maxCount := peakWindow(offsetMap)
+		total := 0
+		minBin, maxBin := math.MaxInt, math.MinInt
+		for bin, count := range offsetMap {
+			total += count
+			minBin = min(minBin, bin)
+			maxBin = max(maxBin, bin)
+		}
+		// The offset is the mean of the exact offsets in the window rather
+		// than the bin edge.
+		sum := 0.0
+		for bin := bestBin - 1; bin <= bestBin+1; bin++ {
+			sum += v.offsetSums[songID][bin]
 		}
+		offset := sum / float64(maxCount)
 
-		bestTimedelta := 0
 		maxTDCount := 0
-		if tdMap, exists := timedeltaHistogram[songID]; exists {
-			for td, count := range tdMap {
+		if tdMap, exists := v.timedeltaHistogram[songID]; exists {
+			for _, count := range tdMap {
 				if count > maxTDCount {
 					maxTDCount = count
-					bestTimedelta = td
 				}
 			}
 		}
-		fmt.Println(bestTimedelta)
 		score := int(float64(maxCount)*countWeight + float64(maxTDCount)*timeDeltaWeight)
+		song := songs[songID]
+		// A random hit can land in any bin between the query starting
+		// before the song and it starting at the song's end.
+		bins := max(maxBin-minBin+1, offsetBins(song.Duration+queryDuration, v.binMs))
 		match := MatchedSongOptimized{
-			SongID:      songID,
-			MatchOffset: bestOffset,
-			MatchCount:  maxCount,
-			Score:       score,
+			Song:         song,
+			MatchCount:   maxCount,
+			Score:        score,
+			Votes:        total,
+			Coverage:     float64(maxCount) / float64(max(queryLength, 1)),
+			Significance: significance(maxCount, WINDOW_BINS*total, bins),
 		}
+		match.locate(offset, 1, queryDuration)
 		finalMatches = append(finalMatches, match)
 	}
+	rank(finalMatches)
 
+	return finalMatches
+}
+
+// WINDOW_BINS is the number of offset bins a match is counted over: the
+// peak bin and one neighbour either side, so that votes straddling a bin
+// edge are not split.
+const WINDOW_BINS = 3
+
+// offsetBin returns the bin of binMs milliseconds holding offset seconds.
+func offsetBin(offset float64, binMs int) int {
+	return int(math.Floor(offset * 1000 / float64(binMs)))
+}
+
+// offsetBins returns the number of bins of binMs milliseconds in seconds.
+func offsetBins(seconds float64, binMs int) int {
+	return int(math.Ceil(seconds * 1000 / float64(binMs)))
+}
+
+// peakWindow returns the bin whose window of WINDOW_BINS bins centred on it
+// holds the most votes of histogram, and that number of votes. Ties go to
+// the earliest bin.
+func peakWindow(histogram map[int]int) (bin, count int) {
+	// Only bins next to a vote can centre a non-empty window.
+	for b := range histogram {
+		for centre := b - 1; centre <= b+1; centre++ {
+			c := histogram[centre-1] + histogram[centre] + histogram[centre+1]
+			if c > count || c == count && centre < bin {
+				bin, count = centre, c
+			}
+		}
+	}
+	return bin, count
+}
+
+// locate sets the offset and the covered part of the song of m from the
+// query's offset in seconds, its speed and its duration in seconds.
+func (m *MatchedSongOptimized) locate(offset, speed, queryDuration float64) {
+	m.MatchOffset = int(math.Round(offset * 1000))
+	m.Speed = speed
+	start := max(0, offset)
+	end := offset + speed*queryDuration
+	if m.Song.Duration > 0 {
+		end = min(end, m.Song.Duration)
+	}
+	m.TrackStart = int(math.Round(start * 1000))
+	m.TrackEnd = int(math.Round(max(start, end) * 1000))
+}
+
+// rank sorts matches best first and rates them. Aligned hashes rank the
+// songs; Score and ID only break ties.
+func rank(finalMatches []MatchedSongOptimized) {
 	sort.Slice(finalMatches, func(i, j int) bool {
-		return finalMatches[i].Score > finalMatches[j].Score
+		a, b := finalMatches[i], finalMatches[j]
+		if a.MatchCount != b.MatchCount {
+			return a.MatchCount > b.MatchCount
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Song.ID < b.Song.ID
 	})
-
-	return finalMatches, nil
+	rate(finalMatches)
 }
 
+// RecogniseSong matches an uploaded clip against the Postgres catalog.
 func RecogniseSong(c *gin.Context) {
+	NewRecogniseHandler(db.NewGormStore(db.DB), fingerprint.DefaultConfig(), DefaultMatchConfig())(c)
+}
+
+// NewRecogniseHandler returns a handler that fingerprints the clip uploaded
+// in the "audio" form field with cfg and matches it against store. It
+// always answers 200 with a SearchResult; "matched" is false when no
+// candidate passes mc or every candidate was indexed under another config.
+func NewRecogniseHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc MatchConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		recogniseSong(c, store, cfg, mc)
+	}
+}
+
+func recogniseSong(c *gin.Context, store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc MatchConfig) {
 
 	fileHeader, err := c.FormFile("audio")
 	if err != nil {
@@ -175,51 +389,29 @@ func RecogniseSong(c *gin.Context) {
 	}
 	defer uploadedFile.Close()
 
-	tempM4AFile, err := os.CreateTemp("", "upload-*.m4a")
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create temp m4a file"})
+	buf, err := audio.DecodeMedia(uploadedFile, fileHeader.Header.Get("Content-Type"))
+	if errors.Is(err, audio.ErrUnknownFormat) {
+		c.JSON(415, gin.H{"error": "Unsupported audio format"})
 		return
 	}
-	defer os.Remove(tempM4AFile.Name())
-	defer tempM4AFile.Close()
-
-	_, err = io.Copy(tempM4AFile, uploadedFile)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save uploaded file"})
-		return
-	}
-	tempM4AFile.Close()
-
-	tempWAVFilePath := tempM4AFile.Name() + ".wav"
-	cmd := exec.Command("ffmpeg", "-i", tempM4AFile.Name(), tempWAVFilePath)
-	if err := cmd.Run(); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to convert audio to WAV: " + err.Error()})
+		c.JSON(422, gin.H{"error": "Failed to decode audio: " + err.Error()})
 		return
 	}
-	defer os.Remove(tempWAVFilePath)
 
-	wavFile, err := os.Open(tempWAVFilePath)
+	fingerPrints, err := fingerprint.FingerprintAudio(buf, 0, cfg)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to open converted WAV file"})
+		c.JSON(500, gin.H{"error": "Failed to fingerprint audio: " + err.Error()})
 		return
 	}
-	defer wavFile.Close()
 
-	d := wav.NewDecoder(wavFile)
-	buf, err := d.FullPCMBuffer()
+	result, err := Search(fingerPrints, cfg, mc, store)
+	if errors.Is(err, ErrIncompatibleConfig) {
+		result, err = mc.Decide(nil, len(fingerPrints)), nil
+	}
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to read PCM buffer from WAV: " + err.Error()})
+		c.JSON(500, gin.H{"error": "Failed to match fingerprints: " + err.Error()})
 		return
 	}
-
-	samples := buf.AsFloatBuffer().Data
-
-	fingerPrints := fingerprint.Fingerprint(&samples, "song")
-
-	hashes, _ := MatchHashes(fingerPrints, db.DB)
-	if len(hashes) == 0 {
-		c.JSON(200, gin.H{"message": "No matches found"})
-	} else {
-		c.JSON(200, hashes)
-	}
+	c.JSON(200, result)
 }
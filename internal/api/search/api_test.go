@@ -0,0 +1,379 @@
+package search
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"github.com/gin-gonic/gin"
+)
+
+// synthSong returns seconds of audio at rate made of two random tones that
+// change every 200ms, seeded by seed.
+func synthSong(seed int64, rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(seconds*float64(rate)))
+	step := rate / 5
+	var f1, f2 float64
+	for i := range samples {
+		if i%step == 0 {
+			f1, f2 = 200+rng.Float64()*1800, 2000+rng.Float64()*2500
+		}
+		t := float64(i) / float64(rate)
+		samples[i] = 0.4*math.Sin(2*math.Pi*f1*t) + 0.3*math.Sin(2*math.Pi*f2*t)
+	}
+	return samples
+}
+
+type testCatalog struct {
+	store *db.MemoryStore
+	cfg   fingerprint.FingerprintConfig
+	audio map[uint][]float64
+}
+
+func newTestCatalog(t *testing.T, songs int, seconds float64) *testCatalog {
+	t.Helper()
+	c := &testCatalog{store: db.NewMemoryStore(), cfg: fingerprint.DefaultConfig(), audio: make(map[uint][]float64)}
+	for i := range songs {
+		samples := synthSong(int64(i+1), c.cfg.SampleRate, seconds)
+		fps, err := fingerprint.Fingerprint(&samples, 0, c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		song := db.Song{Title: "synth", ConfigID: c.cfg.ID(), SampleRate: c.cfg.SampleRate, Duration: seconds}
+		if err := c.store.AddSong(&song, fps); err != nil {
+			t.Fatal(err)
+		}
+		c.audio[song.ID] = samples
+	}
+	return c
+}
+
+// clip fingerprints seconds of song from start, with some noise added.
+func (c *testCatalog) clip(t *testing.T, songID uint, start, seconds float64) []db.Fingerprint {
+	t.Helper()
+	rate := float64(c.cfg.SampleRate)
+	src := c.audio[songID][int(start*rate):int((start+seconds)*rate)]
+	rng := rand.New(rand.NewSource(int64(songID)))
+	samples := make([]float64, len(src))
+	for i, s := range src {
+		samples[i] = s + 0.05*(rng.Float64()*2-1)
+	}
+	fps, err := fingerprint.Fingerprint(&samples, 0, c.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fps
+}
+
+func TestMatchHashesShortClips(t *testing.T) {
+	catalog := newTestCatalog(t, 6, 30)
+	mc := DefaultMatchConfig()
+	const start = 7.3
+
+	for _, seconds := range []float64{3, 5, 10} {
+		for songID := range catalog.audio {
+			query := catalog.clip(t, songID, start, seconds)
+			if len(query) == 0 {
+				t.Fatalf("%gs clip of song %d has no fingerprints", seconds, songID)
+			}
+
+			// Stage one: the source song leads the hit ranking.
+			_, hashes := indexQuery(query)
+			hits, err := catalog.store.HitsPerSong(hashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ranked := rankCandidates(hits, mc.MinCandidateHits)
+			if len(ranked) == 0 || ranked[0] != songID {
+				t.Errorf("%gs clip of song %d: candidates %v (hits %v), want song %d first", seconds, songID, ranked, hits, songID)
+				continue
+			}
+
+			// Stage two: offset alignment picks it with confidence.
+			matches, err := MatchHashes(query, catalog.cfg, mc, catalog.store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) == 0 || matches[0].Song.ID != songID {
+				t.Errorf("%gs clip of song %d: best match %v, want song %d", seconds, songID, matches, songID)
+				continue
+			}
+			best := matches[0]
+			if best.Confidence < mc.MinConfidence {
+				t.Errorf("%gs clip of song %d: confidence %.2f below %.2f", seconds, songID, best.Confidence, mc.MinConfidence)
+			}
+			// The offset is binned, and the clip does not start on a frame.
+			tolerance := float64(mc.OffsetBinMs) + 1000/catalog.cfg.FramesPerSecond()
+			if d := math.Abs(float64(best.MatchOffset) - start*1000); d > tolerance {
+				t.Errorf("%gs clip of song %d: offset %dms, want %gms", seconds, songID, best.MatchOffset, start*1000)
+			}
+		}
+	}
+}
+
+func TestSearchReturnsSongMetadata(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	samples := synthSong(9, cfg.SampleRate, 20)
+	fps, err := fingerprint.Fingerprint(&samples, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemoryStore()
+	song := db.Song{
+		Title: "Song", Artist: "Artist", Album: "Album", Duration: 20, SourcePath: "music/song.wav",
+		ConfigID: cfg.ID(), SampleRate: cfg.SampleRate, SourceSampleRate: 48000,
+	}
+	if err := store.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+
+	clip := samples[5*cfg.SampleRate : 10*cfg.SampleRate]
+	query, err := fingerprint.Fingerprint(&clip, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Search(query, cfg, DefaultMatchConfig(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Matched {
+		t.Fatalf("clip not matched, candidates %+v", result.Candidates)
+	}
+	if got := result.Match.Song; !reflect.DeepEqual(got, song) {
+		t.Errorf("matched song %+v, want %+v", got, song)
+	}
+}
+
+func TestSearchNormalizesQueryRate(t *testing.T) {
+	catalog := newTestCatalog(t, 4, 20)
+	const songID, start, seconds = 3, 6, 5
+
+	// synthSong changes tone at the same times at any rate, so these are
+	// the same clip recorded at other rates, in stereo.
+	for _, rate := range []int{48000, 22050, 16000} {
+		song := synthSong(songID, rate, 20)
+		mono := song[start*rate : (start+seconds)*rate]
+		stereo := make([]float64, 2*len(mono))
+		for i, s := range mono {
+			stereo[2*i], stereo[2*i+1] = s, s
+		}
+		buf := &audio.Buffer{Format: audio.Format{SampleRate: rate, Channels: 2}, Data: stereo}
+		query, err := fingerprint.FingerprintAudio(buf, 0, catalog.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Search(query, catalog.cfg, DefaultMatchConfig(), catalog.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Matched || result.Match.Song.ID != songID {
+			t.Errorf("%d Hz clip of song %d: matched %v, candidates %+v", rate, songID, result.Match, result.Candidates)
+			continue
+		}
+		tolerance := float64(DefaultMatchConfig().OffsetBinMs) + 1000/catalog.cfg.FramesPerSecond()
+		if d := math.Abs(float64(result.Match.MatchOffset) - start*1000); d > tolerance {
+			t.Errorf("%d Hz clip: offset %dms, want %dms", rate, result.Match.MatchOffset, start*1000)
+		}
+	}
+}
+
+func TestMatchHashesScoresOnlyTopCandidates(t *testing.T) {
+	catalog := newTestCatalog(t, 4, 20)
+	query := catalog.clip(t, 3, 4, 5)
+
+	mc := DefaultMatchConfig()
+	mc.MaxCandidates = 1
+	mc.MinConfidence = 0
+	matches, err := MatchHashes(query, catalog.cfg, mc, catalog.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		if m.Song.ID != 3 {
+			t.Errorf("song %d was scored with MaxCandidates 1, want only song 3", m.Song.ID)
+		}
+	}
+	if len(matches) == 0 {
+		t.Error("no match with MaxCandidates 1")
+	}
+
+	// A hit floor no song reaches leaves nothing to score.
+	mc.MinCandidateHits = 1 << 30
+	matches, err = MatchHashes(query, catalog.cfg, mc, catalog.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("%d matches above the hit floor, want none", len(matches))
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	hits := map[uint]int{1: 4, 2: 30, 3: 12, 4: 30, 5: 5}
+	got := rankCandidates(hits, 5)
+	want := []uint{2, 4, 3, 5}
+	if len(got) != len(want) {
+		t.Fatalf("ranked %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ranked %v, want %v", got, want)
+		}
+	}
+}
+
+// postClips uploads clips, sampled at rate, to handler as 16-bit PCM in the
+// "audio" form field.
+func postClips(t *testing.T, handler gin.HandlerFunc, rate int, clips ...[]float64) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, clip := range clips {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="audio"; filename="clip%d.pcm"`, i))
+		header.Set("Content-Type", fmt.Sprintf("audio/L16; rate=%d", rate))
+		part, err := form.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range clip {
+			binary.Write(part, binary.BigEndian, int16(s*math.MaxInt16))
+		}
+	}
+	form.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", handler)
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSearchHandlersTreatIncompatibleConfigAsNoMatch(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	samples := synthSong(1, cfg.SampleRate, 10)
+	fps, err := fingerprint.Fingerprint(&samples, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The song was indexed under another config than the server's.
+	store := db.NewMemoryStore()
+	song := db.Song{Title: "synth", ConfigID: "another config", SampleRate: cfg.SampleRate}
+	if err := store.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+	mc := DefaultMatchConfig()
+	clip := samples[2*cfg.SampleRate : 7*cfg.SampleRate]
+	query, err := fingerprint.Fingerprint(&clip, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MatchHashes(query, cfg, mc, store); !errors.Is(err, ErrIncompatibleConfig) {
+		t.Fatalf("MatchHashes: %v, want ErrIncompatibleConfig", err)
+	}
+
+	w := postClips(t, NewRecogniseHandler(store, cfg, mc), cfg.SampleRate, clip)
+	var result SearchResult
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil {
+		t.Fatalf("/search answered %d: %s", w.Code, w.Body)
+	}
+	if result.Matched || result.Match != nil || result.Candidates == nil || len(result.Candidates) != 0 {
+		t.Errorf("/search answered %s, want the no-match result", w.Body)
+	}
+
+	w = postClips(t, NewBatchHandler(store, cfg, mc), cfg.SampleRate, clip, clip)
+	var batch BatchResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &batch) != nil {
+		t.Fatalf("/search/batch answered %d: %s", w.Code, w.Body)
+	}
+	if len(batch.Results) != 2 {
+		t.Fatalf("/search/batch answered %s, want two results", w.Body)
+	}
+	for _, item := range batch.Results {
+		if item.Error != "" || item.Result == nil || item.Result.Matched || item.Result.QueryFingerprints == 0 {
+			t.Errorf("/search/batch answered %+v for %s, want a no-match result", item, item.File)
+		}
+	}
+}
+
+func TestMatchOffsetAndTrackSpan(t *testing.T) {
+	const songSeconds = 20
+	catalog := newTestCatalog(t, 3, songSeconds)
+	mc := DefaultMatchConfig()
+	rate := float64(catalog.cfg.SampleRate)
+	// Clips are cut on frame boundaries; elsewhere peak times are off by up
+	// to a frame, which is wider than a bin.
+	at := func(frames int) float64 { return float64(frames) / catalog.cfg.FramesPerSecond() }
+	silence := func(seconds float64) []float64 { return make([]float64, int(math.Round(seconds*rate))) }
+	excerpt := func(songID uint, from, to float64) []float64 {
+		return catalog.audio[songID][int(math.Round(from*rate)):int(math.Round(to*rate))]
+	}
+
+	cases := []struct {
+		name   string
+		songID uint
+		clip   []float64
+		offset float64 // seconds into the song the clip starts
+		start  float64 // covered span of the song, in seconds
+		end    float64
+	}{
+		{"middle", 2, excerpt(2, at(157), at(157)+5), at(157), at(157), at(157) + 5},
+		{"from the start", 1, excerpt(1, 0, 4), 0, 0, 4},
+		{"late start", 3, excerpt(3, at(254), at(254)+4), at(254), at(254), at(254) + 4},
+		// Recorded before the song began and on into the next one: the
+		// span is clipped to the song.
+		{"lead-in", 2, append(silence(at(43)), excerpt(2, 0, 4)...), -at(43), 0, 4},
+		{"run-out", 1, append(excerpt(1, at(356), songSeconds), excerpt(3, 0, 2)...), at(356), at(356), songSeconds},
+	}
+	for _, c := range cases {
+		query, err := fingerprint.Fingerprint(&c.clip, 0, catalog.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Search(query, catalog.cfg, mc, catalog.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Matched || result.Match.Song.ID != c.songID {
+			t.Errorf("%s: matched %v, want song %d", c.name, result.Match, c.songID)
+			continue
+		}
+		m := result.Match
+		if d := math.Abs(float64(m.MatchOffset) - c.offset*1000); d > float64(mc.OffsetBinMs) {
+			t.Errorf("%s: offset %dms, want %gms within a %dms bin", c.name, m.MatchOffset, c.offset*1000, mc.OffsetBinMs)
+		}
+		if d := math.Abs(float64(m.TrackStart) - c.start*1000); d > float64(mc.OffsetBinMs) {
+			t.Errorf("%s: track starts at %dms, want %gms", c.name, m.TrackStart, c.start*1000)
+		}
+		// The query is known to last until its last target peak, which
+		// in this audio comes within two tone changes of the clip's end.
+		heard := min(c.offset+queryDuration(query), songSeconds)
+		if d := math.Abs(float64(m.TrackEnd) - heard*1000); d > float64(mc.OffsetBinMs) {
+			t.Errorf("%s: track ends at %dms, want %gms", c.name, m.TrackEnd, heard*1000)
+		}
+		if d := c.end - heard; d < 0 || d > 0.4 {
+			t.Errorf("%s: query heard until %gs into the song, clip ends at %gs", c.name, heard, c.end)
+		}
+		if m.TrackEnd > songSeconds*1000 {
+			t.Errorf("%s: track ends at %dms, past the song's end", c.name, m.TrackEnd)
+		}
+	}
+}
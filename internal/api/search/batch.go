@@ -0,0 +1,304 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MAX_BATCH_CLIPS is the number of clips a batch request may carry.
+	MAX_BATCH_CLIPS = 256
+)
+
+// BatchMatch is the outcome of one query of a MatchMany batch. Err is set,
+// and Matches empty, when the query could not be matched on its own, for
+// example with ErrIncompatibleConfig.
+type BatchMatch struct {
+	Matches []MatchedSongOptimized
+	Err     error
+}
+
+// MatchMany is MatchHashes for a batch of queries, all fingerprinted with
+// cfg. Each query gets the candidates and scores MatchHashes would give it,
+// but the union of the queries' hashes is looked up once per stage: one
+// request counts the hits per hash and song, one fetches the songs and one
+// loads the postings of every query's candidates. The store round-trips
+// therefore do not grow with the number of queries.
+func MatchMany(queries [][]db.Fingerprint, cfg fingerprint.FingerprintConfig, mc MatchConfig, store db.FingerprintStore) ([]BatchMatch, error) {
+	results := make([]BatchMatch, len(queries))
+	indexes := make([]map[int32][]db.Fingerprint, len(queries))
+	hashLists := make([][]int32, len(queries))
+	var union []int32
+	seen := make(map[int32]bool)
+	for i, query := range queries {
+		indexes[i], hashLists[i] = indexQuery(query)
+		for _, hash := range hashLists[i] {
+			if !seen[hash] {
+				seen[hash] = true
+				union = append(union, hash)
+			}
+		}
+	}
+	if len(union) == 0 {
+		return results, nil
+	}
+
+	perHash, err := store.HitsPerHash(union)
+	if err != nil {
+		return nil, err
+	}
+	rankings := make([][]uint, len(queries))
+	var firstChoices []uint
+	for i, hashes := range hashLists {
+		hits := make(map[uint]int)
+		for _, hash := range hashes {
+			for songID, n := range perHash[hash] {
+				hits[songID] += n
+			}
+		}
+		rankings[i] = rankCandidates(hits, mc.MinCandidateHits)
+		firstChoices = append(firstChoices, rankings[i][:min(len(rankings[i]), mc.MaxCandidates)]...)
+	}
+
+	// Fetch every query's first choices together; only queries that pass
+	// over songs indexed under another config need more.
+	songs := newSongCache(store)
+	if err := songs.fetch(firstChoices); err != nil {
+		return nil, err
+	}
+	candidates := make([]map[uint]db.Song, len(queries))
+	var candidateIDs []uint
+	chosen := make(map[uint]bool)
+	for i, ranked := range rankings {
+		if len(ranked) == 0 {
+			results[i].Matches = []MatchedSongOptimized{}
+			continue
+		}
+		found, songIDs, err := compatibleCandidates(songs, ranked, cfg, mc.MaxCandidates)
+		if err != nil {
+			return nil, err
+		}
+		if len(songIDs) == 0 {
+			results[i].Err = ErrIncompatibleConfig
+			continue
+		}
+		candidates[i] = found
+		for _, songID := range songIDs {
+			if !chosen[songID] {
+				chosen[songID] = true
+				candidateIDs = append(candidateIDs, songID)
+			}
+		}
+	}
+	if len(candidateIDs) == 0 {
+		return results, nil
+	}
+
+	allFingerPrints, err := store.LookupHashesForSongs(union, candidateIDs)
+	if err != nil {
+		return nil, err
+	}
+	postings := make(map[int32][]db.Fingerprint)
+	for _, afp := range allFingerPrints {
+		postings[afp.Hash] = append(postings[afp.Hash], afp)
+	}
+
+	for i, query := range queries {
+		if candidates[i] == nil {
+			continue
+		}
+		v := newVoter(cfg, mc)
+		for _, hash := range hashLists[i] {
+			for _, afp := range postings[hash] {
+				if _, ok := candidates[i][afp.SongID]; ok {
+					v.add(afp, indexes[i][hash])
+				}
+			}
+		}
+		results[i].Matches = v.matches(candidates[i], len(query), queryDuration(query))
+	}
+	return results, nil
+}
+
+// songSource looks up catalog songs by ID.
+type songSource interface {
+	Songs(songIDs []uint) (map[uint]db.Song, error)
+}
+
+// songCache is a songSource that asks store for each song at most once.
+type songCache struct {
+	store   db.FingerprintStore
+	songs   map[uint]db.Song
+	fetched map[uint]bool
+}
+
+func newSongCache(store db.FingerprintStore) *songCache {
+	return &songCache{store: store, songs: make(map[uint]db.Song), fetched: make(map[uint]bool)}
+}
+
+// fetch loads the songs of songIDs not requested before.
+func (c *songCache) fetch(songIDs []uint) error {
+	var missing []uint
+	for _, songID := range songIDs {
+		if !c.fetched[songID] {
+			c.fetched[songID] = true
+			missing = append(missing, songID)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	found, err := c.store.Songs(missing)
+	if err != nil {
+		for _, songID := range missing {
+			delete(c.fetched, songID)
+		}
+		return err
+	}
+	for songID, song := range found {
+		c.songs[songID] = song
+	}
+	return nil
+}
+
+func (c *songCache) Songs(songIDs []uint) (map[uint]db.Song, error) {
+	if err := c.fetch(songIDs); err != nil {
+		return nil, err
+	}
+	found := make(map[uint]db.Song, len(songIDs))
+	for _, songID := range songIDs {
+		if song, ok := c.songs[songID]; ok {
+			found[songID] = song
+		}
+	}
+	return found, nil
+}
+
+// SearchMany is Search for a batch of queries; see MatchMany. A query that
+// could not be matched has a nil result and its error at the same index.
+func SearchMany(queries [][]db.Fingerprint, cfg fingerprint.FingerprintConfig, mc MatchConfig, store db.FingerprintStore) ([]*SearchResult, []error, error) {
+	matches, err := MatchMany(queries, cfg, mc, store)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]*SearchResult, len(queries))
+	errs := make([]error, len(queries))
+	for i, m := range matches {
+		if m.Err != nil {
+			errs[i] = m.Err
+			continue
+		}
+		result := mc.Decide(m.Matches, len(queries[i]))
+		results[i] = &result
+	}
+	return results, errs, nil
+}
+
+// BatchItem is the outcome for one clip of a batch search.
+type BatchItem struct {
+	File   string        `json:"file"`
+	Result *SearchResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// BatchResponse lists the outcomes of a batch search in upload order.
+type BatchResponse struct {
+	Results []BatchItem `json:"results"`
+}
+
+// NewBatchHandler returns a handler for POST /search/batch. It fingerprints
+// every clip uploaded in the "audio" form field with cfg, in parallel, and
+// matches them against store together with MatchMany. It answers 200 with a
+// BatchResponse as long as the batch itself is valid; clips that cannot be
+// decoded carry their own error.
+func NewBatchHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc MatchConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		searchBatch(c, store, cfg, mc)
+	}
+}
+
+func searchBatch(c *gin.Context, store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc MatchConfig) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read form: " + err.Error()})
+		return
+	}
+	files := form.File["audio"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No clips in the \"audio\" form field"})
+		return
+	}
+	if len(files) > MAX_BATCH_CLIPS {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("batch has %d clips, at most %d are allowed", len(files), MAX_BATCH_CLIPS)})
+		return
+	}
+
+	items := make([]BatchItem, len(files))
+	queries := make([][]db.Fingerprint, len(files))
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, fileHeader := range files {
+		items[i].File = fileHeader.Filename
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			queries[i], errs[i] = fingerprintClip(fileHeader, cfg)
+		}()
+	}
+	wg.Wait()
+
+	// Clips that failed are matched as empty queries, which find nothing.
+	results, matchErrs, err := SearchMany(queries, cfg, mc, store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match fingerprints: " + err.Error()})
+		return
+	}
+	for i := range items {
+		switch {
+		case errs[i] != nil:
+			items[i].Error = errs[i].Error()
+		case errors.Is(matchErrs[i], ErrIncompatibleConfig):
+			// No song indexed under cfg shares enough hashes with the clip.
+			result := mc.Decide(nil, len(queries[i]))
+			items[i].Result = &result
+		case matchErrs[i] != nil:
+			items[i].Error = matchErrs[i].Error()
+		default:
+			items[i].Result = results[i]
+		}
+	}
+	c.JSON(http.StatusOK, BatchResponse{Results: items})
+}
+
+// fingerprintClip decodes and fingerprints one uploaded clip.
+func fingerprintClip(fileHeader *multipart.FileHeader, cfg fingerprint.FingerprintConfig) ([]db.Fingerprint, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open clip: %w", err)
+	}
+	defer file.Close()
+
+	buf, err := audio.DecodeMedia(file, fileHeader.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("decode clip: %w", err)
+	}
+	return fingerprint.FingerprintAudio(buf, 0, cfg)
+}
@@ -0,0 +1,169 @@
+package search
+
+import (
+	"fmt"
+	"math"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+// MatchConfig decides which songs are scored, how many of them are reported
+// and when the best of them is accepted as the match.
+type MatchConfig struct {
+	// MaxCandidates is the number of songs, ranked by hash hits, whose
+	// postings are loaded and scored.
+	MaxCandidates int `yaml:"max_candidates" toml:"max_candidates"`
+	// MinCandidateHits is the number of hash hits a song needs to be a
+	// candidate at all.
+	MinCandidateHits int `yaml:"min_candidate_hits" toml:"min_candidate_hits"`
+
+	// MinMatchCount is the number of aligned hashes a match needs.
+	MinMatchCount int `yaml:"min_match_count" toml:"min_match_count"`
+	// MinConfidence is the confidence, in [0, 1], a match needs.
+	MinConfidence float64 `yaml:"min_confidence" toml:"min_confidence"`
+	// TopN is the number of candidates reported; 0 reports all of them.
+	TopN int `yaml:"top_n" toml:"top_n"`
+	// MaxSpeedChange is the largest relative speed difference between
+	// query and song that ratio hash matching looks for, e.g. 0.1 for
+	// ±10%. Pair hashes only match at the original speed.
+	MaxSpeedChange float64 `yaml:"max_speed_change" toml:"max_speed_change"`
+	// OffsetBinMs is the width, in milliseconds, of the bins query offsets
+	// are counted in. A match is counted over its bin and both neighbours.
+	OffsetBinMs int `yaml:"offset_bin_ms" toml:"offset_bin_ms"`
+}
+
+// DefaultMatchConfig returns the configuration used when none is supplied.
+func DefaultMatchConfig() MatchConfig {
+	return MatchConfig{
+		MaxCandidates:    MAX_CANDIDATES,
+		MinCandidateHits: MIN_CANDIDATE_HITS,
+		MinMatchCount:    MIN_MATCH_THRESHOLD,
+		MinConfidence:    MIN_CONFIDENCE,
+		TopN:             TOP_N_RESULTS,
+		MaxSpeedChange:   MAX_SPEED_CHANGE,
+		OffsetBinMs:      OFFSET_BIN_SIZE_MS,
+	}
+}
+
+// Validate reports the first setting outside its range.
+func (c MatchConfig) Validate() error {
+	switch {
+	case c.MaxCandidates < 1:
+		return fmt.Errorf("max candidates must be positive, got %d", c.MaxCandidates)
+	case c.MinCandidateHits < 1:
+		return fmt.Errorf("min candidate hits must be positive, got %d", c.MinCandidateHits)
+	case c.MinMatchCount < 1:
+		return fmt.Errorf("min match count must be positive, got %d", c.MinMatchCount)
+	case c.MinConfidence < 0 || c.MinConfidence > 1:
+		return fmt.Errorf("min confidence must be in [0, 1], got %g", c.MinConfidence)
+	case c.TopN < 0:
+		return fmt.Errorf("top n must not be negative, got %d", c.TopN)
+	case c.MaxSpeedChange < 0 || c.MaxSpeedChange >= 1:
+		return fmt.Errorf("max speed change must be in [0, 1), got %g", c.MaxSpeedChange)
+	case c.OffsetBinMs < 1:
+		return fmt.Errorf("offset bin must be at least 1 ms, got %d", c.OffsetBinMs)
+	}
+	return nil
+}
+
+// SearchResult is the outcome of a query. Match is the best candidate when
+// it passes the MatchConfig thresholds and nil otherwise: there is no
+// confident match, even if Candidates is not empty.
+type SearchResult struct {
+	Matched           bool                   `json:"matched"`
+	Match             *MatchedSongOptimized  `json:"match"`
+	Candidates        []MatchedSongOptimized `json:"candidates"`
+	QueryFingerprints int                    `json:"query_fingerprints"`
+}
+
+// Decide applies c to matches ranked by MatchHashes.
+func (c MatchConfig) Decide(matches []MatchedSongOptimized, queryLength int) SearchResult {
+	result := SearchResult{Candidates: matches, QueryFingerprints: queryLength}
+	if c.TopN > 0 && len(result.Candidates) > c.TopN {
+		result.Candidates = result.Candidates[:c.TopN]
+	}
+	if result.Candidates == nil {
+		result.Candidates = []MatchedSongOptimized{}
+	}
+	if len(matches) > 0 && c.Accepts(matches[0]) {
+		best := matches[0]
+		result.Matched = true
+		result.Match = &best
+	}
+	return result
+}
+
+// Accepts reports whether m is confident enough to be reported as a match.
+func (c MatchConfig) Accepts(m MatchedSongOptimized) bool {
+	return m.MatchCount >= c.MinMatchCount && m.Confidence >= c.MinConfidence
+}
+
+// Search matches queryFingerprints, made with cfg, against store and decides
+// the outcome with mc.
+func Search(queryFingerprints []db.Fingerprint, cfg fingerprint.FingerprintConfig, mc MatchConfig, store db.FingerprintStore) (SearchResult, error) {
+	matches, err := MatchHashes(queryFingerprints, cfg, mc, store)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return mc.Decide(matches, len(queryFingerprints)), nil
+}
+
+// rate fills in Ratio and Confidence of matches, which must be ranked best
+// first.
+func rate(matches []MatchedSongOptimized) {
+	for i := range matches {
+		// The best other song is the leader, or the runner-up for the
+		// leader itself.
+		other := 0
+		if i == 0 && len(matches) > 1 {
+			other = matches[1].MatchCount
+		} else if i > 0 {
+			other = matches[0].MatchCount
+		}
+		matches[i].Ratio = float64(matches[i].MatchCount) / float64(max(other, 1))
+		matches[i].Confidence = confidence(matches[i].Significance, matches[i].Ratio)
+	}
+}
+
+// confidence is the probability that the best bin is not chance, scaled
+// down as the runner-up gets closer: a song only twice as well aligned as
+// the next one keeps half of it, one no better than the next keeps none.
+func confidence(significance, ratio float64) float64 {
+	if ratio <= 1 {
+		return 0
+	}
+	notChance := 1 - math.Pow(10, -significance)
+	return notChance * (1 - 1/ratio)
+}
+
+// significance returns -log10 of the probability that, if votes hits fell
+// at random over bins offset bins, some bin would collect at least count
+// of them. Bin counts are modelled as Poisson with mean votes/bins, and the
+// probability for one bin is multiplied by bins for the choice of bin.
+func significance(count, votes, bins int) float64 {
+	if count <= 0 || votes <= 0 || bins <= 0 {
+		return 0
+	}
+	lambda := float64(votes) / float64(bins)
+	logP := math.Log(float64(bins)) + logPoissonTail(count, lambda)
+	return max(0, -logP/math.Ln10)
+}
+
+// logPoissonTail returns the natural log of P(X >= k) for X ~ Poisson(lambda).
+// A k at or below the mean is never significant and counts as certain.
+func logPoissonTail(k int, lambda float64) float64 {
+	if float64(k) <= lambda {
+		return 0
+	}
+	lg, _ := math.Lgamma(float64(k) + 1)
+	logTerm := -lambda + float64(k)*math.Log(lambda) - lg
+	// Sum the following terms relative to the first; they shrink
+	// geometrically since k > lambda.
+	sum, term := 1.0, 1.0
+	for i := k + 1; term > 1e-12*sum; i++ {
+		term *= lambda / float64(i)
+		sum += term
+	}
+	return logTerm + math.Log(sum)
+}
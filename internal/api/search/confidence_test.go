@@ -0,0 +1,208 @@
+package search
+
+import (
+	"math"
+	"testing"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+func TestLogPoissonTail(t *testing.T) {
+	// P(X >= k) summed directly from the probability mass function.
+	direct := func(k int, lambda float64) float64 {
+		term := math.Exp(-lambda)
+		for i := 1; i <= k; i++ {
+			term *= lambda / float64(i)
+		}
+		tail := 0.0
+		for i := k + 1; i < k+200; i++ {
+			tail += term
+			term *= lambda / float64(i)
+		}
+		return tail
+	}
+	for _, c := range []struct {
+		k      int
+		lambda float64
+	}{{2, 0.5}, {3, 1}, {5, 1.5}, {10, 4}, {20, 2}} {
+		got := math.Exp(logPoissonTail(c.k, c.lambda))
+		want := direct(c.k, c.lambda)
+		if math.Abs(got-want) > 1e-9*want {
+			t.Errorf("P(X >= %d) for mean %g is %g, want %g", c.k, c.lambda, got, want)
+		}
+	}
+	if got := logPoissonTail(3, 3); got != 0 {
+		t.Errorf("log tail at the mean is %g, want 0", got)
+	}
+}
+
+func TestSignificance(t *testing.T) {
+	// 100 votes spread over 1000 bins: some bin with four of them is
+	// already unlikely, and more is ever less likely.
+	prev := 0.0
+	for count := 4; count <= 20; count++ {
+		s := significance(count, 100, 1000)
+		if s <= prev {
+			t.Errorf("significance of %d votes in a bin is %g, not above %g for %d", count, s, prev, count-1)
+		}
+		prev = s
+	}
+	// At or below the mean count per bin nothing is significant.
+	for _, c := range [][3]int{{1, 100, 100}, {5, 1000, 100}, {0, 10, 10}, {3, 0, 10}, {3, 10, 0}} {
+		if s := significance(c[0], c[1], c[2]); s != 0 {
+			t.Errorf("significance(%d, %d, %d) = %g, want 0", c[0], c[1], c[2], s)
+		}
+	}
+	// One bin holding 3 of 3 votes over 10 bins: 10 * P(X >= 3) for a
+	// mean of 0.3.
+	want := -math.Log10(10 * math.Exp(logPoissonTail(3, 0.3)))
+	if s := significance(3, 3, 10); math.Abs(s-want) > 1e-12 {
+		t.Errorf("significance(3, 3, 10) = %g, want %g", s, want)
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	cases := []struct {
+		significance, ratio float64
+		want                float64
+	}{
+		{10, 1, 0},   // no better than the runner-up
+		{10, 0.5, 0}, // worse than the leader
+		{0, 5, 0},    // chance alignment
+		{12, 2, 0.5},
+		{12, 4, 0.75},
+		{1, 2, 0.45}, // one chance in ten of being noise
+	}
+	for _, c := range cases {
+		if got := confidence(c.significance, c.ratio); math.Abs(got-c.want) > 1e-6 {
+			t.Errorf("confidence(%g, %g) = %g, want %g", c.significance, c.ratio, got, c.want)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	matches := []MatchedSongOptimized{
+		{MatchCount: 40, Significance: 20},
+		{MatchCount: 10, Significance: 3},
+		{MatchCount: 0},
+	}
+	rate(matches)
+	wantRatio := []float64{4, 0.25, 0}
+	for i, m := range matches {
+		if m.Ratio != wantRatio[i] {
+			t.Errorf("match %d has ratio %g, want %g", i, m.Ratio, wantRatio[i])
+		}
+	}
+	if c := matches[0].Confidence; math.Abs(c-0.75) > 1e-6 {
+		t.Errorf("leader four times the runner-up has confidence %g, want 0.75", c)
+	}
+	if matches[1].Confidence != 0 || matches[2].Confidence != 0 {
+		t.Errorf("runners-up have confidence %g and %g, want 0", matches[1].Confidence, matches[2].Confidence)
+	}
+
+	// A lone match is measured against a runner-up of one.
+	lone := []MatchedSongOptimized{{MatchCount: 8, Significance: 12}}
+	rate(lone)
+	if lone[0].Ratio != 8 {
+		t.Errorf("lone match has ratio %g, want 8", lone[0].Ratio)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	mc := DefaultMatchConfig()
+	mc.TopN = 2
+	song := func(id uint) db.Song { return db.Song{ID: id} }
+	matches := []MatchedSongOptimized{
+		{Song: song(7), MatchCount: 30, Confidence: 0.9},
+		{Song: song(3), MatchCount: 6, Confidence: 0},
+		{Song: song(9), MatchCount: 2, Confidence: 0},
+	}
+
+	result := mc.Decide(matches, 120)
+	if !result.Matched || result.Match == nil || result.Match.Song.ID != 7 {
+		t.Fatalf("result %+v, want a match with song 7", result)
+	}
+	if len(result.Candidates) != 2 || result.Candidates[1].Song.ID != 3 {
+		t.Errorf("candidates %+v, want the top 2", result.Candidates)
+	}
+	if result.QueryFingerprints != 120 {
+		t.Errorf("query fingerprints %d, want 120", result.QueryFingerprints)
+	}
+	mc.TopN = 0
+	if result := mc.Decide(matches, 120); len(result.Candidates) != 3 {
+		t.Errorf("%d candidates with TopN 0, want all 3", len(result.Candidates))
+	}
+
+	// Either threshold alone rejects the best candidate, which is still
+	// reported among the candidates.
+	rejected := []struct {
+		name string
+		m    MatchedSongOptimized
+	}{
+		{"confidence", MatchedSongOptimized{Song: song(7), MatchCount: 30, Confidence: mc.MinConfidence - 0.01}},
+		{"match count", MatchedSongOptimized{Song: song(7), MatchCount: mc.MinMatchCount - 1, Confidence: 1}},
+	}
+	for _, c := range rejected {
+		result := mc.Decide([]MatchedSongOptimized{c.m}, 50)
+		if result.Matched || result.Match != nil {
+			t.Errorf("below the %s threshold: matched %+v", c.name, result.Match)
+		}
+		if len(result.Candidates) != 1 {
+			t.Errorf("below the %s threshold: candidates %+v, want the rejected one", c.name, result.Candidates)
+		}
+	}
+	at := MatchedSongOptimized{MatchCount: mc.MinMatchCount, Confidence: mc.MinConfidence}
+	if !mc.Accepts(at) {
+		t.Error("a match exactly at both thresholds is rejected")
+	}
+
+	// Nothing to decide is an explicit no match with an empty list.
+	result = mc.Decide(nil, 0)
+	if result.Matched || result.Match != nil || result.Candidates == nil || len(result.Candidates) != 0 {
+		t.Errorf("no candidates decided as %+v, want no match and empty candidates", result)
+	}
+}
+
+func TestSearchAcceptThreshold(t *testing.T) {
+	catalog := newTestCatalog(t, 6, 30)
+	mc := DefaultMatchConfig()
+
+	for songID := range catalog.audio {
+		result, err := Search(catalog.clip(t, songID, 11, 5), catalog.cfg, mc, catalog.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Matched || result.Match.Song.ID != songID {
+			t.Errorf("clip of song %d: matched %v with candidates %+v", songID, result.Match, result.Candidates)
+			continue
+		}
+		if result.Match.Confidence < mc.MinConfidence {
+			t.Errorf("clip of song %d: accepted with confidence %.2f below %.2f", songID, result.Match.Confidence, mc.MinConfidence)
+		}
+		if len(result.Candidates) > mc.TopN {
+			t.Errorf("clip of song %d: %d candidates reported, TopN is %d", songID, len(result.Candidates), mc.TopN)
+		}
+	}
+
+	// Audio of the same kind that is not in the catalog.
+	for seed := int64(100); seed < 106; seed++ {
+		samples := synthSong(seed, catalog.cfg.SampleRate, 5)
+		query, err := fingerprint.Fingerprint(&samples, 0, catalog.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Search(query, catalog.cfg, mc, catalog.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Matched {
+			t.Errorf("unrelated clip %d matched song %d with confidence %.2f", seed, result.Match.Song.ID, result.Match.Confidence)
+		}
+		for _, c := range result.Candidates {
+			if c.Confidence >= mc.MinConfidence {
+				t.Errorf("unrelated clip %d: candidate song %d has confidence %.2f", seed, c.Song.ID, c.Confidence)
+			}
+		}
+	}
+}
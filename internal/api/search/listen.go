@@ -0,0 +1,321 @@
+package search
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Live recognition defaults.
+const (
+	LISTEN_MAX_DURATION = 30 * time.Second
+	// LISTEN_EVENT_INTERVAL is how much audio passes between progress events.
+	LISTEN_EVENT_INTERVAL = time.Second
+	// LISTEN_READ_TIMEOUT is how long the client may go without sending
+	// before the session ends as if it had stopped.
+	LISTEN_READ_TIMEOUT = 10 * time.Second
+	// LISTEN_MAX_MESSAGE is the largest message accepted from the client,
+	// in bytes: about 3 seconds of 48 kHz stereo 32-bit audio.
+	LISTEN_MAX_MESSAGE = 1 << 20
+)
+
+// Event types sent to a listening client.
+const (
+	EventListening = "listening"
+	EventCandidate = "candidate"
+	EventMatched   = "matched"
+	EventNoMatch   = "no_match"
+	EventError     = "error"
+)
+
+// ListenConfig controls when a live query stops: as soon as the leading
+// song passes Match, after MaxDuration of audio has been received, or when
+// the client sends nothing for ReadTimeout. Messages over MaxMessage bytes
+// close the connection.
+type ListenConfig struct {
+	Match         MatchConfig
+	MaxDuration   time.Duration
+	EventInterval time.Duration
+	ReadTimeout   time.Duration
+	MaxMessage    int64
+}
+
+// DefaultListenConfig returns the LISTEN_* defaults with match.
+func DefaultListenConfig(match MatchConfig) ListenConfig {
+	return ListenConfig{
+		Match:         match,
+		MaxDuration:   LISTEN_MAX_DURATION,
+		EventInterval: LISTEN_EVENT_INTERVAL,
+		ReadTimeout:   LISTEN_READ_TIMEOUT,
+		MaxMessage:    LISTEN_MAX_MESSAGE,
+	}
+}
+
+// ListenEvent is one message sent to the client. Seconds is the amount of
+// audio heard so far; Match is set for candidate and matched events.
+type ListenEvent struct {
+	Event        string                `json:"event"`
+	Seconds      float64               `json:"seconds"`
+	Fingerprints int                   `json:"fingerprints"`
+	Match        *MatchedSongOptimized `json:"match,omitempty"`
+	Error        string                `json:"error,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	// The intended clients are mobile apps, which send no Origin, so the
+	// origin is not restricted.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// errStopListening ends fingerprinting once a final event has been sent.
+var errStopListening = errors.New("stop listening")
+
+// NewListenHandler returns a handler that upgrades the request to a
+// WebSocket and recognises audio streamed over it.
+//
+// The client sends binary messages of interleaved PCM in the format given
+// by the query parameters rate (default 44100), channels (default 1), bits
+// (default 16) and float (default false); samples are little-endian and
+// messages need not hold whole frames. A text message "stop" ends the
+// stream, as does reaching lc.MaxDuration of audio. The server answers with
+// ListenEvent JSON messages: listening or candidate progress events, then a
+// single matched, no_match or error event, after which it closes the
+// connection.
+func NewListenHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, lc ListenConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, err := listenFormat(c)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// The upgrader has already replied.
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(lc.MaxMessage)
+
+		l := &listener{
+			conn:       conn,
+			format:     format,
+			cfg:        cfg,
+			lc:         lc,
+			recognizer: NewRecognizer(store, cfg, lc.Match),
+		}
+		l.run()
+	}
+}
+
+func listenFormat(c *gin.Context) (audio.RawFormat, error) {
+	f := audio.RawFormat{SampleRate: 44100, Channels: 1, BitDepth: 16}
+	ints := map[string]*int{"rate": &f.SampleRate, "channels": &f.Channels, "bits": &f.BitDepth}
+	for name, dst := range ints {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = n
+		}
+	}
+	if v := c.Query("float"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid float %q", v)
+		}
+		f.Float = b
+	}
+	// Validate the format before upgrading, so the client gets a 400.
+	if _, err := audio.NewPCMReader(bytes.NewReader(nil), f); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// listener is one live recognition session. The reading goroutine feeds
+// decoded blocks to the fingerprinting goroutine, which is the only writer
+// to conn until it returns.
+type listener struct {
+	conn       *websocket.Conn
+	format     audio.RawFormat
+	cfg        fingerprint.FingerprintConfig
+	lc         ListenConfig
+	recognizer *Recognizer
+
+	heard     float64 // seconds of audio fingerprinted so far
+	lastEvent float64
+
+	// stopped is set once the session has its final event, so the reading
+	// goroutine stops extending its deadline.
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (l *listener) run() {
+	blocks := make(chan *audio.Buffer)
+	finished := make(chan struct{})
+	var streamErr error
+	go func() {
+		defer close(finished)
+		_, streamErr = fingerprint.FingerprintChannel(blocks, 0, l.cfg, l.emit)
+	}()
+
+	err := l.read(blocks, finished)
+	close(blocks)
+	<-finished
+	if err == nil {
+		err = streamErr
+	}
+
+	switch {
+	case errors.Is(err, errStopListening):
+	case err != nil:
+		l.send(ListenEvent{Event: EventError, Error: err.Error()})
+	default:
+		l.finish()
+	}
+	l.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// read forwards PCM messages as blocks until the client stops, MaxDuration
+// of audio has arrived or the fingerprinting goroutine finishes early. It
+// only returns an error for audio it cannot decode.
+func (l *listener) read(blocks chan<- *audio.Buffer, finished <-chan struct{}) error {
+	frameSize := l.format.Channels * l.format.BitDepth / 8
+	remaining := int(l.lc.MaxDuration.Seconds() * float64(l.format.SampleRate))
+	var pending []byte
+	for remaining > 0 {
+		l.extendDeadline()
+		kind, msg, err := l.conn.ReadMessage()
+		if err != nil {
+			// A client that closes the socket, goes quiet or sends an
+			// oversized message has stopped sending.
+			return nil
+		}
+		if kind == websocket.TextMessage {
+			if string(msg) == "stop" {
+				return nil
+			}
+			continue
+		}
+
+		pending = append(pending, msg...)
+		whole := len(pending) - len(pending)%frameSize
+		if whole == 0 {
+			continue
+		}
+		pcm, err := audio.NewPCMReader(bytes.NewReader(pending[:whole]), l.format)
+		if err != nil {
+			return err
+		}
+		block, err := pcm.ReadAll()
+		if err != nil {
+			return err
+		}
+		pending = pending[:copy(pending, pending[whole:])]
+		if block.Frames() > remaining {
+			block.Data = block.Data[:remaining*l.format.Channels]
+		}
+		remaining -= block.Frames()
+
+		select {
+		case blocks <- block:
+		case <-finished:
+			return nil
+		}
+	}
+	return nil
+}
+
+// extendDeadline gives the client ReadTimeout to send its next message,
+// unless the session has stopped.
+func (l *listener) extendDeadline() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stopped {
+		l.conn.SetReadDeadline(time.Now().Add(l.lc.ReadTimeout))
+	}
+}
+
+// emit receives fingerprints as the stream produces them, votes with them
+// and reports progress. It stops the stream once a match is certain or the
+// time limit is reached.
+func (l *listener) emit(fingerprints []db.Fingerprint) error {
+	if err := l.recognizer.Add(fingerprints); err != nil {
+		return err
+	}
+	l.heard = fingerprints[len(fingerprints)-1].AnchorTime
+
+	best, matched := l.leader()
+	switch {
+	case matched:
+		l.send(ListenEvent{Event: EventMatched, Match: best})
+		return l.stop()
+	case l.heard >= l.lc.MaxDuration.Seconds():
+		l.send(ListenEvent{Event: EventNoMatch})
+		return l.stop()
+	case l.heard-l.lastEvent >= l.lc.EventInterval.Seconds():
+		l.lastEvent = l.heard
+		if best == nil {
+			l.send(ListenEvent{Event: EventListening})
+		} else {
+			l.send(ListenEvent{Event: EventCandidate, Match: best})
+		}
+	}
+	return nil
+}
+
+// stop makes the reading goroutine's pending read return so the session
+// ends without waiting for more audio.
+func (l *listener) stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.conn.SetReadDeadline(time.Now())
+	return errStopListening
+}
+
+// finish sends the final event once the client has stopped sending.
+func (l *listener) finish() {
+	best, matched := l.leader()
+	if matched {
+		l.send(ListenEvent{Event: EventMatched, Match: best})
+		return
+	}
+	l.send(ListenEvent{Event: EventNoMatch})
+}
+
+// leader returns the best candidate so far and whether it is confident
+// enough to call.
+func (l *listener) leader() (*MatchedSongOptimized, bool) {
+	result := l.recognizer.Result(l.lc.Match)
+	if result.Matched {
+		return result.Match, true
+	}
+	if len(result.Candidates) == 0 {
+		return nil, false
+	}
+	return &result.Candidates[0], false
+}
+
+func (l *listener) send(event ListenEvent) {
+	event.Seconds = l.heard
+	event.Fingerprints = l.recognizer.Fingerprints()
+	if err := l.conn.WriteJSON(event); err != nil {
+		log.Printf("listen: writing %s event: %v", event.Event, err)
+	}
+}
@@ -0,0 +1,214 @@
+package search
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shazam/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestRecognizerMatchesMatchHashes(t *testing.T) {
+	catalog := newTestCatalog(t, 6, 20)
+	mc := DefaultMatchConfig()
+	mc.MaxCandidates = 2
+	query := catalog.clip(t, 4, 6, 8)
+
+	want, err := MatchHashes(query, catalog.cfg, mc, catalog.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRecognizer(catalog.store, catalog.cfg, mc)
+	for start := 0; start < len(query); start += 97 {
+		if err := r.Add(query[start:min(len(query), start+97)]); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(r.Matches()); n > mc.MaxCandidates {
+			t.Fatalf("%d songs scored with MaxCandidates %d", n, mc.MaxCandidates)
+		}
+	}
+	got := r.Matches()
+	if len(got) != len(want) {
+		t.Fatalf("recognizer has %d matches, MatchHashes %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Song.ID != w.Song.ID || g.Votes != w.Votes || g.MatchCount != w.MatchCount || g.MatchOffset != w.MatchOffset {
+			t.Errorf("match %d is song %d with %d/%d votes at %dms, MatchHashes has song %d with %d/%d at %dms",
+				i, g.Song.ID, g.MatchCount, g.Votes, g.MatchOffset, w.Song.ID, w.MatchCount, w.Votes, w.MatchOffset)
+		}
+	}
+	if got[0].Song.ID != 4 {
+		t.Errorf("best match is song %d, want 4", got[0].Song.ID)
+	}
+}
+
+// countingStore counts the hashes asked for hits and refuses catalog-wide
+// lookups.
+type countingStore struct {
+	db.FingerprintStore
+	counted int
+}
+
+func (s *countingStore) HitsPerHash(hashes []int32) (map[int32]map[uint]int, error) {
+	s.counted += len(hashes)
+	return s.FingerprintStore.HitsPerHash(hashes)
+}
+
+func (s *countingStore) LookupHashes(hashes []int32) ([]db.Fingerprint, error) {
+	return nil, errors.New("the recognizer must not look up hashes across the catalog")
+}
+
+func TestRecognizerCountsEachHashOnce(t *testing.T) {
+	catalog := newTestCatalog(t, 3, 10)
+	store := &countingStore{FingerprintStore: catalog.store}
+	query := catalog.clip(t, 2, 1, 6)
+	r := NewRecognizer(store, catalog.cfg, DefaultMatchConfig())
+	// The same fingerprints twice over, in pieces.
+	for range 2 {
+		for start := 0; start < len(query); start += 50 {
+			if err := r.Add(query[start:min(len(query), start+50)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, hashes := indexQuery(query)
+	if store.counted != len(hashes) {
+		t.Errorf("%d hashes counted for hits, want each of the %d once", store.counted, len(hashes))
+	}
+}
+
+type listenSession struct {
+	conn   *websocket.Conn
+	events chan ListenEvent
+}
+
+func startListen(t *testing.T, lc ListenConfig) *listenSession {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	catalog := newTestCatalog(t, 2, 5)
+	r := gin.New()
+	r.GET("/listen", NewListenHandler(catalog.store, catalog.cfg, lc))
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/listen?rate=8000"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &listenSession{conn: conn, events: make(chan ListenEvent, 100)}
+	go func() {
+		defer close(s.events)
+		for {
+			var event ListenEvent
+			if err := conn.ReadJSON(&event); err != nil {
+				return
+			}
+			s.events <- event
+		}
+	}()
+	return s
+}
+
+// final waits for the session's last event and the close that follows.
+func (s *listenSession) final(t *testing.T, within time.Duration) ListenEvent {
+	t.Helper()
+	var last ListenEvent
+	timeout := time.After(within)
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				return last
+			}
+			last = event
+		case <-timeout:
+			t.Fatalf("session still open after %v, last event %+v", within, last)
+		}
+	}
+}
+
+// noise returns seconds of 16-bit noise at 8 kHz, unlike anything in the
+// catalog.
+func noise(seconds float64) []byte {
+	pcm := make([]byte, 0, int(seconds*8000)*2)
+	for i := range int(seconds * 8000) {
+		v := int16(8000 * math.Sin(float64(i)*float64(i)*1e-3))
+		pcm = binary.LittleEndian.AppendUint16(pcm, uint16(v))
+	}
+	return pcm
+}
+
+func TestListenStopsAtMaxDuration(t *testing.T) {
+	lc := DefaultListenConfig(DefaultMatchConfig())
+	lc.MaxDuration = 2 * time.Second
+	s := startListen(t, lc)
+
+	// Keep sending well past the limit without a stop message; the
+	// session must end by itself.
+	go func() {
+		for _, chunk := range [][]byte{noise(1.5), noise(1.5), noise(1.5), noise(1.5)} {
+			if s.conn.WriteMessage(websocket.BinaryMessage, chunk) != nil {
+				return
+			}
+		}
+	}()
+	event := s.final(t, 10*time.Second)
+	if event.Event != EventNoMatch {
+		t.Fatalf("final event %+v, want no_match", event)
+	}
+	if event.Seconds > lc.MaxDuration.Seconds() {
+		t.Errorf("fingerprinted %.2fs of audio, limit is %v", event.Seconds, lc.MaxDuration)
+	}
+}
+
+func TestListenReadTimeout(t *testing.T) {
+	lc := DefaultListenConfig(DefaultMatchConfig())
+	lc.ReadTimeout = 200 * time.Millisecond
+	s := startListen(t, lc)
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, noise(0.5)); err != nil {
+		t.Fatal(err)
+	}
+	// Then nothing: the server gives up on the client.
+	if event := s.final(t, 5*time.Second); event.Event != EventNoMatch {
+		t.Fatalf("final event %+v, want no_match", event)
+	}
+}
+
+func TestListenReadLimit(t *testing.T) {
+	lc := DefaultListenConfig(DefaultMatchConfig())
+	lc.MaxMessage = 4096
+	s := startListen(t, lc)
+	s.conn.WriteMessage(websocket.BinaryMessage, make([]byte, 8192))
+	// The oversized message ends the session.
+	s.final(t, 5*time.Second)
+}
+
+func TestRecognizerSkipsIncompatibleSongs(t *testing.T) {
+	catalog := newTestCatalog(t, 2, 10)
+	query := catalog.clip(t, 1, 2, 5)
+	other := catalog.cfg
+	other.SampleRate *= 2
+	if _, err := MatchHashes(query, other, DefaultMatchConfig(), catalog.store); !errors.Is(err, ErrIncompatibleConfig) {
+		t.Fatalf("MatchHashes: %v, want ErrIncompatibleConfig", err)
+	}
+
+	// A live query under another config hears nothing it can match, which
+	// the listen handler reports as no_match rather than an error.
+	r := NewRecognizer(catalog.store, other, DefaultMatchConfig())
+	if err := r.Add(query); err != nil {
+		t.Fatal(err)
+	}
+	if result := r.Result(DefaultMatchConfig()); result.Matched || len(result.Candidates) != 0 {
+		t.Errorf("result %+v, want no match and no candidates", result)
+	}
+}
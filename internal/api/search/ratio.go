@@ -0,0 +1,168 @@
+package search
+
+import (
+	"math"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+const (
+	// SPEED_STEP is the spacing of the speeds scaleVotes tries.
+	SPEED_STEP = 0.005
+	// SPAN_TOLERANCE_FRAMES is how far, in frames, a catalog triplet's span
+	// may be from the query span scaled by a tried speed and still vote for
+	// it. Peak times are whole frames, so spans are off by up to one.
+	SPAN_TOLERANCE_FRAMES = 1.0
+)
+
+// scaleVotes matches ratio hashes. A query played at speed s relative to
+// the song maps query time tq to song time offset + s*tq, so matching
+// fingerprints line up on a line rather than at a constant offset. For each
+// song, scaleVotes tries every speed within the allowed range and keeps the
+// one whose offset histogram has the highest peak; a least-squares fit over
+// the votes in that peak then refines the speed.
+type scaleVotes struct {
+	maxChange float64
+	binMs     int
+	tolerance float64 // SPAN_TOLERANCE_FRAMES in seconds
+	pairs     map[uint][]scalePair
+}
+
+// scalePair is one catalog fingerprint matching one query fingerprint.
+type scalePair struct {
+	query, ref         float64 // anchor times in seconds
+	querySpan, refSpan float64 // triplet spans in seconds
+}
+
+func newScaleVotes(cfg fingerprint.FingerprintConfig, mc MatchConfig) *scaleVotes {
+	return &scaleVotes{
+		maxChange: mc.MaxSpeedChange,
+		binMs:     mc.OffsetBinMs,
+		tolerance: SPAN_TOLERANCE_FRAMES / cfg.FramesPerSecond(),
+		pairs:     make(map[uint][]scalePair),
+	}
+}
+
+func (v *scaleVotes) add(afp db.Fingerprint, qfps []db.Fingerprint) {
+	for _, qfp := range qfps {
+		// Drop pairs whose spans no allowed speed reconciles.
+		if afp.TimeDelta < (1-v.maxChange)*qfp.TimeDelta-v.tolerance ||
+			afp.TimeDelta > (1+v.maxChange)*qfp.TimeDelta+v.tolerance {
+			continue
+		}
+		v.pairs[afp.SongID] = append(v.pairs[afp.SongID], scalePair{
+			query:     qfp.AnchorTime,
+			ref:       afp.AnchorTime,
+			querySpan: qfp.TimeDelta,
+			refSpan:   afp.TimeDelta,
+		})
+	}
+}
+
+func (v *scaleVotes) matches(songs map[uint]db.Song, queryLength int, queryDuration float64) []MatchedSongOptimized {
+	steps := int(math.Ceil(v.maxChange / SPEED_STEP))
+	speeds := 2*steps + 1
+
+	finalMatches := []MatchedSongOptimized{}
+	for songID, pairs := range v.pairs {
+		best := scaleFit{}
+		for k := 0; k < speeds; k++ {
+			// Try speeds outwards from 1 so ties favour the original speed.
+			step := (k + 1) / 2
+			if k%2 == 1 {
+				step = -step
+			}
+			fit := v.fitOffset(pairs, 1+float64(step)*SPEED_STEP)
+			if fit.count > best.count {
+				best = fit
+			}
+		}
+		if best.count == 0 {
+			continue
+		}
+
+		song := songs[songID]
+		speed, offset := v.refine(pairs, best)
+		// Every speed and offset bin was a chance for noise to peak, while
+		// the votes of one speed spread over its bins only.
+		bins := max(best.bins, offsetBins(song.Duration+queryDuration, v.binMs))
+		match := MatchedSongOptimized{
+			Song:         song,
+			MatchCount:   best.count,
+			Score:        best.count,
+			Votes:        len(pairs),
+			Coverage:     float64(best.count) / float64(max(queryLength, 1)),
+			Significance: significance(best.count, WINDOW_BINS*best.votes*speeds, bins*speeds),
+		}
+		match.locate(offset, speed, queryDuration)
+		finalMatches = append(finalMatches, match)
+	}
+	rank(finalMatches)
+
+	return finalMatches
+}
+
+// scaleFit is the best offset window of the votes at one speed.
+type scaleFit struct {
+	speed  float64
+	offset int // centre bin of the window
+	count  int // votes in the window
+	votes  int // votes consistent with speed
+	bins   int // number of bins the votes spread over
+}
+
+// consistent reports whether p agrees with speed and, if so, its offset bin.
+func (v *scaleVotes) consistent(p scalePair, speed float64) (int, bool) {
+	if math.Abs(p.refSpan-speed*p.querySpan) > v.tolerance {
+		return 0, false
+	}
+	return offsetBin(p.ref-speed*p.query, v.binMs), true
+}
+
+// fitOffset histograms the offsets of the pairs consistent with speed and
+// finds the window holding the most votes.
+func (v *scaleVotes) fitOffset(pairs []scalePair, speed float64) scaleFit {
+	histogram := make(map[int]int)
+	fit := scaleFit{speed: speed}
+	minOffset, maxOffset := math.MaxInt, math.MinInt
+	for _, p := range pairs {
+		offset, ok := v.consistent(p, speed)
+		if !ok {
+			continue
+		}
+		histogram[offset]++
+		fit.votes++
+		minOffset = min(minOffset, offset)
+		maxOffset = max(maxOffset, offset)
+	}
+	fit.offset, fit.count = peakWindow(histogram)
+	if fit.votes > 0 {
+		fit.bins = maxOffset - minOffset + 1
+	}
+	return fit
+}
+
+// refine fits song time = offset + speed*query time by least squares over
+// the pairs in the winning window. The speed stays within one step of the
+// grid speed, so a few clustered votes cannot produce a wild slope.
+func (v *scaleVotes) refine(pairs []scalePair, fit scaleFit) (speed, offset float64) {
+	var n, sumQ, sumR, sumQQ, sumQR float64
+	for _, p := range pairs {
+		bin, ok := v.consistent(p, fit.speed)
+		if !ok || bin < fit.offset-1 || bin > fit.offset+1 {
+			continue
+		}
+		n++
+		sumQ += p.query
+		sumR += p.ref
+		sumQQ += p.query * p.query
+		sumQR += p.query * p.ref
+	}
+	speed = fit.speed
+	if variance := sumQQ - sumQ*sumQ/n; n >= 3 && variance > 1e-6 {
+		slope := (sumQR - sumQ*sumR/n) / variance
+		speed = max(fit.speed-SPEED_STEP, min(fit.speed+SPEED_STEP, slope))
+	}
+	return speed, (sumR - speed*sumQ) / n
+}
@@ -0,0 +1,104 @@
+package search
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+// melody returns seconds of audio at rate made of three voices that each
+// move to a random note every 60 to 180ms, seeded by seed. Unlike the steady
+// tones of synthSong, it gives peak triplets varied time ratios.
+func melody(seed int64, rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(seconds*float64(rate)))
+	for voice := range 3 {
+		var freq, phase float64
+		next := 0
+		for i := range samples {
+			if i == next {
+				freq = 200 * math.Pow(2, rng.Float64()*4.3)
+				next += rate * (60 + rng.Intn(120)) / 1000
+			}
+			phase += 2 * math.Pi * freq / float64(rate)
+			samples[i] += (0.3 - 0.07*float64(voice)) * math.Sin(phase)
+		}
+	}
+	return samples
+}
+
+func TestRatioHashesDetectSpeed(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	cfg.HashMode = fingerprint.HashModeRatio
+	store := db.NewMemoryStore()
+	songs := make(map[uint][]float64)
+	for seed := int64(1); seed <= 4; seed++ {
+		samples := melody(seed, cfg.SampleRate, 30)
+		fps, err := fingerprint.Fingerprint(&samples, 0, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		song := db.Song{Title: "synth", ConfigID: cfg.ID(), SampleRate: cfg.SampleRate, Duration: 30}
+		if err := store.AddSong(&song, fps); err != nil {
+			t.Fatal(err)
+		}
+		songs[song.ID] = samples
+	}
+	mc := DefaultMatchConfig()
+	const start, seconds = 9.0, 8.0
+
+	for _, speed := range []float64{0.9, 0.93, 0.95, 1, 1.05, 1.07, 1.1} {
+		for songID, samples := range songs {
+			// Playing the excerpt speed times faster is resampling it to
+			// 1/speed of its rate and playing it at the original rate,
+			// which shifts its pitch along with its tempo.
+			src := samples[int(start)*cfg.SampleRate : int(start+seconds)*cfg.SampleRate]
+			clip, err := audio.Resample(src, int(math.Round(speed*1000)), 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, err := fingerprint.Fingerprint(&clip, 0, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := Search(query, cfg, mc, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Matched || result.Match.Song.ID != songID {
+				t.Errorf("song %d at speed %g: matched %v, candidates %+v", songID, speed, result.Match, result.Candidates)
+				continue
+			}
+			m := result.Match
+			if math.Abs(m.Speed-speed) > SPEED_STEP {
+				t.Errorf("song %d at speed %g: detected speed %.4f", songID, speed, m.Speed)
+			}
+			// The offset comes from the fitted line, so allow a bin and a
+			// frame either side.
+			tolerance := float64(mc.OffsetBinMs) + 1000/cfg.FramesPerSecond()
+			if d := math.Abs(float64(m.MatchOffset) - start*1000); d > tolerance {
+				t.Errorf("song %d at speed %g: offset %dms, want %gms", songID, speed, m.MatchOffset, start*1000)
+			}
+		}
+	}
+}
+
+func TestPairHashesReportUnitSpeed(t *testing.T) {
+	catalog := newTestCatalog(t, 2, 15)
+	matches, err := MatchHashes(catalog.clip(t, 2, 3, 5), catalog.cfg, DefaultMatchConfig(), catalog.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatal("no match")
+	}
+	for _, m := range matches {
+		if m.Speed != 1 {
+			t.Errorf("song %d matched at speed %g with pair hashes, want 1", m.Song.ID, m.Speed)
+		}
+	}
+}
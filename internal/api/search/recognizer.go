@@ -0,0 +1,136 @@
+package search
+
+import (
+	"slices"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+// Recognizer accumulates the offset votes of a query that arrives in
+// pieces, such as a live recording, so the best match can be read off at any
+// point instead of after the whole clip is known. Like MatchHashes, it only
+// votes for the songs with the most hash hits, and feeding it every
+// fingerprint of a clip gives the same votes MatchHashes counts for its
+// candidates.
+type Recognizer struct {
+	store db.FingerprintStore
+	cfg   fingerprint.FingerprintConfig
+	mc    MatchConfig
+	votes voter
+	songs *songCache
+
+	// query holds the query fingerprints so far by hash, hashes its
+	// distinct hashes and hits the catalog hits per song they draw.
+	query  map[int32][]db.Fingerprint
+	hashes []int32
+	hits   map[uint]int
+	// candidates are the songs currently scored. voted holds every song
+	// that has been a candidate; their votes are kept up to date so one
+	// that drops out and comes back is scored on the whole query.
+	candidates   map[uint]db.Song
+	voted        []uint
+	fingerprints int
+	duration     float64
+}
+
+// NewRecognizer returns a recognizer matching queries fingerprinted with
+// cfg against store. Of mc, the candidate limits, speed range and offset
+// bins are used; pass the same config to Result.
+func NewRecognizer(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc MatchConfig) *Recognizer {
+	return &Recognizer{
+		store: store,
+		cfg:   cfg,
+		mc:    mc,
+		votes: newVoter(cfg, mc),
+		songs: newSongCache(store),
+		query: make(map[int32][]db.Fingerprint),
+		hits:  make(map[uint]int),
+	}
+}
+
+// Add votes with the next query fingerprints. Only the hashes not seen
+// before are counted against the catalog; the postings of the songs
+// already voted for are fetched for this batch alone, and those of a song
+// that becomes a candidate for the whole query so far.
+func (r *Recognizer) Add(queryFingerprints []db.Fingerprint) error {
+	if len(queryFingerprints) == 0 {
+		return nil
+	}
+	r.fingerprints += len(queryFingerprints)
+	r.duration = max(r.duration, queryDuration(queryFingerprints))
+	batch, batchHashes := indexQuery(queryFingerprints)
+
+	var fresh []int32
+	for _, hash := range batchHashes {
+		if _, seen := r.query[hash]; !seen {
+			fresh = append(fresh, hash)
+		}
+		r.query[hash] = append(r.query[hash], batch[hash]...)
+	}
+	r.hashes = append(r.hashes, fresh...)
+	if len(fresh) > 0 {
+		perHash, err := r.store.HitsPerHash(fresh)
+		if err != nil {
+			return err
+		}
+		for _, hash := range fresh {
+			for songID, n := range perHash[hash] {
+				r.hits[songID] += n
+			}
+		}
+	}
+
+	ranked := rankCandidates(r.hits, r.mc.MinCandidateHits)
+	candidates, songIDs, err := compatibleCandidates(r.songs, ranked, r.cfg, r.mc.MaxCandidates)
+	if err != nil {
+		return err
+	}
+
+	if len(r.voted) > 0 {
+		allFingerPrints, err := r.store.LookupHashesForSongs(batchHashes, r.voted)
+		if err != nil {
+			return err
+		}
+		for _, afp := range allFingerPrints {
+			r.votes.add(afp, batch[afp.Hash])
+		}
+	}
+	var admitted []uint
+	for _, songID := range songIDs {
+		if !slices.Contains(r.voted, songID) {
+			admitted = append(admitted, songID)
+		}
+	}
+	if len(admitted) > 0 {
+		allFingerPrints, err := r.store.LookupHashesForSongs(r.hashes, admitted)
+		if err != nil {
+			return err
+		}
+		for _, afp := range allFingerPrints {
+			r.votes.add(afp, r.query[afp.Hash])
+		}
+		r.voted = append(r.voted, admitted...)
+	}
+	r.candidates = candidates
+	return nil
+}
+
+// Fingerprints returns the number of query fingerprints added so far.
+func (r *Recognizer) Fingerprints() int {
+	return r.fingerprints
+}
+
+// Matches returns the current candidates with votes so far, best first.
+func (r *Recognizer) Matches() []MatchedSongOptimized {
+	matches := r.votes.matches(r.candidates, r.fingerprints, r.duration)
+	return slices.DeleteFunc(matches, func(m MatchedSongOptimized) bool {
+		_, ok := r.candidates[m.Song.ID]
+		return !ok
+	})
+}
+
+// Result decides the outcome of the query so far with mc.
+func (r *Recognizer) Result(mc MatchConfig) SearchResult {
+	return mc.Decide(r.Matches(), r.fingerprints)
+}
@@ -1,38 +1,198 @@
 package upload
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shazam/internal/api/search"
 	"shazam/internal/audio"
 	"shazam/internal/db"
 	"shazam/internal/fingerprint"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
+const (
+	// DUPLICATE_MATCH_RATIO is the share of an upload's fingerprints that
+	// must line up with an existing song for the upload to be rejected as a
+	// duplicate of it.
+	DUPLICATE_MATCH_RATIO = 0.2
+)
+
+// UploadResponse is returned for a successfully ingested song. When the
+// same file was ingested before, AlreadyIngested is set, Song is the stored
+// song and Fingerprints is left out.
+type UploadResponse struct {
+	Song            db.Song `json:"song"`
+	SongID          uint    `json:"song_id"`
+	Fingerprints    int     `json:"fingerprints,omitempty"`
+	AlreadyIngested bool    `json:"already_ingested,omitempty"`
+}
+
+// FingerprintAPI ingests an uploaded song into the Postgres catalog.
 func FingerprintAPI(c *gin.Context) {
-	song, err := c.FormFile("song")
+	NewUploadHandler(db.NewGormStore(db.DB), fingerprint.DefaultConfig(), search.DefaultMatchConfig())(c)
+}
+
+// NewUploadHandler returns a handler for POST /songs. It fingerprints the
+// file in the "song" form field with cfg and stores it in store together
+// with the optional title, artist and album fields. Uploading a file whose
+// checksum is already stored answers 200 with the stored song, so retries
+// are safe; other uploads that match a song already in the catalog are
+// rejected with 409 Conflict. Duplicates are searched for with mc, the
+// config the server matches queries with.
+func NewUploadHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc search.MatchConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadSong(c, store, cfg, mc)
+	}
+}
+
+func uploadSong(c *gin.Context, store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc search.MatchConfig) {
+	up, ok := readUpload(c, cfg, func(checksum string) bool {
+		existing, err := store.SongByChecksum(checksum)
+		switch {
+		case err == nil:
+			c.JSON(http.StatusOK, UploadResponse{Song: existing, SongID: existing.ID, AlreadyIngested: true})
+			return false
+		case errors.Is(err, db.ErrSongNotFound):
+			return true
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up checksum: " + err.Error()})
+			return false
+		}
+	})
+	if !ok {
+		return
+	}
+	fingerprints := up.fingerprints
+
+	duplicate, err := findDuplicate(fingerprints, cfg, mc, store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for duplicates: " + err.Error()})
+		return
+	}
+	if duplicate != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "Song is already in the catalog",
+			"song":     duplicate.Song,
+			"song_id":  duplicate.Song.ID,
+			"matching": duplicate.MatchCount,
+		})
+		return
+	}
+
+	song := up.song
+	if song.Title == "" {
+		song.Title = db.TitleFromPath(song.SourcePath)
+	}
+	if err := store.AddSong(&song, fingerprints); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store song: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, UploadResponse{
+		Song:         song,
+		SongID:       song.ID,
+		Fingerprints: len(fingerprints),
+	})
+}
+
+// upload is a decoded and fingerprinted song file. song carries the form
+// metadata and what was learnt from the file, but no ID.
+type upload struct {
+	song         db.Song
+	fingerprints []db.Fingerprint
+}
+
+// readUpload reads the file in the "song" form field and the title, artist
+// and album fields. Once the file's checksum is known it calls proceed,
+// which may answer the request itself and return false to stop before the
+// audio is decoded. readUpload answers the request whenever it returns
+// false.
+func readUpload(c *gin.Context, cfg fingerprint.FingerprintConfig, proceed func(checksum string) bool) (*upload, bool) {
+	fileHeader, err := c.FormFile("song")
 	if err != nil {
-		panic(err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit)})
+			return nil, false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not get file from form: " + err.Error()})
+		return nil, false
 	}
 
-	songFile, err := song.Open()
+	songFile, err := fileHeader.Open()
 	if err != nil {
-		panic(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open uploaded file"})
+		return nil, false
 	}
 	defer songFile.Close()
-	songs, err := os.Open("")
+
+	checksum, err := db.FileChecksum(songFile)
+	if err == nil {
+		_, err = songFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+		return nil, false
+	}
+	if !proceed(checksum) {
+		return nil, false
+	}
+
+	buf, err := audio.DecodeMedia(songFile, fileHeader.Header.Get("Content-Type"))
+	if errors.Is(err, audio.ErrUnknownFormat) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported audio format"})
+		return nil, false
+	}
 	if err != nil {
-		panic(err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode audio: " + err.Error()})
+		return nil, false
 	}
-	defer songs.Close()
-	samples, err := audio.DownSamplingAudio(songs)
-	hashes := fingerprint.Fingerprint(samples, song.Filename)
-	CreateHash(hashes, db.DB)
+
+	fingerprints, err := fingerprint.FingerprintAudio(buf, 0, cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fingerprint audio: " + err.Error()})
+		return nil, false
+	}
+	if len(fingerprints) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Audio produced no fingerprints"})
+		return nil, false
+	}
+
+	return &upload{
+		song: db.Song{
+			Title:            c.PostForm("title"),
+			Artist:           c.PostForm("artist"),
+			Album:            c.PostForm("album"),
+			Duration:         buf.Duration().Seconds(),
+			SourcePath:       fileHeader.Filename,
+			ConfigID:         cfg.ID(),
+			Checksum:         checksum,
+			SampleRate:       cfg.SampleRate,
+			SourceSampleRate: buf.Format.SampleRate,
+		},
+		fingerprints: fingerprints,
+	}, true
 }
 
-func CreateHash(hashes []db.Fingerprint, DB *gorm.DB) {
-	if err := DB.CreateInBatches(&hashes, 4000).Error; err != nil {
-		panic(err)
+// findDuplicate returns the best matching stored song if enough of the
+// upload's fingerprints line up with it, and nil otherwise.
+func findDuplicate(fingerprints []db.Fingerprint, cfg fingerprint.FingerprintConfig, mc search.MatchConfig, store db.FingerprintStore) (*search.MatchedSongOptimized, error) {
+	matches, err := search.MatchHashes(fingerprints, cfg, mc, store)
+	if errors.Is(err, search.ErrIncompatibleConfig) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	best := matches[0]
+	if float64(best.MatchCount) < DUPLICATE_MATCH_RATIO*float64(len(fingerprints)) {
+		return nil, nil
 	}
+	return &best, nil
 }
@@ -0,0 +1,45 @@
+package upload
+
+import (
+	"math"
+	"testing"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+func TestFindDuplicateUsesMatchConfig(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	samples := make([]float64, 10*cfg.SampleRate)
+	for i := range samples {
+		// A chirp, so every frame has different peaks.
+		sec := float64(i) / float64(cfg.SampleRate)
+		samples[i] = 0.5 * math.Sin(2*math.Pi*(300*sec+80*sec*sec))
+	}
+	fps, err := fingerprint.Fingerprint(&samples, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemoryStore()
+	song := db.Song{Title: "chirp", ConfigID: cfg.ID(), SampleRate: cfg.SampleRate}
+	if err := store.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := search.DefaultMatchConfig()
+	duplicate, err := findDuplicate(fps, cfg, mc, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate == nil || duplicate.Song.ID != song.ID {
+		t.Fatalf("duplicate %v, want song %d", duplicate, song.ID)
+	}
+
+	// With a candidate floor no song reaches, the server would not match
+	// the upload, so it is not a duplicate either.
+	mc.MinCandidateHits = len(fps) + 1
+	if duplicate, err := findDuplicate(fps, cfg, mc, store); err != nil || duplicate != nil {
+		t.Errorf("duplicate %v, err %v with an unreachable hit floor; want none", duplicate, err)
+	}
+}
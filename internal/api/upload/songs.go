@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewReplaceHandler returns a handler for PUT /songs/:id. It fingerprints
+// the file in the "song" form field with cfg and replaces the audio of the
+// song in one store transaction, keeping its ID. The title, artist and
+// album fields replace the stored ones when given. A file whose checksum
+// belongs to another song is rejected with 409 Conflict.
+func NewReplaceHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		replaceSong(c, store, cfg)
+	}
+}
+
+func replaceSong(c *gin.Context, store db.FingerprintStore, cfg fingerprint.FingerprintConfig) {
+	songID, ok := songIDParam(c)
+	if !ok {
+		return
+	}
+	found, err := store.Songs([]uint{songID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up song: " + err.Error()})
+		return
+	}
+	existing, ok := found[songID]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+		return
+	}
+
+	up, ok := readUpload(c, cfg, func(checksum string) bool {
+		other, err := store.SongByChecksum(checksum)
+		switch {
+		case errors.Is(err, db.ErrSongNotFound) || err == nil && other.ID == songID:
+			return true
+		case err == nil:
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "File is already in the catalog as another song",
+				"song":    other,
+				"song_id": other.ID,
+			})
+			return false
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up checksum: " + err.Error()})
+			return false
+		}
+	})
+	if !ok {
+		return
+	}
+
+	song := up.song
+	song.ID = songID
+	if song.Title == "" {
+		song.Title = existing.Title
+	}
+	if song.Artist == "" {
+		song.Artist = existing.Artist
+	}
+	if song.Album == "" {
+		song.Album = existing.Album
+	}
+	err = store.ReplaceSong(&song, up.fingerprints)
+	if errors.Is(err, db.ErrSongNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace song: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, UploadResponse{
+		Song:         song,
+		SongID:       song.ID,
+		Fingerprints: len(up.fingerprints),
+	})
+}
+
+// NewDeleteHandler returns a handler for DELETE /songs/:id. It removes the
+// song and its fingerprints in one store transaction and answers 204 No
+// Content, or 404 if there is no such song.
+func NewDeleteHandler(store db.FingerprintStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		songID, ok := songIDParam(c)
+		if !ok {
+			return
+		}
+		err := store.DeleteSong(songID)
+		if errors.Is(err, db.ErrSongNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete song: " + err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// songIDParam parses the :id path parameter, answering 400 if it is not a
+// song ID.
+func songIDParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid song ID " + strconv.Quote(c.Param("id"))})
+		return 0, false
+	}
+	return uint(id), true
+}
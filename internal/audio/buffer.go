@@ -0,0 +1,75 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Format describes the layout of the samples in a Buffer.
+type Format struct {
+	SampleRate int
+	Channels   int
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d Hz, %d ch", f.SampleRate, f.Channels)
+}
+
+// Buffer is decoded audio: interleaved samples in [-1, 1] tagged with the
+// format they are in. Decoders keep the source's rate and channels; use
+// Mono and Resample to bring a buffer to an analysis format.
+type Buffer struct {
+	Format Format
+	Data   []float64
+}
+
+// Frames returns the number of samples per channel.
+func (b *Buffer) Frames() int {
+	if b.Format.Channels <= 0 {
+		return 0
+	}
+	return len(b.Data) / b.Format.Channels
+}
+
+// Duration returns the playing time of the buffer.
+func (b *Buffer) Duration() time.Duration {
+	if b.Format.SampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(b.Frames()) * time.Second / time.Duration(b.Format.SampleRate)
+}
+
+// Mono returns the buffer mixed down to one channel. A mono buffer is
+// returned as is.
+func (b *Buffer) Mono() *Buffer {
+	if b.Format.Channels == 1 {
+		return b
+	}
+	return &Buffer{
+		Format: Format{SampleRate: b.Format.SampleRate, Channels: 1},
+		Data:   MixToMono(b.Data, b.Format.Channels),
+	}
+}
+
+// Resample returns the buffer converted to rate. Only mono buffers can be
+// resampled; call Mono first. A buffer already at rate is returned as is.
+func (b *Buffer) Resample(rate int) (*Buffer, error) {
+	if b.Format.Channels != 1 {
+		return nil, errors.New("resampling requires a mono buffer")
+	}
+	if b.Format.SampleRate == rate {
+		return b, nil
+	}
+	data, err := Resample(b.Data, b.Format.SampleRate, rate)
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer{Format: Format{SampleRate: rate, Channels: 1}, Data: data}, nil
+}
+
+// Normalize returns the buffer as mono at rate, the form fingerprinting
+// expects.
+func (b *Buffer) Normalize(rate int) (*Buffer, error) {
+	return b.Mono().Resample(rate)
+}
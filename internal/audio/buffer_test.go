@@ -0,0 +1,87 @@
+package audio
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBufferFramesAndDuration(t *testing.T) {
+	b := &Buffer{Format: Format{SampleRate: 48000, Channels: 2}, Data: make([]float64, 2*72000)}
+	if b.Frames() != 72000 {
+		t.Errorf("%d frames, want 72000", b.Frames())
+	}
+	if b.Duration() != 1500*time.Millisecond {
+		t.Errorf("duration %v, want 1.5s", b.Duration())
+	}
+	empty := &Buffer{}
+	if empty.Frames() != 0 || empty.Duration() != 0 {
+		t.Errorf("buffer without a format has %d frames of %v", empty.Frames(), empty.Duration())
+	}
+}
+
+func TestBufferMono(t *testing.T) {
+	stereo := &Buffer{Format: Format{SampleRate: 8000, Channels: 2}, Data: []float64{1, 0, 0.5, 0.5, -1, 0.2}}
+	mono := stereo.Mono()
+	if mono.Format != (Format{SampleRate: 8000, Channels: 1}) {
+		t.Errorf("mono format %v", mono.Format)
+	}
+	want := []float64{0.5, 0.5, -0.4}
+	for i := range want {
+		if math.Abs(mono.Data[i]-want[i]) > 1e-12 {
+			t.Fatalf("mixed down to %v, want %v", mono.Data, want)
+		}
+	}
+	if mono.Mono() != mono {
+		t.Error("Mono copied a mono buffer")
+	}
+}
+
+func TestBufferResampleNeedsMono(t *testing.T) {
+	stereo := &Buffer{Format: Format{SampleRate: 8000, Channels: 2}, Data: make([]float64, 16)}
+	if _, err := stereo.Resample(16000); err == nil {
+		t.Error("resampled a stereo buffer")
+	}
+	mono := stereo.Mono()
+	if same, err := mono.Resample(8000); err != nil || same != mono {
+		t.Errorf("resampling to the buffer's own rate returned %p, %v; want the buffer", same, err)
+	}
+}
+
+func TestBufferNormalize(t *testing.T) {
+	const rate, freq, seconds = 44100, 440.0, 2
+	cases := []Format{
+		{SampleRate: 44100, Channels: 1},
+		{SampleRate: 44100, Channels: 2},
+		{SampleRate: 48000, Channels: 2},
+		{SampleRate: 22050, Channels: 1},
+		{SampleRate: 16000, Channels: 1},
+		{SampleRate: 8000, Channels: 6},
+	}
+	for _, f := range cases {
+		// The tone is on the first channel only, so mixing down scales it
+		// by the number of channels.
+		mono := tone(freq, f.SampleRate, seconds)
+		data := make([]float64, len(mono)*f.Channels)
+		for i, s := range mono {
+			data[i*f.Channels] = s
+		}
+		b, err := (&Buffer{Format: f, Data: data}).Normalize(rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Format != (Format{SampleRate: rate, Channels: 1}) {
+			t.Errorf("%v normalized to %v", f, b.Format)
+		}
+		if b.Frames() != rate*seconds {
+			t.Errorf("%v: %d frames out of %ds, want %d", f, b.Frames(), seconds, rate*seconds)
+		}
+		gotFreq, amplitude := measureTone(b.Data, rate)
+		if math.Abs(gotFreq-freq) > freq*1e-3 {
+			t.Errorf("%v: %g Hz tone came out at %g Hz", f, freq, gotFreq)
+		}
+		if want := 0.5 / float64(f.Channels); math.Abs(amplitude-want) > 0.01 {
+			t.Errorf("%v: amplitude %g, want %g", f, amplitude, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnknownFormat is returned by Decode when no registered decoder
+// recognises the stream and no ffmpeg fallback is configured.
+var ErrUnknownFormat = errors.New("unrecognised audio format")
+
+// sniffLen is the number of leading bytes passed to Decoder.Sniff.
+const sniffLen = 64
+
+// Decoder decodes one container format.
+type Decoder struct {
+	// Name identifies the format in errors and logs, e.g. "wav".
+	Name string
+	// Sniff reports whether header, the first bytes of the stream (fewer
+	// than sniffLen for short streams), looks like this format.
+	Sniff func(header []byte) bool
+	// Decode returns the stream's samples in their own rate and channel
+	// layout. r is positioned at the start of the stream.
+	Decode func(r io.ReadSeeker) (*Buffer, error)
+}
+
+// Registry picks a decoder for a stream by looking at its content, never at
+// a file name or extension.
+type Registry struct {
+	decoders []Decoder
+
+	// FFmpegPath, if set, is the ffmpeg binary used for streams no
+	// registered decoder recognises, such as AAC in MP4/M4A containers.
+	FFmpegPath string
+}
+
+// NewRegistry returns a registry with the built-in WAV, FLAC, Ogg Vorbis and
+// MP3 decoders and no ffmpeg fallback.
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.Register(Decoder{Name: "wav", Sniff: sniffWAV, Decode: ReadWAV})
+	r.Register(Decoder{Name: "flac", Sniff: sniffFLAC, Decode: ReadFLAC})
+	r.Register(Decoder{Name: "vorbis", Sniff: sniffVorbis, Decode: ReadVorbis})
+	r.Register(Decoder{Name: "mp3", Sniff: sniffMP3, Decode: ReadMP3})
+	return r
+}
+
+// DefaultRegistry is used by Decode.
+var DefaultRegistry = NewRegistry()
+
+// Register adds d. Decoders are tried in registration order, so formats with
+// a strict signature should be registered before loosely sniffed ones.
+func (reg *Registry) Register(d Decoder) {
+	reg.decoders = append(reg.decoders, d)
+}
+
+// Sniff returns the name of the decoder that recognises r, or "" if none
+// does. r is rewound to the start before returning.
+func (reg *Registry) Sniff(r io.ReadSeeker) (string, error) {
+	d, err := reg.sniff(r)
+	if d == nil {
+		return "", err
+	}
+	return d.Name, err
+}
+
+func (reg *Registry) sniff(r io.ReadSeeker) (*Decoder, error) {
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header = header[:n]
+	for i := range reg.decoders {
+		if reg.decoders[i].Sniff(header) {
+			return &reg.decoders[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Decode decodes r with the first decoder that recognises its content,
+// falling back to ffmpeg when FFmpegPath is set.
+func (reg *Registry) Decode(r io.ReadSeeker) (*Buffer, error) {
+	d, err := reg.sniff(r)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		buf, err := d.Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", d.Name, err)
+		}
+		return buf, nil
+	}
+	if reg.FFmpegPath != "" {
+		return decodeFFmpeg(reg.FFmpegPath, r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// DecodeMedia is Decode for streams that arrive with a declared media type,
+// such as multipart uploads. Raw PCM types (see ParseRawMediaType) are
+// decoded as declared; any other type is ignored in favour of sniffing.
+func (reg *Registry) DecodeMedia(r io.ReadSeeker, mediaType string) (*Buffer, error) {
+	raw, ok, err := ParseRawMediaType(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return ReadRawPCM(r, raw)
+	}
+	return reg.Decode(r)
+}
+
+// Decode decodes r with DefaultRegistry.
+func Decode(r io.ReadSeeker) (*Buffer, error) {
+	return DefaultRegistry.Decode(r)
+}
+
+// DecodeMedia decodes r with DefaultRegistry.
+func DecodeMedia(r io.ReadSeeker, mediaType string) (*Buffer, error) {
+	return DefaultRegistry.DecodeMedia(r, mediaType)
+}
+
+func sniffWAV(header []byte) bool {
+	return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+func sniffFLAC(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("fLaC"))
+}
+
+// sniffVorbis matches an Ogg stream whose first packet is a Vorbis
+// identification header. Other Ogg codecs such as Opus are left to ffmpeg.
+func sniffVorbis(header []byte) bool {
+	if len(header) < 27 || string(header[0:4]) != "OggS" {
+		return false
+	}
+	segments := int(header[26])
+	packet := 27 + segments
+	return len(header) >= packet+7 && string(header[packet:packet+7]) == "\x01vorbis"
+}
+
+// sniffMP3 matches an ID3v2 tag or an MPEG audio layer III frame header.
+func sniffMP3(header []byte) bool {
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		return true
+	}
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return false
+	}
+	version := header[1] >> 3 & 0x3
+	layer := header[1] >> 1 & 0x3
+	bitrate := header[2] >> 4
+	rate := header[2] >> 2 & 0x3
+	return version != 1 && layer == 1 && bitrate != 0 && bitrate != 15 && rate != 3
+}
+
+// MixToMono averages interleaved frames of the given channel count into one
+// channel. Averaging rather than summing keeps full-scale input in range.
+func MixToMono(interleaved []float64, channels int) []float64 {
+	if channels <= 1 {
+		return interleaved
+	}
+	samples := make([]float64, len(interleaved)/channels)
+	for i := range samples {
+		sum := 0.0
+		for ch := 0; ch < channels; ch++ {
+			sum += interleaved[i*channels+ch]
+		}
+		samples[i] = sum / float64(channels)
+	}
+	return samples
+}
@@ -0,0 +1,50 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// decodeFFmpeg converts r to 16-bit WAV with an external ffmpeg and
+// decodes the result. Both sides go through temporary files: containers such
+// as MP4 need a seekable input, and a piped WAV has no valid size fields.
+func decodeFFmpeg(ffmpeg string, r io.Reader) (*Buffer, error) {
+	dir, err := os.MkdirTemp("", "shazam-ffmpeg-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "input")
+	outPath := filepath.Join(dir, "output.wav")
+	in, err := os.Create(inPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(in, r)
+	if closeErr := in.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpeg, "-nostdin", "-v", "error", "-i", inPath,
+		"-vn", "-ac", "1", "-c:a", "pcm_s16le", outPath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	out, err := os.Open(outPath)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	return ReadWAV(out)
+}
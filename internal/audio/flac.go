@@ -0,0 +1,47 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+// ReadFLAC decodes a native FLAC stream into samples in [-1, 1]. Frame CRCs
+// are verified; the STREAMINFO MD5 is not.
+//
+// The sample count in STREAMINFO comes from the file and is not trusted:
+// the buffer grows with the frames actually decoded, so a small file that
+// claims billions of samples costs nothing up front.
+func ReadFLAC(r io.ReadSeeker) (*Buffer, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, err
+	}
+	info := stream.Info
+	channels, bits := int(info.NChannels), int(info.BitsPerSample)
+	if info.SampleRate == 0 || channels == 0 || bits < 4 {
+		return nil, errors.New("invalid FLAC STREAMINFO")
+	}
+
+	buf := &Buffer{Format: Format{SampleRate: int(info.SampleRate), Channels: channels}}
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("frame at sample %d: %w", buf.Frames(), err)
+		}
+		if len(frame.Subframes) != channels {
+			return nil, fmt.Errorf("frame at sample %d has %d channels, stream has %d", buf.Frames(), len(frame.Subframes), channels)
+		}
+		for i := range frame.Subframes[0].Samples {
+			for _, sub := range frame.Subframes {
+				buf.Data = append(buf.Data, intToFloat(int64(sub.Samples[i]), bits))
+			}
+		}
+	}
+	return buf, nil
+}
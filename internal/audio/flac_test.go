@@ -0,0 +1,114 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// The fixtures in testdata are written by testdata/flacgen, each with its
+// source samples as little-endian int32 in a .pcm file.
+var flacFixtures = []struct {
+	name     string
+	rate     int
+	channels int
+	bits     int
+}{
+	// constant, verbatim and fixed orders 0 to 4, an uncommon block size
+	{"fixed", 44100, 1, 16},
+	// LPC orders 1 to 32 and precisions 5 to 15, variable block sizes
+	{"lpc", 48000, 1, 16},
+	{"lpc24", 96000, 1, 24},
+	// escaped Rice partitions, including a width of 0, with 4 and 5-bit
+	// parameters
+	{"escape", 22050, 1, 16},
+	// wasted bits in verbatim, constant, fixed and LPC subframes
+	{"wasted", 44100, 1, 24},
+	// independent, left/side, side/right and mid/side channels
+	{"stereo", 44100, 2, 16},
+	{"stereo24", 88200, 2, 24},
+}
+
+func readFLACFixture(t *testing.T, name string) (flac []byte, want []int32) {
+	t.Helper()
+	flac, err := os.ReadFile(filepath.Join("testdata", name+".flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := os.ReadFile(filepath.Join("testdata", name+".pcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = make([]int32, len(pcm)/4)
+	if err := binary.Read(bytes.NewReader(pcm), binary.LittleEndian, want); err != nil {
+		t.Fatal(err)
+	}
+	return flac, want
+}
+
+func TestReadFLACMatchesSource(t *testing.T) {
+	for _, f := range flacFixtures {
+		data, want := readFLACFixture(t, f.name)
+		buf, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+		if buf.Format != (Format{SampleRate: f.rate, Channels: f.channels}) {
+			t.Errorf("%s: format %+v, want %d Hz, %d channels", f.name, buf.Format, f.rate, f.channels)
+		}
+		if len(buf.Data) != len(want) {
+			t.Errorf("%s: decoded %d samples, source has %d", f.name, len(buf.Data), len(want))
+			continue
+		}
+		scale := float64(int64(1) << (f.bits - 1))
+		for i, v := range want {
+			if got := buf.Data[i] * scale; got != float64(v) {
+				t.Errorf("%s: sample %d (frame %d, channel %d) is %g, source %d",
+					f.name, i, i/f.channels, i%f.channels, got, v)
+				break
+			}
+		}
+	}
+}
+
+func TestReadFLACTruncated(t *testing.T) {
+	data, _ := readFLACFixture(t, "stereo")
+	// Cut into the middle of the last frame.
+	if _, err := ReadFLAC(bytes.NewReader(data[:len(data)-100])); err == nil {
+		t.Error("truncated stream decoded without an error")
+	}
+	if _, err := ReadFLAC(bytes.NewReader(append([]byte("fLaX"), data[4:]...))); err == nil {
+		t.Error("stream without the fLaC marker decoded without an error")
+	}
+}
+
+func TestReadFLACDoesNotTrustStreamInfo(t *testing.T) {
+	// A bare STREAMINFO claiming 2^36-1 frames of 8-channel 32-bit audio
+	// and no frames at all: 42 bytes that once asked for 4 TiB up front.
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	b.Write([]byte{0x80, 0, 0, 34})                     // last block, STREAMINFO, 34 bytes
+	b.Write([]byte{0x10, 0, 0x10, 0, 0, 0, 0, 0, 0, 0}) // block and frame sizes
+	sampleRate, channels, bits, total := uint64(44100), uint64(8), uint64(32), uint64(1)<<36-1
+	packed := sampleRate<<44 | (channels-1)<<41 | (bits-1)<<36 | total
+	b.Write(binary.BigEndian.AppendUint64(nil, packed))
+	b.Write(make([]byte, 16)) // MD5
+	if b.Len() != 42 {
+		t.Fatalf("header is %d bytes", b.Len())
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	buf, err := Decode(bytes.NewReader(b.Bytes()))
+	runtime.ReadMemStats(&after)
+	if err == nil && len(buf.Data) != 0 {
+		t.Errorf("decoded %d samples from a stream without frames", len(buf.Data))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decoding a 42-byte header allocated %d bytes", allocated)
+	}
+}
@@ -0,0 +1,27 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+
+	go_mp3 "github.com/hajimehoshi/go-mp3"
+)
+
+// ReadMP3 decodes an MPEG layer III stream into stereo samples in [-1, 1].
+func ReadMP3(r io.ReadSeeker) (*Buffer, error) {
+	decoder, err := go_mp3.NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	pcm, err := io.ReadAll(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-mp3 always produces interleaved 16-bit little-endian stereo.
+	samples := make([]float64, len(pcm)/2)
+	for i := range samples {
+		samples[i] = intToFloat(int64(int16(binary.LittleEndian.Uint16(pcm[i*2:]))), 16)
+	}
+	return &Buffer{Format: Format{SampleRate: decoder.SampleRate(), Channels: 2}, Data: samples}, nil
+}
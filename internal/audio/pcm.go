@@ -0,0 +1,199 @@
+package audio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// RawFormat describes headerless PCM, which cannot be sniffed and must be
+// declared by the sender.
+type RawFormat struct {
+	SampleRate int
+	Channels   int
+	// BitDepth is 8, 16, 24 or 32 for integer samples and 32 or 64 for
+	// float. 8-bit samples are unsigned, wider integers are signed two's
+	// complement.
+	BitDepth  int
+	Float     bool
+	BigEndian bool
+}
+
+func (f RawFormat) validate() error {
+	switch {
+	case f.SampleRate <= 0:
+		return errors.New("raw PCM sample rate must be positive")
+	case f.Channels <= 0:
+		return errors.New("raw PCM channel count must be positive")
+	}
+	return validSampleWidth(f.BitDepth/8, f.Float, f.BitDepth%8 == 0)
+}
+
+func validSampleWidth(width int, float, whole bool) error {
+	if !whole {
+		return errors.New("sample width is not a whole number of bytes")
+	}
+	if float && width != 4 && width != 8 {
+		return fmt.Errorf("unsupported float sample width %d bits", width*8)
+	}
+	if !float && (width < 1 || width > 4) {
+		return fmt.Errorf("unsupported integer sample width %d bits", width*8)
+	}
+	return nil
+}
+
+// ReadRawPCM decodes headerless interleaved PCM into samples in [-1, 1]. A
+// trailing partial frame is ignored.
+func ReadRawPCM(r io.Reader, f RawFormat) (*Buffer, error) {
+	p, err := NewPCMReader(bufio.NewReader(r), f)
+	if err != nil {
+		return nil, err
+	}
+	return p.ReadAll()
+}
+
+// PCMReader decodes interleaved PCM from a reader a block at a time, so
+// long recordings can be processed without holding them in memory.
+type PCMReader struct {
+	Format Format
+
+	r         io.Reader
+	width     int
+	float     bool
+	bigEndian bool
+	buf       []byte
+}
+
+// NewPCMReader returns a reader of headerless PCM in format f.
+func NewPCMReader(r io.Reader, f RawFormat) (*PCMReader, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return &PCMReader{
+		Format:    Format{SampleRate: f.SampleRate, Channels: f.Channels},
+		r:         r,
+		width:     f.BitDepth / 8,
+		float:     f.Float,
+		bigEndian: f.BigEndian,
+	}, nil
+}
+
+// ReadBlock returns up to frames frames of samples in [-1, 1]. It returns
+// io.EOF once the stream is exhausted; a trailing partial frame is ignored.
+func (p *PCMReader) ReadBlock(frames int) (*Buffer, error) {
+	if frames <= 0 {
+		return nil, errors.New("block size must be positive")
+	}
+	frameSize := p.Format.Channels * p.width
+	if cap(p.buf) < frames*frameSize {
+		p.buf = make([]byte, frames*frameSize)
+	}
+	data := p.buf[:frames*frameSize]
+	n, err := io.ReadFull(p.r, data)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		err = nil
+	case err != nil && err != io.EOF:
+		return nil, err
+	}
+	if n < frameSize {
+		return nil, io.EOF
+	}
+	return &Buffer{
+		Format: p.Format,
+		Data:   decodeInterleaved(data[:n], p.Format.Channels, p.width, p.float, p.bigEndian),
+	}, nil
+}
+
+// ReadAll decodes the rest of the stream into a single buffer.
+func (p *PCMReader) ReadAll() (*Buffer, error) {
+	data, err := io.ReadAll(p.r)
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer{
+		Format: p.Format,
+		Data:   decodeInterleaved(data, p.Format.Channels, p.width, p.float, p.bigEndian),
+	}, nil
+}
+
+// decodeInterleaved converts interleaved samples of width bytes each to
+// floats in [-1, 1], keeping the interleaving. A trailing partial frame is
+// ignored.
+func decodeInterleaved(data []byte, channels, width int, float, bigEndian bool) []float64 {
+	frames := len(data) / (channels * width)
+	samples := make([]float64, frames*channels)
+	for i := range samples {
+		samples[i] = pcmSample(data[i*width:(i+1)*width], float, bigEndian)
+	}
+	return samples
+}
+
+// pcmSample converts one encoded sample to a float in [-1, 1]. The width is
+// len(b): 8-bit integers are unsigned with a 128 offset, 16 to 32-bit
+// integers are signed, and float samples are IEEE 754 of 4 or 8 bytes.
+func pcmSample(b []byte, float, bigEndian bool) float64 {
+	var v uint64
+	for i := range b {
+		shift := uint(8 * i)
+		if bigEndian {
+			shift = uint(8 * (len(b) - 1 - i))
+		}
+		v |= uint64(b[i]) << shift
+	}
+	bits := uint(8 * len(b))
+	switch {
+	case float && bits == 32:
+		return float64(math.Float32frombits(uint32(v)))
+	case float:
+		return math.Float64frombits(v)
+	case bits == 8:
+		return (float64(v) - 128) / 128
+	}
+	signed := int64(v<<(64-bits)) >> (64 - bits)
+	return float64(signed) / float64(int64(1)<<(bits-1))
+}
+
+// intToFloat scales a signed integer sample of the given bit depth to
+// [-1, 1].
+func intToFloat(v int64, bits int) float64 {
+	return float64(v) / float64(int64(1)<<(bits-1))
+}
+
+// ParseRawMediaType parses the RFC 2586/3190 linear PCM media types
+// audio/L8, audio/L16 and audio/L24, e.g. "audio/L16; rate=44100;
+// channels=2". These are big-endian; a missing channels parameter means
+// mono. ok is false for any other media type.
+func ParseRawMediaType(mediaType string) (f RawFormat, ok bool, err error) {
+	name, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return RawFormat{}, false, nil
+	}
+	switch strings.ToLower(name) {
+	case "audio/l8":
+		f.BitDepth = 8
+	case "audio/l16":
+		f.BitDepth = 16
+	case "audio/l24":
+		f.BitDepth = 24
+	default:
+		return RawFormat{}, false, nil
+	}
+	f.BigEndian = true
+	f.Channels = 1
+
+	if f.SampleRate, err = strconv.Atoi(params["rate"]); err != nil {
+		return RawFormat{}, true, fmt.Errorf("%s: missing or invalid rate parameter", name)
+	}
+	if ch, present := params["channels"]; present {
+		if f.Channels, err = strconv.Atoi(ch); err != nil {
+			return RawFormat{}, true, fmt.Errorf("%s: invalid channels parameter", name)
+		}
+	}
+	return f, true, f.validate()
+}
@@ -0,0 +1,158 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestReadRawPCMEncodings(t *testing.T) {
+	f32 := func(v float32) []byte { return binary.LittleEndian.AppendUint32(nil, math.Float32bits(v)) }
+	f64 := func(v float64) []byte { return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)) }
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	cases := []struct {
+		name   string
+		format RawFormat
+		data   []byte
+		want   []float64
+	}{
+		{
+			name:   "8-bit unsigned",
+			format: RawFormat{BitDepth: 8},
+			data:   []byte{0, 64, 128, 192, 255},
+			want:   []float64{-1, -0.5, 0, 0.5, 127.0 / 128},
+		},
+		{
+			name:   "16-bit little-endian",
+			format: RawFormat{BitDepth: 16},
+			data:   []byte{0x00, 0x80, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x40, 0xff, 0x7f},
+			want:   []float64{-1, -0.5, 0, 0.5, 32767.0 / 32768},
+		},
+		{
+			name:   "16-bit big-endian",
+			format: RawFormat{BitDepth: 16, BigEndian: true},
+			data:   []byte{0x80, 0x00, 0xff, 0xff, 0x40, 0x00},
+			want:   []float64{-1, -1.0 / 32768, 0.5},
+		},
+		{
+			name:   "24-bit little-endian",
+			format: RawFormat{BitDepth: 24},
+			data:   []byte{0x00, 0x00, 0x80, 0xff, 0xff, 0xff, 0x00, 0x00, 0x40, 0xff, 0xff, 0x7f},
+			want:   []float64{-1, -1.0 / (1 << 23), 0.5, float64(1<<23-1) / (1 << 23)},
+		},
+		{
+			name:   "24-bit big-endian",
+			format: RawFormat{BitDepth: 24, BigEndian: true},
+			data:   []byte{0x80, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x01},
+			want:   []float64{-1, -0.5, 1.0 / (1 << 23)},
+		},
+		{
+			name:   "32-bit integer",
+			format: RawFormat{BitDepth: 32},
+			data:   []byte{0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x40, 0xff, 0xff, 0xff, 0xff},
+			want:   []float64{-1, 0.5, -1.0 / (1 << 31)},
+		},
+		{
+			name:   "32-bit float",
+			format: RawFormat{BitDepth: 32, Float: true},
+			data:   cat(f32(-1), f32(0.25), f32(0.75)),
+			want:   []float64{-1, 0.25, 0.75},
+		},
+		{
+			name:   "64-bit float",
+			format: RawFormat{BitDepth: 64, Float: true},
+			data:   cat(f64(-0.125), f64(1)),
+			want:   []float64{-0.125, 1},
+		},
+		{
+			name:   "32-bit float big-endian",
+			format: RawFormat{BitDepth: 32, Float: true, BigEndian: true},
+			data:   binary.BigEndian.AppendUint32(nil, math.Float32bits(0.5)),
+			want:   []float64{0.5},
+		},
+	}
+	for _, c := range cases {
+		c.format.SampleRate, c.format.Channels = 8000, 1
+		buf, err := ReadRawPCM(bytes.NewReader(c.data), c.format)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(buf.Data) != len(c.want) {
+			t.Fatalf("%s: %d samples, want %d", c.name, len(buf.Data), len(c.want))
+		}
+		for i, want := range c.want {
+			if buf.Data[i] != want {
+				t.Errorf("%s: sample %d is %g, want %g", c.name, i, buf.Data[i], want)
+			}
+		}
+	}
+}
+
+func TestPCMReaderBlocksKeepInterleaving(t *testing.T) {
+	// Three stereo 16-bit frames and a trailing half frame.
+	data := []byte{0x00, 0x40, 0x00, 0xc0, 0x00, 0x20, 0x00, 0xe0, 0x00, 0x10, 0x00, 0xf0, 0x00, 0x08}
+	p, err := NewPCMReader(bytes.NewReader(data), RawFormat{SampleRate: 8000, Channels: 2, BitDepth: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for {
+		block, err := p.ReadBlock(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Format != (Format{SampleRate: 8000, Channels: 2}) {
+			t.Fatalf("block format %v", block.Format)
+		}
+		got = append(got, block.Data...)
+	}
+	want := []float64{0.5, -0.5, 0.25, -0.25, 0.125, -0.125}
+	if len(got) != len(want) {
+		t.Fatalf("read %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("read %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRawFormatValidation(t *testing.T) {
+	bad := []RawFormat{
+		{SampleRate: 0, Channels: 1, BitDepth: 16},
+		{SampleRate: 8000, Channels: 0, BitDepth: 16},
+		{SampleRate: 8000, Channels: 1, BitDepth: 12},
+		{SampleRate: 8000, Channels: 1, BitDepth: 40},
+		{SampleRate: 8000, Channels: 1, BitDepth: 16, Float: true},
+	}
+	for _, f := range bad {
+		if _, err := NewPCMReader(bytes.NewReader(nil), f); err == nil {
+			t.Errorf("%+v accepted, want an error", f)
+		}
+	}
+}
+
+func TestParseRawMediaType(t *testing.T) {
+	f, ok, err := ParseRawMediaType("audio/L16; rate=44100; channels=2")
+	if !ok || err != nil {
+		t.Fatalf("ok %v, err %v", ok, err)
+	}
+	if want := (RawFormat{SampleRate: 44100, Channels: 2, BitDepth: 16, BigEndian: true}); f != want {
+		t.Errorf("parsed %+v, want %+v", f, want)
+	}
+	if f, ok, err := ParseRawMediaType("audio/L24;rate=8000"); !ok || err != nil || f.Channels != 1 || f.BitDepth != 24 {
+		t.Errorf("audio/L24 without channels: %+v, ok %v, err %v", f, ok, err)
+	}
+	if _, ok, err := ParseRawMediaType("audio/L8"); !ok || err == nil {
+		t.Errorf("missing rate: ok %v, err %v; want an error", ok, err)
+	}
+	if _, ok, _ := ParseRawMediaType("audio/wav"); ok {
+		t.Error("audio/wav parsed as raw PCM")
+	}
+}
@@ -0,0 +1,244 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// Resampler filter design. The kernel is a Kaiser-windowed sinc spanning
+// resampleZeroCrossings zero crossings on each side, with its cutoff a
+// little below the lower of the two Nyquist frequencies so the transition
+// band does not alias.
+const (
+	resampleZeroCrossings = 16
+	resampleRolloff       = 0.94
+	resampleKaiserBeta    = 8.6
+	// maxResamplePhases bounds the precomputed filter table. Ratios with
+	// more phases than this (e.g. 44100 to 44101 Hz) evaluate the kernel
+	// per output sample instead.
+	maxResamplePhases = 1024
+)
+
+// Resampler converts mono audio between two sample rates by the rational
+// ratio to/from, using a polyphase windowed-sinc low-pass filter. It is
+// safe for concurrent use.
+type Resampler struct {
+	from, to int
+	// up and down are the reduced ratio: output sample n lies at input
+	// position n*down/up.
+	up, down int64
+	// cutoff is the filter cutoff in cycles per input sample.
+	cutoff float64
+	// halfWidth is the number of input samples used on each side.
+	halfWidth int
+	// table[p] holds the 2*halfWidth taps for phase p, when precomputed.
+	table [][]float64
+}
+
+// NewResampler returns a resampler from one positive sample rate to another.
+func NewResampler(from, to int) (*Resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("invalid resampling rates %d Hz -> %d Hz", from, to)
+	}
+	g := gcd(from, to)
+	r := &Resampler{
+		from: from,
+		to:   to,
+		up:   int64(to / g),
+		down: int64(from / g),
+	}
+	r.cutoff = 0.5 * resampleRolloff * math.Min(1, float64(to)/float64(from))
+	r.halfWidth = int(math.Ceil(resampleZeroCrossings / (2 * r.cutoff)))
+
+	if r.up <= maxResamplePhases {
+		r.table = make([][]float64, r.up)
+		for p := range r.table {
+			r.table[p] = r.taps(float64(p) / float64(r.up))
+		}
+	}
+	return r, nil
+}
+
+// taps returns the filter taps for an output sample lying frac (0 <= frac <
+// 1) input samples after input sample i. Tap j weights input sample
+// i-halfWidth+1+j. The taps are normalized to unit DC gain.
+func (r *Resampler) taps(frac float64) []float64 {
+	taps := make([]float64, 2*r.halfWidth)
+	sum := 0.0
+	for j := range taps {
+		x := frac + float64(r.halfWidth-1-j)
+		taps[j] = r.kernel(x)
+		sum += taps[j]
+	}
+	if sum != 0 {
+		for j := range taps {
+			taps[j] /= sum
+		}
+	}
+	return taps
+}
+
+// kernel is the windowed-sinc impulse response at x input samples from its
+// centre.
+func (r *Resampler) kernel(x float64) float64 {
+	w := float64(r.halfWidth)
+	if math.Abs(x) >= w {
+		return 0
+	}
+	arg := 2 * r.cutoff * x
+	sinc := 1.0
+	if arg != 0 {
+		sinc = math.Sin(math.Pi*arg) / (math.Pi * arg)
+	}
+	u := x / w
+	window := besselI0(resampleKaiserBeta*math.Sqrt(1-u*u)) / besselI0(resampleKaiserBeta)
+	return 2 * r.cutoff * sinc * window
+}
+
+// Resample returns in converted to the output rate. Samples beyond either
+// end of in are treated as silence.
+func (r *Resampler) Resample(in []float64) []float64 {
+	if r.from == r.to {
+		return append([]float64(nil), in...)
+	}
+	n := int((int64(len(in))*r.up + r.down - 1) / r.down)
+	out := make([]float64, n)
+	for k := range out {
+		pos := int64(k) * r.down
+		i := int(pos / r.up)
+		phase := pos % r.up
+
+		var taps []float64
+		if r.table != nil {
+			taps = r.table[phase]
+		} else {
+			taps = r.taps(float64(phase) / float64(r.up))
+		}
+
+		start := i - r.halfWidth + 1
+		lo, hi := 0, len(taps)
+		if start < 0 {
+			lo = -start
+		}
+		if start+hi > len(in) {
+			hi = len(in) - start
+		}
+		sum := 0.0
+		for j := lo; j < hi; j++ {
+			sum += taps[j] * in[start+j]
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// ResampleStream resamples audio delivered in blocks. Its output is
+// identical to resampling the concatenated blocks in one call.
+type ResampleStream struct {
+	r *Resampler
+	// in holds the input samples still needed, starting at absolute input
+	// index base.
+	in   []float64
+	base int64
+	// total counts the input samples written and next is the index of the
+	// next output sample.
+	total, next int64
+}
+
+// Stream returns a new stream using r's filter.
+func (r *Resampler) Stream() *ResampleStream {
+	return &ResampleStream{r: r}
+}
+
+// Write adds mono input samples and returns the output samples whose
+// filter support is now complete.
+func (s *ResampleStream) Write(in []float64) []float64 {
+	if s.r.from == s.r.to {
+		s.total += int64(len(in))
+		return append([]float64(nil), in...)
+	}
+	s.in = append(s.in, in...)
+	s.total += int64(len(in))
+	return s.produce(false)
+}
+
+// Flush returns the remaining output samples, treating the input as ending
+// here.
+func (s *ResampleStream) Flush() []float64 {
+	if s.r.from == s.r.to {
+		return nil
+	}
+	return s.produce(true)
+}
+
+func (s *ResampleStream) produce(final bool) []float64 {
+	r := s.r
+	end := (s.total*r.up + r.down - 1) / r.down
+	var out []float64
+	for ; s.next < end; s.next++ {
+		pos := s.next * r.down
+		i := pos / r.up
+		if !final && i+int64(r.halfWidth) >= s.total {
+			break
+		}
+		phase := pos % r.up
+
+		var taps []float64
+		if r.table != nil {
+			taps = r.table[phase]
+		} else {
+			taps = r.taps(float64(phase) / float64(r.up))
+		}
+
+		start := i - int64(r.halfWidth) + 1
+		lo, hi := int64(0), int64(len(taps))
+		if start < 0 {
+			lo = -start
+		}
+		if start+hi > s.total {
+			hi = s.total - start
+		}
+		sum := 0.0
+		for j := lo; j < hi; j++ {
+			sum += taps[j] * s.in[start+j-s.base]
+		}
+		out = append(out, sum)
+	}
+
+	// Drop input no later output sample reaches.
+	first := (s.next*r.down)/r.up - int64(r.halfWidth) + 1
+	if drop := first - s.base; drop > 0 {
+		drop = min(drop, int64(len(s.in)))
+		s.in = s.in[:copy(s.in, s.in[drop:])]
+		s.base += drop
+	}
+	return out
+}
+
+// Resample converts mono samples from one sample rate to another.
+func Resample(samples []float64, from, to int) ([]float64, error) {
+	r, err := NewResampler(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return r.Resample(samples), nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind,
+// evaluated by its power series.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	half := x / 2
+	for k := 1; term > sum*1e-16; k++ {
+		term *= (half / float64(k)) * (half / float64(k))
+		sum += term
+	}
+	return sum
+}
@@ -0,0 +1,128 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func tone(freq float64, rate int, seconds float64) []float64 {
+	samples := make([]float64, int(seconds*float64(rate)))
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+	}
+	return samples
+}
+
+// measureTone estimates the frequency and amplitude of a sine from the
+// middle half of samples, away from the edges where the filter runs into
+// silence. The frequency comes from the positive-going zero crossings.
+func measureTone(samples []float64, rate int) (freq, amplitude float64) {
+	mid := samples[len(samples)/4 : 3*len(samples)/4]
+	var first, last float64
+	crossings := 0
+	for i := 1; i < len(mid); i++ {
+		if mid[i-1] < 0 && mid[i] >= 0 {
+			at := float64(i-1) + mid[i-1]/(mid[i-1]-mid[i])
+			if crossings == 0 {
+				first = at
+			}
+			last = at
+			crossings++
+		}
+		amplitude = math.Max(amplitude, math.Abs(mid[i]))
+	}
+	if crossings < 2 {
+		return 0, amplitude
+	}
+	return float64(crossings-1) * float64(rate) / (last - first), amplitude
+}
+
+func rms(samples []float64) float64 {
+	sum := 0.0
+	for _, s := range samples {
+		sum += s * s
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func TestResamplePreservesToneFrequency(t *testing.T) {
+	cases := []struct {
+		from, to int
+		freq     float64
+	}{
+		{44100, 11025, 1000},
+		{48000, 11025, 2500},
+		{22050, 11025, 440},
+		{8000, 11025, 1234},
+		{11025, 44100, 3000},
+		// 44101/44100 has too many phases for the filter table.
+		{44100, 44101, 5000},
+	}
+	for _, c := range cases {
+		out, err := Resample(tone(c.freq, c.from, 1), c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := c.to; len(out) != want {
+			t.Errorf("%d -> %d Hz: %d samples out of 1s, want %d", c.from, c.to, len(out), want)
+		}
+		freq, amplitude := measureTone(out, c.to)
+		if math.Abs(freq-c.freq) > c.freq*1e-3 {
+			t.Errorf("%d -> %d Hz: %g Hz tone came out at %g Hz", c.from, c.to, c.freq, freq)
+		}
+		if math.Abs(amplitude-0.5) > 0.01 {
+			t.Errorf("%d -> %d Hz: amplitude %g, want 0.5", c.from, c.to, amplitude)
+		}
+	}
+}
+
+func TestResampleRejectsAliases(t *testing.T) {
+	// 7 kHz is above the 5512.5 Hz Nyquist frequency of 11025 Hz and must
+	// be filtered out rather than folded down to 4025 Hz.
+	out, err := Resample(tone(7000, 44100, 1), 44100, 11025)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := rms(out[len(out)/4 : 3*len(out)/4]); level > 0.005 {
+		t.Errorf("alias level %g, want it filtered out", level)
+	}
+}
+
+func TestResampleStreamMatchesResample(t *testing.T) {
+	input := tone(997, 44100, 0.5)
+	for i := range input {
+		// Add a second tone so the signal is not periodic in the block size.
+		input[i] += 0.2 * math.Sin(float64(i)*0.37)
+	}
+	for _, rates := range [][2]int{{44100, 11025}, {48000, 11025}, {8000, 11025}, {44100, 44101}, {11025, 11025}} {
+		r, err := NewResampler(rates[0], rates[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := r.Resample(input)
+		for _, block := range []int{1, 7, 100, 4096, len(input)} {
+			stream := r.Stream()
+			var got []float64
+			for start := 0; start < len(input); start += block {
+				got = append(got, stream.Write(input[start:min(len(input), start+block)])...)
+			}
+			got = append(got, stream.Flush()...)
+			if len(got) != len(want) {
+				t.Fatalf("%v, blocks of %d: %d samples streamed, %d in one shot", rates, block, len(got), len(want))
+			}
+			for i := range got {
+				if math.Abs(got[i]-want[i]) > 1e-12 {
+					t.Fatalf("%v, blocks of %d: sample %d is %g streamed, %g in one shot", rates, block, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestNewResamplerRejectsRates(t *testing.T) {
+	for _, rates := range [][2]int{{0, 11025}, {44100, 0}, {-1, 11025}} {
+		if _, err := NewResampler(rates[0], rates[1]); err == nil {
+			t.Errorf("NewResampler(%d, %d) succeeded, want an error", rates[0], rates[1])
+		}
+	}
+}
@@ -0,0 +1,536 @@
+// Command flacgen writes the FLAC fixtures for the audio package tests.
+//
+// Each fixture forces one path through the decoder: the subframe types,
+// LPC orders and precisions, escaped Rice partitions, wasted bits and the
+// stereo decorrelation modes. The streams are written with the
+// github.com/mewkiz/flac encoder, with every subframe parameter chosen
+// here rather than by the encoder, and decoded again to check that they
+// round-trip. The source samples are stored next to each fixture as
+// interleaved little-endian int32 samples in a .pcm file.
+//
+// Regenerate the fixtures from the repository root with
+//
+//	go run ./internal/audio/testdata/flacgen -out internal/audio/testdata
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// subframe describes how to code one channel of a frame. The Rice
+// parameters and escape widths are worked out from the residual.
+type subframe struct {
+	pred      frame.Pred
+	order     int
+	precision uint // LPC coefficient precision in bits
+	wasted    uint
+	rice2     bool
+	partOrder int
+	escape    []int // partitions stored unencoded
+}
+
+type block struct {
+	size      int
+	channels  frame.Channels
+	subframes []subframe
+}
+
+type fixture struct {
+	name     string
+	rate     int
+	bps      int
+	channels int
+	// variable selects the variable blocking strategy, which codes sample
+	// rather than frame numbers in the frame header.
+	variable bool
+	blocks   []block
+	// signal fills samples for channel ch.
+	signal func(samples []int32, ch int)
+}
+
+var (
+	constant = subframe{pred: frame.PredConstant}
+	verbatim = subframe{pred: frame.PredVerbatim}
+)
+
+func fixed(order, partOrder int) subframe {
+	return subframe{pred: frame.PredFixed, order: order, partOrder: partOrder}
+}
+
+func lpc(order int, precision uint, partOrder int) subframe {
+	return subframe{pred: frame.PredFIR, order: order, precision: precision, partOrder: partOrder}
+}
+
+func (s subframe) withWasted(bits uint) subframe { s.wasted = bits; return s }
+func (s subframe) withRice2() subframe           { s.rice2 = true; return s }
+func (s subframe) withEscape(p ...int) subframe  { s.escape = p; return s }
+
+func mono(size int, s subframe) block {
+	return block{size: size, channels: frame.ChannelsMono, subframes: []subframe{s}}
+}
+
+func stereo(size int, channels frame.Channels, a, b subframe) block {
+	return block{size: size, channels: channels, subframes: []subframe{a, b}}
+}
+
+var fixtures = []fixture{
+	{
+		name: "fixed", rate: 44100, bps: 16, channels: 1,
+		blocks: []block{
+			mono(1152, constant),
+			mono(1152, verbatim),
+			mono(1152, fixed(0, 0)),
+			mono(1152, fixed(1, 2)),
+			mono(1152, fixed(2, 4)),
+			mono(1152, fixed(3, 1).withRice2()),
+			mono(1152, fixed(4, 3)),
+			mono(1000, fixed(2, 3)), // uncommon block size, coded in the header
+		},
+		signal: tones(1, 16),
+	},
+	{
+		name: "lpc", rate: 48000, bps: 16, channels: 1, variable: true,
+		blocks: []block{
+			mono(2048, lpc(1, 15, 0)),
+			mono(2048, lpc(8, 12, 4)),
+			mono(2048, lpc(12, 15, 2).withRice2()),
+			mono(2048, lpc(32, 15, 5)),
+			mono(2048, lpc(3, 5, 3)),
+			mono(777, lpc(10, 14, 0)), // odd block size, 8-bit size code
+		},
+		signal: tones(2, 16),
+	},
+	{
+		// 24-bit samples times 15-bit coefficients need 64-bit sums.
+		name: "lpc24", rate: 96000, bps: 24, channels: 1,
+		blocks: []block{
+			mono(2304, lpc(12, 15, 3)),
+			mono(2304, lpc(32, 15, 0).withRice2()),
+		},
+		signal: tones(3, 24),
+	},
+	{
+		name: "escape", rate: 22050, bps: 16, channels: 1,
+		blocks: []block{
+			mono(4096, fixed(2, 2).withEscape(1, 2)),
+			mono(4096, lpc(4, 13, 3).withRice2().withEscape(0, 7)),
+			mono(4096, fixed(1, 0).withEscape(0)),
+		},
+		signal: func(samples []int32, ch int) {
+			tones(4, 16)(samples, ch)
+			// A ramp over the third partition of the first frame leaves an
+			// order 2 residual of zeros, escaped with a width of 0.
+			for i := 2040; i < 3072; i++ {
+				samples[i] = int32(i*7 - 20000)
+			}
+		},
+	},
+	{
+		name: "wasted", rate: 44100, bps: 24, channels: 1,
+		blocks: []block{
+			mono(2048, verbatim.withWasted(5)),
+			mono(2048, fixed(2, 3).withWasted(5)),
+			mono(2048, lpc(8, 15, 2).withWasted(3)),
+			mono(2048, constant.withWasted(5)),
+			mono(2048, fixed(3, 0).withWasted(1).withEscape(0)),
+		},
+		signal: func(samples []int32, ch int) {
+			tones(5, 24)(samples, ch)
+			for i := range samples {
+				samples[i] &^= 1<<5 - 1
+			}
+		},
+	},
+	{
+		name: "stereo", rate: 44100, bps: 16, channels: 2, variable: true,
+		blocks: []block{
+			stereo(1152, frame.ChannelsLR, fixed(2, 2), lpc(8, 14, 2)),
+			stereo(1152, frame.ChannelsLeftSide, fixed(2, 2), fixed(2, 2)),
+			stereo(1152, frame.ChannelsSideRight, lpc(8, 14, 2), fixed(2, 2)),
+			stereo(1152, frame.ChannelsMidSide, fixed(2, 2), lpc(8, 14, 2)),
+			stereo(1152, frame.ChannelsLeftSide, verbatim, verbatim),
+			stereo(1152, frame.ChannelsSideRight, verbatim, verbatim),
+			stereo(1152, frame.ChannelsMidSide, verbatim, verbatim),
+			stereo(1152, frame.ChannelsMidSide, fixed(1, 0).withEscape(0), fixed(3, 1)),
+		},
+		signal: tones(6, 16),
+	},
+	{
+		// The side channel of 24-bit audio takes 25 bits.
+		name: "stereo24", rate: 88200, bps: 24, channels: 2,
+		blocks: []block{
+			stereo(2304, frame.ChannelsLeftSide, verbatim, verbatim),
+			stereo(2304, frame.ChannelsSideRight, verbatim, lpc(12, 15, 3)),
+			stereo(2304, frame.ChannelsMidSide, lpc(16, 15, 2).withRice2(), verbatim),
+			stereo(2304, frame.ChannelsMidSide, fixed(2, 2), fixed(2, 2).withEscape(3)),
+		},
+		signal: tones(7, 24),
+	},
+}
+
+// tones returns a signal of a few random tones and some noise at about half
+// of full scale.
+func tones(seed int64, bps int) func([]int32, int) {
+	return func(samples []int32, ch int) {
+		rng := rand.New(rand.NewSource(seed*10 + int64(ch)))
+		full := float64(int64(1) << (bps - 1))
+		var freqs [3]float64
+		for i := range freqs {
+			freqs[i] = 0.001 + rng.Float64()*0.05
+		}
+		for i := range samples {
+			v := 0.0
+			for _, f := range freqs {
+				v += 0.15 * math.Sin(2*math.Pi*f*float64(i))
+			}
+			v += 0.02 * (rng.Float64()*2 - 1)
+			samples[i] = int32(math.Round(v * full))
+		}
+	}
+}
+
+func main() {
+	out := flag.String("out", "internal/audio/testdata", "directory to write the fixtures to")
+	flag.Parse()
+	for _, f := range fixtures {
+		if err := generate(f, *out); err != nil {
+			log.Fatalf("%s: %v", f.name, err)
+		}
+	}
+}
+
+func generate(f fixture, dir string) error {
+	total := 0
+	for _, b := range f.blocks {
+		total += b.size
+	}
+	source := make([][]int32, f.channels)
+	for ch := range source {
+		source[ch] = make([]int32, total)
+		f.signal(source[ch], ch)
+	}
+
+	path := filepath.Join(dir, f.name+".flac")
+	if err := encode(path, f, source); err != nil {
+		return err
+	}
+	decoded, err := decode(path)
+	if err != nil {
+		return err
+	}
+	for ch := range source {
+		if len(decoded[ch]) != total {
+			return fmt.Errorf("decoded %d samples, encoded %d", len(decoded[ch]), total)
+		}
+		for i := range source[ch] {
+			if decoded[ch][i] != source[ch][i] {
+				return fmt.Errorf("channel %d sample %d decoded as %d, encoded %d", ch, i, decoded[ch][i], source[ch][i])
+			}
+		}
+	}
+
+	pcm, err := os.Create(filepath.Join(dir, f.name+".pcm"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(pcm)
+	for i := 0; i < total; i++ {
+		for ch := range decoded {
+			binary.Write(w, binary.LittleEndian, decoded[ch][i])
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return pcm.Close()
+}
+
+func encode(path string, f fixture, source [][]int32) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	info := &meta.StreamInfo{
+		SampleRate:    uint32(f.rate),
+		NChannels:     uint8(f.channels),
+		BitsPerSample: uint8(f.bps),
+	}
+	enc, err := flac.NewEncoder(file, info)
+	if err != nil {
+		return err
+	}
+	enc.EnablePredictionAnalysis(false)
+
+	start := 0
+	for _, b := range f.blocks {
+		channels := make([][]int32, len(source))
+		for ch := range source {
+			samples := source[ch][start : start+b.size]
+			if b.subframes[ch].pred == frame.PredConstant {
+				for i := range samples {
+					samples[i] = samples[0]
+				}
+			}
+			channels[ch] = append([]int32(nil), samples...)
+		}
+		start += b.size
+
+		fr := &frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: !f.variable,
+				BlockSize:         uint16(b.size),
+				SampleRate:        uint32(f.rate),
+				Channels:          b.channels,
+				BitsPerSample:     uint8(f.bps),
+			},
+		}
+		coded := decorrelate(b.channels, channels)
+		for ch, s := range b.subframes {
+			bps := uint(f.bps)
+			if sideChannel(b.channels, ch) {
+				bps++
+			}
+			sub, err := s.build(channels[ch], coded[ch], bps)
+			if err != nil {
+				return fmt.Errorf("block at %d, channel %d: %w", start-b.size, ch, err)
+			}
+			fr.Subframes = append(fr.Subframes, sub)
+		}
+		if err := enc.WriteFrame(fr); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+func sideChannel(channels frame.Channels, ch int) bool {
+	switch channels {
+	case frame.ChannelsLeftSide, frame.ChannelsMidSide:
+		return ch == 1
+	case frame.ChannelsSideRight:
+		return ch == 0
+	}
+	return false
+}
+
+// decorrelate returns the channels as the encoder will code them.
+func decorrelate(channels frame.Channels, samples [][]int32) [][]int32 {
+	if len(samples) != 2 {
+		return samples
+	}
+	l, r := samples[0], samples[1]
+	a, b := append([]int32(nil), l...), append([]int32(nil), r...)
+	for i := range l {
+		switch channels {
+		case frame.ChannelsLeftSide:
+			b[i] = l[i] - r[i]
+		case frame.ChannelsSideRight:
+			a[i] = l[i] - r[i]
+		case frame.ChannelsMidSide:
+			a[i] = int32((int64(l[i]) + int64(r[i])) >> 1)
+			b[i] = l[i] - r[i]
+		}
+	}
+	return [][]int32{a, b}
+}
+
+// build fills in the subframe header for samples, which the encoder codes
+// as coded after decorrelation.
+func (s subframe) build(samples, coded []int32, bps uint) (*frame.Subframe, error) {
+	sub := &frame.Subframe{
+		SubHeader: frame.SubHeader{Pred: s.pred, Order: s.order, Wasted: s.wasted},
+		Samples:   samples,
+		NSamples:  len(samples),
+	}
+	shifted := make([]int32, len(coded))
+	for i, v := range coded {
+		if v&(1<<s.wasted-1) != 0 {
+			return nil, errors.New("sample has bits set below the wasted bits")
+		}
+		shifted[i] = v >> s.wasted
+	}
+
+	var coeffs []int32
+	var shift int32
+	switch s.pred {
+	case frame.PredConstant, frame.PredVerbatim:
+		return sub, nil
+	case frame.PredFixed:
+		coeffs = frame.FixedCoeffs[s.order]
+	case frame.PredFIR:
+		coeffs, shift = quantize(levinson(shifted, s.order), s.precision)
+		sub.CoeffPrec, sub.CoeffShift, sub.Coeffs = s.precision, shift, coeffs
+	}
+	residual := residuals(shifted, coeffs, shift)
+	for i, v := range shifted[:s.order] {
+		if width(v) > int(bps-s.wasted) {
+			return nil, fmt.Errorf("warm-up sample %d does not fit in %d bits", i, bps-s.wasted)
+		}
+	}
+
+	sub.ResidualCodingMethod = frame.ResidualCodingMethodRice1
+	escape := uint(15)
+	if s.rice2 {
+		sub.ResidualCodingMethod = frame.ResidualCodingMethodRice2
+		escape = 31
+	}
+	parts := 1 << s.partOrder
+	rice := &frame.RiceSubframe{PartOrder: s.partOrder, Partitions: make([]frame.RicePartition, parts)}
+	for p := range rice.Partitions {
+		lo, hi := p*len(samples)/parts-s.order, (p+1)*len(samples)/parts-s.order
+		part := residual[max(lo, 0):hi]
+		if contains(s.escape, p) {
+			w := 0
+			for _, v := range part {
+				w = max(w, width(v))
+			}
+			rice.Partitions[p] = frame.RicePartition{Param: escape, EscapedBitsPerSample: uint(w)}
+			continue
+		}
+		rice.Partitions[p].Param = min(riceParameter(part), escape-1)
+	}
+	sub.RiceSubframe = rice
+	return sub, nil
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// width returns the bits needed to store v in two's complement.
+func width(v int32) int {
+	if v == 0 {
+		return 0
+	}
+	if v < 0 {
+		v = ^v
+	}
+	n := 1
+	for ; v != 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+func residuals(samples, coeffs []int32, shift int32) []int32 {
+	order := len(coeffs)
+	out := make([]int32, 0, len(samples)-order)
+	for i := order; i < len(samples); i++ {
+		var prediction int64
+		for j, c := range coeffs {
+			prediction += int64(c) * int64(samples[i-j-1])
+		}
+		out = append(out, samples[i]-int32(prediction>>shift))
+	}
+	return out
+}
+
+func riceParameter(residual []int32) uint {
+	var sum uint64
+	for _, v := range residual {
+		sum += uint64(v<<1 ^ v>>31)
+	}
+	k := uint(0)
+	for len(residual) > 0 && uint64(len(residual))<<(k+1) < sum {
+		k++
+	}
+	return k
+}
+
+// levinson returns the order LPC coefficients of samples by the
+// Levinson-Durbin recursion over a Welch-windowed autocorrelation.
+func levinson(samples []int32, order int) []float64 {
+	n := len(samples)
+	x := make([]float64, n)
+	for i, v := range samples {
+		w := 2*float64(i)/float64(n-1) - 1
+		x[i] = float64(v) * (1 - w*w)
+	}
+	r := make([]float64, order+1)
+	for lag := range r {
+		for i := lag; i < n; i++ {
+			r[lag] += x[i] * x[i-lag]
+		}
+	}
+	r[0] *= 1 + 1e-9
+
+	a := make([]float64, order)
+	prev := make([]float64, order)
+	e := r[0]
+	for i := 0; i < order; i++ {
+		k := r[i+1]
+		for j := 0; j < i; j++ {
+			k -= a[j] * r[i-j]
+		}
+		k /= e
+		copy(prev, a)
+		a[i] = k
+		for j := 0; j < i; j++ {
+			a[j] = prev[j] - k*prev[i-j-1]
+		}
+		e *= 1 - k*k
+	}
+	return a
+}
+
+// quantize rounds coefficients to precision bits with the largest shift
+// that keeps them in range.
+func quantize(coeffs []float64, precision uint) ([]int32, int32) {
+	peak := 0.0
+	for _, c := range coeffs {
+		peak = math.Max(peak, math.Abs(c))
+	}
+	shift := int32(precision) - 1
+	if peak > 0 {
+		_, exp := math.Frexp(peak)
+		shift -= int32(exp)
+	}
+	shift = max(0, min(shift, 15))
+	limit := int64(1) << (precision - 1)
+	q := make([]int32, len(coeffs))
+	for i, c := range coeffs {
+		v := int64(math.Round(c * float64(int64(1)<<shift)))
+		q[i] = int32(max(-limit, min(v, limit-1)))
+	}
+	return q, shift
+}
+
+func decode(path string) ([][]int32, error) {
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	decoded := make([][]int32, stream.Info.NChannels)
+	for {
+		fr, err := stream.ParseNext()
+		if err == io.EOF {
+			return decoded, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for ch, sub := range fr.Subframes {
+			decoded[ch] = append(decoded[ch], sub.Samples...)
+		}
+	}
+}
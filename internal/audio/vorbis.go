@@ -0,0 +1,20 @@
+package audio
+
+import (
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// ReadVorbis decodes an Ogg Vorbis stream into samples in [-1, 1].
+func ReadVorbis(r io.ReadSeeker) (*Buffer, error) {
+	data, format, err := oggvorbis.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]float64, len(data))
+	for i, v := range data {
+		samples[i] = float64(v)
+	}
+	return &Buffer{Format: Format{SampleRate: format.SampleRate, Channels: format.Channels}, Data: samples}, nil
+}
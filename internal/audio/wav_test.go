@@ -0,0 +1,61 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// wavFile returns a mono 16-bit WAV holding samples, with dataSize written
+// as the size of the data chunk and trailer appended after the samples.
+func wavFile(samples []int16, dataSize uint32, trailer []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, []uint32{16, 1<<16 | wavFormatPCM, 8000, 16000, 16<<16 | 2})
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, dataSize)
+	binary.Write(&b, binary.LittleEndian, samples)
+	b.Write(trailer)
+	return b.Bytes()
+}
+
+func TestReadWAVDataSize(t *testing.T) {
+	samples := []int16{0x4000, -0x4000, 0x2000, -0x2000}
+	want := []float64{0.5, -0.5, 0.25, -0.25}
+	// A chunk after the data must not be read as samples.
+	list := []byte("LIST\x04\x00\x00\x00INFO")
+
+	cases := []struct {
+		name string
+		data []byte
+		want []float64
+	}{
+		{"exact size", wavFile(samples, 8, list), want},
+		{"short size", wavFile(samples, 4, nil), want[:2]},
+		// Streamed WAVs written before their length was known.
+		{"size 0", wavFile(samples, 0, nil), want},
+		{"size 0xFFFFFFFF", wavFile(samples, 0xFFFFFFFF, nil), want},
+	}
+	for _, c := range cases {
+		buf, err := ReadWAV(bytes.NewReader(c.data))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if buf.Format != (Format{SampleRate: 8000, Channels: 1}) {
+			t.Errorf("%s: format %+v", c.name, buf.Format)
+		}
+		if len(buf.Data) != len(c.want) {
+			t.Errorf("%s: read %v, want %v", c.name, buf.Data, c.want)
+			continue
+		}
+		for i := range c.want {
+			if buf.Data[i] != c.want[i] {
+				t.Errorf("%s: read %v, want %v", c.name, buf.Data, c.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Package cli implements the shazam command-line tool.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"shazam/internal/audio"
+	"shazam/internal/config"
+	"shazam/internal/db"
+	"shazam/internal/diskindex"
+	"shazam/internal/fingerprint"
+)
+
+// Exit codes. A search that runs successfully but finds nothing exits with
+// ExitNoMatch so scripts can tell it apart from a failure.
+const (
+	ExitOK      = 0
+	ExitNoMatch = 1
+	ExitError   = 2
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(env *env, args []string) int
+}
+
+var commands = []command{
+	{"ingest", "<dir|file>...", "fingerprint audio files and add them to the catalog", runIngest},
+	{"search", "<file>", "identify an audio clip", runSearch},
+	{"delete", "<song-id>...", "remove songs and their fingerprints", runDelete},
+	{"replace", "<song-id> <file>", "replace the audio of a song, keeping its ID", runReplace},
+	{"list", "", "list the songs in the catalog", runList},
+	{"stats", "", "show catalog statistics", runStats},
+	{"monitor", "<file|->", "log the catalog songs played in a long recording or stream", runMonitor},
+	{"plays", "", "list the plays found by monitor", runPlays},
+	{"duplicates", "", "find songs that are in the catalog more than once", runDuplicates},
+	{"serve", "", "run the HTTP API", runServe},
+	{"migrate", "", "apply or revert Postgres schema migrations", runMigrate},
+	{"compact", "", "merge the segments of the on-disk index and drop deleted songs", runCompact},
+}
+
+// env carries what every command needs: its output streams and, once flags
+// are parsed, the loaded configuration.
+type env struct {
+	stdout io.Writer
+	stderr io.Writer
+	flags  *flag.FlagSet
+
+	configPath string
+	indexDir   string
+	dsn        string
+	format     string
+	verbose    bool
+
+	conf *config.Config
+}
+
+// Run executes the command line args (without the program name) and returns
+// the process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return ExitError
+		}
+		return ExitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		e := &env{stdout: stdout, stderr: stderr}
+		e.flags = flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		e.flags.SetOutput(stderr)
+		e.flags.Usage = func() {
+			fmt.Fprintf(stderr, "usage: shazam %s [flags] %s\n\n%s.\n\nflags:\n", cmd.name, cmd.args, cmd.summary)
+			e.flags.PrintDefaults()
+		}
+		e.flags.StringVar(&e.configPath, "config", "", "config file (.yaml or .toml); defaults to $"+config.ConfigFileEnv)
+		e.flags.StringVar(&e.indexDir, "index-dir", "", "use the on-disk index in this directory instead of Postgres")
+		e.flags.StringVar(&e.dsn, "dsn", "", "Postgres connection string, overriding the config")
+		e.flags.StringVar(&e.format, "format", "text", "output format: text or json")
+		e.flags.BoolVar(&e.verbose, "v", false, "log pipeline progress to stderr")
+		return cmd.run(e, args[1:])
+	}
+
+	fmt.Fprintf(stderr, "shazam: unknown command %q\n\n", args[0])
+	usage(stderr)
+	return ExitError
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: shazam <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "shazam <command> -h" for the flags of a command.`)
+}
+
+// parse parses the command's flags and loads the configuration. It returns
+// the positional arguments, or ok=false after reporting an error.
+func (e *env) parse(args []string) (rest []string, code int, ok bool) {
+	if err := e.flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ExitOK, false
+		}
+		return nil, ExitError, false
+	}
+	if e.format != "text" && e.format != "json" {
+		return nil, e.fail(fmt.Errorf("unknown output format %q", e.format)), false
+	}
+	if !e.verbose {
+		log.SetOutput(io.Discard)
+	} else {
+		log.SetOutput(e.stderr)
+	}
+
+	conf, err := config.Load(e.configPath)
+	if err != nil {
+		return nil, e.fail(fmt.Errorf("invalid configuration: %w", err)), false
+	}
+	if e.indexDir != "" {
+		conf.IndexDir = e.indexDir
+	}
+	if e.dsn != "" {
+		conf.Database.URL = e.dsn
+	}
+	e.conf = conf
+	audio.DefaultRegistry.FFmpegPath = conf.FFmpegPath
+	return e.flags.Args(), ExitOK, true
+}
+
+// fail reports err and returns ExitError.
+func (e *env) fail(err error) int {
+	fmt.Fprintf(e.stderr, "shazam %s: %v\n", e.flags.Name(), err)
+	return ExitError
+}
+
+func (e *env) json() bool {
+	return e.format == "json"
+}
+
+func (e *env) writeJSON(v any) {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// openStore opens the backend selected by the configuration. The returned
+// function releases it.
+func (e *env) openStore() (db.FingerprintStore, func(), error) {
+	store, err := OpenStore(e.conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, func() {
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+	}, nil
+}
+
+// OpenStore opens the on-disk index when conf.IndexDir is set and Postgres
+// otherwise. The Postgres schema is migrated to the latest version if
+// conf.Database.AutoMigrate is set, and must already be there if not.
+func OpenStore(conf *config.Config) (db.FingerprintStore, error) {
+	if conf.IndexDir != "" {
+		return diskindex.Open(conf.IndexDir)
+	}
+
+	DB, err := db.EstablishConn(conf.Database.DSN())
+	if err != nil {
+		return nil, err
+	}
+	if conf.Database.AutoMigrate {
+		err = db.Migrate(DB, schemaOptions(conf))
+	} else {
+		err = db.CheckSchema(DB)
+	}
+	if errors.Is(err, db.ErrSchemaOutdated) {
+		return nil, fmt.Errorf("%w; run shazam migrate", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store := db.NewGormStore(DB)
+	store.LoadMethod = conf.Database.BulkLoad
+	store.BatchSize = conf.Database.InsertBatchSize
+	return store, nil
+}
+
+// schemaOptions returns the options the Postgres schema is migrated with.
+func schemaOptions(conf *config.Config) db.SchemaOptions {
+	cfg := conf.Fingerprint
+	return db.SchemaOptions{
+		Layout: db.HashLayout{
+			BinHz:           cfg.BinHz(),
+			FramesPerSecond: cfg.FramesPerSecond(),
+			FreqBits:        fingerprint.HashFreqBits,
+			DeltaBits:       fingerprint.HashDeltaBits,
+		},
+		HashPartitions: conf.Database.HashPartitions,
+	}
+}
+
+// readAudio decodes the audio file at path.
+func readAudio(path string) (*audio.Buffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf, err := audio.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return buf, nil
+}
+
+// supportedExtensions lists the audio files ingest picks up from
+// directories. Decoding itself goes by content, not extension.
+var supportedExtensions = map[string]bool{
+	".wav":  true,
+	".flac": true,
+	".mp3":  true,
+	".ogg":  true,
+	".oga":  true,
+}
+
+// ffmpegExtensions are also picked up when an ffmpeg fallback is configured.
+var ffmpegExtensions = map[string]bool{
+	".m4a":  true,
+	".aac":  true,
+	".mp4":  true,
+	".opus": true,
+	".wma":  true,
+	".aiff": true,
+	".aif":  true,
+}
+
+func hasSupportedExtension(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return supportedExtensions[ext] || audio.DefaultRegistry.FFmpegPath != "" && ffmpegExtensions[ext]
+}
@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"shazam/internal/api/search"
+	"shazam/internal/ingest"
+)
+
+const wavRate = 11025
+
+// tones returns seconds of 16-bit samples at wavRate of a tone that jumps to
+// a random frequency four times a second, seeded by seed.
+func tones(seed int64, seconds int) []int16 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]int16, wavRate*seconds)
+	var freq float64
+	for i := range samples {
+		if i%(wavRate/4) == 0 {
+			freq = 300 + rng.Float64()*3000
+		}
+		samples[i] = int16(12000 * math.Sin(2*math.Pi*freq*float64(i)/wavRate))
+	}
+	return samples
+}
+
+// writeWAV writes samples as a mono 16-bit WAV file at path.
+func writeWAV(t *testing.T, path string, samples []int16) string {
+	t.Helper()
+	dataSize := uint32(2 * len(samples))
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(wavRate), uint32(2 * wavRate), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	var buf bytes.Buffer
+	for _, v := range append(header, samples) {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// shazam runs the command line args and returns its exit code and output.
+func shazam(t *testing.T, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = Run(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// clearEnv unsets every SHAZAM_* variable for the duration of the test, so
+// the defaults apply.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "SHAZAM_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestUsageAndArguments(t *testing.T) {
+	clearEnv(t)
+	index := t.TempDir()
+	cases := []struct {
+		args   []string
+		code   int
+		stderr string // substring of stderr
+	}{
+		{nil, ExitError, "usage: shazam <command>"},
+		{[]string{"help"}, ExitOK, "commands:"},
+		{[]string{"-h"}, ExitOK, "compact"},
+		{[]string{"identify"}, ExitError, `unknown command "identify"`},
+		{[]string{"list", "-h"}, ExitOK, "usage: shazam list"},
+		{[]string{"list", "-bogus"}, ExitError, "flag provided but not defined"},
+		{[]string{"list", "-format", "xml", "-index-dir", index}, ExitError, `unknown output format "xml"`},
+		{[]string{"list", "-config", filepath.Join(index, "missing.yaml")}, ExitError, "invalid configuration"},
+		{[]string{"search", "-index-dir", index}, ExitError, "usage: shazam search"},
+		{[]string{"search", "-index-dir", index, "a.wav", "b.wav"}, ExitError, "usage: shazam search"},
+		{[]string{"search", "-index-dir", index, filepath.Join(index, "missing.wav")}, ExitError, "shazam search:"},
+		{[]string{"ingest", "-index-dir", index}, ExitError, "usage: shazam ingest"},
+		{[]string{"ingest", "-index-dir", index, t.TempDir()}, ExitError, "no supported audio files"},
+		{[]string{"delete", "-index-dir", index}, ExitError, "usage: shazam delete"},
+		{[]string{"delete", "-index-dir", index, "one"}, ExitError, `invalid song ID "one"`},
+		{[]string{"delete", "-index-dir", index, "0"}, ExitError, `invalid song ID "0"`},
+		{[]string{"delete", "-index-dir", index, "7"}, ExitError, "song 7 does not exist"},
+		{[]string{"replace", "-index-dir", index, "1"}, ExitError, "usage: shazam replace"},
+		{[]string{"compact"}, ExitError, "shazam compact:"},
+	}
+	for _, c := range cases {
+		code, _, stderr := shazam(t, c.args...)
+		if code != c.code || !strings.Contains(stderr, c.stderr) {
+			t.Errorf("shazam %q exited %d with stderr %q, want %d and %q", c.args, code, stderr, c.code, c.stderr)
+		}
+	}
+}
+
+func TestCatalogCommands(t *testing.T) {
+	clearEnv(t)
+	dir := t.TempDir()
+	index := filepath.Join(dir, "index")
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	song := tones(1, 20)
+	writeWAV(t, filepath.Join(music, "one.wav"), song)
+	writeWAV(t, filepath.Join(music, "two.wav"), tones(2, 20))
+	os.WriteFile(filepath.Join(music, "notes.txt"), []byte("not audio"), 0o644)
+	clip := writeWAV(t, filepath.Join(dir, "clip.wav"), song[5*wavRate:10*wavRate])
+	unknown := writeWAV(t, filepath.Join(dir, "unknown.wav"), tones(99, 5))
+
+	// Directories are searched for audio files only.
+	code, stdout, stderr := shazam(t, "ingest", "-index-dir", index, "-format", "json", music)
+	if code != ExitOK {
+		t.Fatalf("ingest exited %d: %s", code, stderr)
+	}
+	var results []ingest.Result
+	if err := json.Unmarshal([]byte(stdout), &results); err != nil {
+		t.Fatalf("ingest output %q: %v", stdout, err)
+	}
+	if len(results) != 2 || results[0].SongID == 0 || results[0].Fingerprints == 0 {
+		t.Fatalf("ingest results %+v, want the two WAV files", results)
+	}
+	one := results[0].SongID
+
+	// Ingesting again skips what is stored.
+	if code, stdout, _ := shazam(t, "ingest", "-index-dir", index, music); code != ExitOK || strings.Count(stdout, "skipped") != 2 {
+		t.Errorf("second ingest exited %d with %q, want both files skipped", code, stdout)
+	}
+
+	code, stdout, stderr = shazam(t, "search", "-index-dir", index, "-format", "json", clip)
+	if code != ExitOK {
+		t.Fatalf("search of a clip exited %d: %s%s", code, stdout, stderr)
+	}
+	var result search.SearchResult
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		t.Fatalf("search output %q: %v", stdout, err)
+	}
+	if !result.Matched || result.Match.Song.ID != one || result.Match.Song.Title != "one" {
+		t.Errorf("clip matched %+v, want song %d titled one", result.Match, one)
+	}
+	if code, stdout, _ := shazam(t, "search", "-index-dir", index, unknown); code != ExitNoMatch || !strings.Contains(stdout, "no confident match") {
+		t.Errorf("search of unknown audio exited %d with %q, want %d", code, stdout, ExitNoMatch)
+	}
+
+	var listing []songListing
+	code, stdout, _ = shazam(t, "list", "-index-dir", index, "-format", "json")
+	if err := json.Unmarshal([]byte(stdout), &listing); code != ExitOK || err != nil {
+		t.Fatalf("list exited %d with %q: %v", code, stdout, err)
+	}
+	if len(listing) != 2 || listing[0].Title != "one" || listing[1].Title != "two" || listing[0].Duration != 20 {
+		t.Errorf("listing %+v, want songs one and two of 20s", listing)
+	}
+
+	if code, stdout, _ := shazam(t, "delete", "-index-dir", index, "-format", "json", "2"); code != ExitOK || !strings.Contains(stdout, `"deleted"`) {
+		t.Errorf("delete exited %d with %q", code, stdout)
+	}
+	var stats catalogStats
+	code, stdout, _ = shazam(t, "stats", "-index-dir", index, "-format", "json")
+	if err := json.Unmarshal([]byte(stdout), &stats); code != ExitOK || err != nil {
+		t.Fatalf("stats exited %d with %q: %v", code, stdout, err)
+	}
+	if stats.Songs != 1 || stats.TotalDuration != 20 || len(stats.ConfigIDs) != 1 {
+		t.Errorf("stats %+v after deleting a song, want one song of 20s", stats)
+	}
+
+	code, stdout, _ = shazam(t, "compact", "-index-dir", index, "-format", "json")
+	var compacted struct{ Segments int }
+	if err := json.Unmarshal([]byte(stdout), &compacted); code != ExitOK || err != nil || compacted.Segments != 1 {
+		t.Errorf("compact exited %d with %q, want one segment", code, stdout)
+	}
+	if code, _, _ := shazam(t, "search", "-index-dir", index, clip); code != ExitOK {
+		t.Errorf("search after compact exited %d", code)
+	}
+}
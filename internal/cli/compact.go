@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"shazam/internal/diskindex"
+)
+
+func runCompact(e *env, args []string) int {
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+	if e.conf.IndexDir == "" {
+		return e.fail(errors.New("compaction only applies to the on-disk index, but index_dir is not set"))
+	}
+
+	idx, err := diskindex.Open(e.conf.IndexDir)
+	if err != nil {
+		return e.fail(err)
+	}
+	defer idx.Close()
+
+	before := idx.Segments()
+	if err := idx.Compact(); err != nil {
+		return e.fail(err)
+	}
+	after := idx.Segments()
+
+	if e.json() {
+		e.writeJSON(map[string]int{"segments_before": before, "segments": after})
+		return ExitOK
+	}
+	fmt.Fprintf(e.stdout, "compacted %s from %d segments to %d\n", e.conf.IndexDir, before, after)
+	return ExitOK
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"fmt"
+
+	"shazam/internal/dedup"
+)
+
+func runDuplicates(e *env, args []string) int {
+	minOverlap := e.flags.Float64("min-overlap", 0, "share of the shorter song that must line up, overriding the config")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+	conf := e.conf.Dedup
+	if *minOverlap != 0 {
+		conf.MinOverlap = *minOverlap
+		if err := conf.Validate(); err != nil {
+			return e.fail(err)
+		}
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	report, err := dedup.Find(store, e.conf.Fingerprint, e.conf.Match, conf)
+	if err != nil {
+		return e.fail(err)
+	}
+	if e.json() {
+		e.writeJSON(report)
+		return ExitOK
+	}
+
+	fmt.Fprintf(e.stdout, "compared %d songs", report.Songs)
+	if report.Skipped > 0 {
+		fmt.Fprintf(e.stdout, " (skipped %d indexed under another config or without fingerprints)", report.Skipped)
+	}
+	fmt.Fprintf(e.stdout, ", found %d clusters of duplicates\n", len(report.Clusters))
+	for i, c := range report.Clusters {
+		fmt.Fprintf(e.stdout, "\ncluster %d:\n", i+1)
+		for _, song := range c.Songs {
+			fmt.Fprintf(e.stdout, "  song %d: %s\n", song.ID, describeSong(song.Title, song.Artist))
+		}
+		for _, p := range c.Pairs {
+			fmt.Fprintf(e.stdout, "  %d ~ %d: %.1f%% overlap, %d starts at %+.3fs in %d",
+				p.SongA, p.SongB, p.OverlapPercent, p.SongA, p.OffsetSeconds, p.SongB)
+			if p.Speed != 1 {
+				fmt.Fprintf(e.stdout, ", speed=%.3f", p.Speed)
+			}
+			fmt.Fprintln(e.stdout)
+		}
+	}
+	return ExitOK
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"shazam/internal/db"
+	"shazam/internal/ingest"
+)
+
+func runIngest(e *env, args []string) int {
+	title := e.flags.String("title", "", "song title (single file only; defaults to the file name)")
+	artist := e.flags.String("artist", "", "song artist (single file only)")
+	album := e.flags.String("album", "", "song album (single file only)")
+	workers := e.flags.Int("workers", runtime.NumCPU(), "number of files decoded and fingerprinted in parallel")
+	load := e.flags.String("load", "", `how Postgres is written: "copy" or "insert" (default: database.bulk_load)`)
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+
+	paths, err := collectAudioFiles(args)
+	if err != nil {
+		return e.fail(err)
+	}
+	if len(paths) == 0 {
+		return e.fail(errors.New("no supported audio files found"))
+	}
+	if len(paths) > 1 && (*title != "" || *artist != "" || *album != "") {
+		return e.fail(errors.New("-title, -artist and -album require a single file"))
+	}
+	switch *load {
+	case "":
+	case db.LoadCopy, db.LoadInsert:
+		e.conf.Database.BulkLoad = *load
+	default:
+		return e.fail(fmt.Errorf("-load must be %q or %q, got %q", db.LoadCopy, db.LoadInsert, *load))
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	jobs := make([]ingest.Job, len(paths))
+	for i, path := range paths {
+		jobs[i] = ingest.Job{
+			Path: path,
+			Song: db.Song{Title: *title, Artist: *artist, Album: *album},
+		}
+	}
+
+	// An interrupted run stops after the files in flight; running the same
+	// command again skips what was already ingested.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	pipeline := ingest.Pipeline{
+		Store:      store,
+		Config:     e.conf.Fingerprint,
+		Workers:    *workers,
+		OnProgress: e.reportIngestProgress,
+	}
+	results, err := pipeline.Run(ctx, jobs)
+	if results == nil {
+		return e.fail(err)
+	}
+	if reporter, ok := store.(db.LoadReporter); ok {
+		e.reportLoadStats(reporter.LoadStats())
+	}
+
+	if e.json() {
+		e.writeJSON(results)
+	}
+	if err != nil {
+		return e.fail(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return ExitError
+		}
+	}
+	return ExitOK
+}
+
+// reportIngestProgress prints one line per finished file. Failures and the
+// running totals go to stderr so the JSON output stays clean.
+func (e *env) reportIngestProgress(p ingest.Progress) {
+	r := p.Last
+	switch {
+	case r.Err != nil:
+		fmt.Fprintf(e.stderr, "failed %s: %v\n", r.Path, r.Err)
+	case e.json():
+	case r.Skipped:
+		fmt.Fprintf(e.stdout, "skipped %s: already ingested as song %d\n", r.Path, r.SongID)
+	default:
+		fmt.Fprintf(e.stdout, "ingested %s as song %d (%d fingerprints)\n", r.Path, r.SongID, r.Fingerprints)
+	}
+
+	finished := p.Done + p.Failed + p.Skipped
+	if p.Total > 1 {
+		fmt.Fprintf(e.stderr, "[%d/%d] %d ingested, %d skipped, %d failed, %s elapsed",
+			finished, p.Total, p.Done, p.Skipped, p.Failed, p.Elapsed.Round(time.Second))
+		if finished < p.Total && p.ETA > 0 {
+			fmt.Fprintf(e.stderr, ", about %s left", p.ETA.Round(time.Second))
+		}
+		fmt.Fprintln(e.stderr)
+	}
+}
+
+// reportLoadStats prints the fingerprint write throughput per load method to
+// stderr.
+func (e *env) reportLoadStats(stats []db.LoadStat) {
+	for _, s := range stats {
+		fmt.Fprintf(e.stderr, "wrote %d fingerprint rows via %s in %d writes, %s (%.0f rows/s)\n",
+			s.Rows, s.Method, s.Writes, s.Duration.Round(time.Millisecond), s.RowsPerSecond())
+	}
+}
+
+// collectAudioFiles expands directories in args into the supported audio
+// files beneath them. Files named explicitly are kept regardless of
+// extension.
+func collectAudioFiles(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		var found []string
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && hasSupportedExtension(path) {
+				found = append(found, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		paths = append(paths, found...)
+	}
+	return paths, nil
+}
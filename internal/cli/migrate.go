@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"shazam/internal/db"
+)
+
+func runMigrate(e *env, args []string) int {
+	to := e.flags.Int("to", -1, "schema version to migrate up or down to (default: the latest)")
+	status := e.flags.Bool("status", false, "only report the current and latest schema version")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+	if e.conf.IndexDir != "" {
+		return e.fail(errors.New("schema migrations only apply to Postgres, but index_dir is set"))
+	}
+
+	DB, err := db.EstablishConn(e.conf.Database.DSN())
+	if err != nil {
+		return e.fail(err)
+	}
+	if sqlDB, err := DB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	from, err := db.SchemaVersion(DB)
+	if err != nil {
+		return e.fail(err)
+	}
+	target := *to
+	if target < 0 {
+		target = db.LatestSchemaVersion()
+	}
+	if !*status {
+		if err := db.MigrateTo(DB, target, schemaOptions(e.conf)); err != nil {
+			return e.fail(err)
+		}
+	}
+	version, err := db.SchemaVersion(DB)
+	if err != nil {
+		return e.fail(err)
+	}
+
+	if e.json() {
+		e.writeJSON(map[string]int{"from": from, "version": version, "latest": db.LatestSchemaVersion()})
+		return ExitOK
+	}
+	switch {
+	case *status:
+		fmt.Fprintf(e.stdout, "schema version %d, latest %d\n", version, db.LatestSchemaVersion())
+		for _, m := range db.Migrations {
+			state := "pending"
+			if m.Version <= version {
+				state = "applied"
+			}
+			fmt.Fprintf(e.stdout, "  %3d %-24s %s\n", m.Version, m.Name, state)
+		}
+	case from == version:
+		fmt.Fprintf(e.stdout, "schema already at version %d\n", version)
+	default:
+		fmt.Fprintf(e.stdout, "migrated schema from version %d to %d\n", from, version)
+	}
+	return ExitOK
+}
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+	"shazam/internal/monitor"
+)
+
+func runMonitor(e *env, args []string) int {
+	source := e.flags.String("source", "", "name of the stream in the play log (default: the file name)")
+	csvPath := e.flags.String("csv", "", "also export plays as CSV to this file")
+	jsonPath := e.flags.String("jsonl", "", "also export plays as JSON lines to this file")
+	startFlag := e.flags.String("start", "", "wall-clock time of the start of the stream, RFC 3339 (default: now when reading stdin)")
+	rate := e.flags.Int("rate", 44100, "sample rate of raw PCM on stdin")
+	channels := e.flags.Int("channels", 1, "channel count of raw PCM on stdin")
+	bits := e.flags.Int("bits", 16, "bits per sample of raw PCM on stdin")
+	float := e.flags.Bool("float", false, "raw PCM on stdin holds float samples")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 1 {
+		e.flags.Usage()
+		return ExitError
+	}
+	path := args[0]
+	if *source == "" {
+		*source = path
+	}
+
+	var origin time.Time
+	switch {
+	case *startFlag != "":
+		t, err := time.Parse(time.RFC3339, *startFlag)
+		if err != nil {
+			return e.fail(fmt.Errorf("invalid -start: %w", err))
+		}
+		origin = t
+	case path == "-":
+		origin = time.Now()
+	}
+
+	var exporters []monitor.Exporter
+	for _, out := range []struct {
+		path string
+		new  func(io.Writer) monitor.Exporter
+	}{
+		{*csvPath, func(w io.Writer) monitor.Exporter { return monitor.NewCSVExporter(w) }},
+		{*jsonPath, func(w io.Writer) monitor.Exporter { return monitor.NewJSONExporter(w) }},
+	} {
+		if out.path == "" {
+			continue
+		}
+		f, err := os.Create(out.path)
+		if err != nil {
+			return e.fail(err)
+		}
+		defer f.Close()
+		exporters = append(exporters, out.new(f))
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+	playLog, _ := store.(db.PlayLog)
+	if playLog == nil {
+		log.Printf("The store keeps no play log; plays are only printed and exported.")
+	}
+
+	plays := 0
+	m := &monitor.Monitor{
+		Store:       store,
+		Fingerprint: e.conf.Fingerprint,
+		Match:       e.conf.Match,
+		Config:      e.conf.Monitor,
+		Source:      *source,
+		Origin:      origin,
+		OnPlay: func(play db.Play) error {
+			if playLog != nil {
+				if err := playLog.AddPlay(&play); err != nil {
+					return err
+				}
+			}
+			for _, exp := range exporters {
+				if err := exp.Write(play); err != nil {
+					return err
+				}
+			}
+			plays++
+			if e.json() {
+				e.writeJSON(play)
+			} else {
+				fmt.Fprintf(e.stdout, "%s-%s %s (song %d) from %s, confidence %.2f\n",
+					formatStreamTime(play.StreamStart), formatStreamTime(play.StreamEnd),
+					describeSong(play.Title, play.Artist), play.SongID, formatStreamTime(play.RefOffset), play.Confidence)
+			}
+			return nil
+		},
+	}
+
+	if err := monitorInput(m, path, audio.RawFormat{SampleRate: *rate, Channels: *channels, BitDepth: *bits, Float: *float}); err != nil {
+		return e.fail(err)
+	}
+	if plays == 0 {
+		return ExitNoMatch
+	}
+	return ExitOK
+}
+
+// monitorInput feeds the audio at path, or raw PCM in format on stdin for
+// "-", to m.
+func monitorInput(m *monitor.Monitor, path string, format audio.RawFormat) error {
+	if path == "-" {
+		duration, err := fingerprint.FingerprintReader(os.Stdin, format, 0, m.Fingerprint, m.Add)
+		if err != nil {
+			return err
+		}
+		return m.Finish(duration)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// WAV recordings are streamed, as they can run for hours; other
+	// formats are decoded whole.
+	if name, _ := audio.DefaultRegistry.Sniff(f); name == "wav" {
+		pcm, err := audio.OpenWAV(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		duration, err := fingerprint.FingerprintPCM(pcm, 0, m.Fingerprint, m.Add)
+		if err != nil {
+			return err
+		}
+		return m.Finish(duration)
+	}
+	buf, err := audio.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fingerprints, err := fingerprint.FingerprintAudio(buf, 0, m.Fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := m.Add(fingerprints); err != nil {
+		return err
+	}
+	return m.Finish(buf.Duration())
+}
+
+func runPlays(e *env, args []string) int {
+	source := e.flags.String("source", "", "only list plays of this stream")
+	csvOut := e.flags.Bool("csv", false, "write CSV instead of the -format output")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+	playLog, ok := store.(db.PlayLog)
+	if !ok {
+		return e.fail(errors.New("the store keeps no play log"))
+	}
+	plays, err := playLog.ListPlays(*source)
+	if err != nil {
+		return e.fail(err)
+	}
+
+	switch {
+	case *csvOut:
+		exp := monitor.NewCSVExporter(e.stdout)
+		for _, play := range plays {
+			if err := exp.Write(play); err != nil {
+				return e.fail(err)
+			}
+		}
+	case e.json():
+		if plays == nil {
+			plays = []db.Play{}
+		}
+		e.writeJSON(plays)
+	default:
+		tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSOURCE\tSTART\tEND\tSONG\tFROM\tCONFIDENCE")
+		for _, play := range plays {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s (song %d)\t%s\t%.2f\n", play.ID, play.Source,
+				formatStreamTime(play.StreamStart), formatStreamTime(play.StreamEnd),
+				describeSong(play.Title, play.Artist), play.SongID, formatStreamTime(play.RefOffset), play.Confidence)
+		}
+		tw.Flush()
+	}
+	return ExitOK
+}
+
+// formatStreamTime formats seconds as h:mm:ss.s.
+func formatStreamTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(100 * time.Millisecond)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%d:%02d:%04.1f", h, m, s)
+}
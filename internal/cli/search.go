@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"fmt"
+
+	"shazam/internal/api/search"
+	"shazam/internal/fingerprint"
+)
+
+func runSearch(e *env, args []string) int {
+	top := e.flags.Int("top", -1, "number of candidates to show, overriding the config (0 shows all)")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	mc := e.conf.Match
+	if *top >= 0 {
+		mc.TopN = *top
+	}
+	if len(args) != 1 {
+		e.flags.Usage()
+		return ExitError
+	}
+
+	cfg := e.conf.Fingerprint
+	buf, err := readAudio(args[0])
+	if err != nil {
+		return e.fail(err)
+	}
+	fingerprints, err := fingerprint.FingerprintAudio(buf, 0, cfg)
+	if err != nil {
+		return e.fail(err)
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	result, err := search.Search(fingerprints, cfg, mc, store)
+	if err != nil {
+		return e.fail(err)
+	}
+
+	if e.json() {
+		e.writeJSON(result)
+	} else {
+		if result.Matched {
+			fmt.Fprintf(e.stdout, "match: %s (song %d), confidence %.2f\n",
+				describeSong(result.Match.Song.Title, result.Match.Song.Artist), result.Match.Song.ID, result.Match.Confidence)
+		} else {
+			fmt.Fprintln(e.stdout, "no confident match")
+		}
+		for i, m := range result.Candidates {
+			fmt.Fprintf(e.stdout, "%d. %s (song %d) confidence=%.2f matches=%d ratio=%.1f significance=%.1f offset=%s track=%s-%s speed=%.3f\n",
+				i+1, describeSong(m.Song.Title, m.Song.Artist), m.Song.ID, m.Confidence, m.MatchCount, m.Ratio, m.Significance,
+				formatMs(m.MatchOffset), formatMs(m.TrackStart), formatMs(m.TrackEnd), m.Speed)
+		}
+	}
+
+	if !result.Matched {
+		return ExitNoMatch
+	}
+	return ExitOK
+}
+
+// formatMs formats milliseconds as seconds.
+func formatMs(ms int) string {
+	return fmt.Sprintf("%.3fs", float64(ms)/1000)
+}
+
+func describeSong(title, artist string) string {
+	if artist == "" {
+		return title
+	}
+	return artist + " - " + title
+}
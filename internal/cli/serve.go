@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"net/http"
+
+	"shazam/internal/api/search"
+	"shazam/internal/api/upload"
+	"shazam/internal/dedup"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+func runServe(e *env, args []string) int {
+	addr := e.flags.String("addr", "", "listen address, overriding the config")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+	if *addr != "" {
+		e.conf.Server.ListenAddr = *addr
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	r := gin.Default()
+	r.Use(cors.New(cors.Config{
+		AllowMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowHeaders: []string{"Origin", "Content-Type", "Accept"},
+		AllowOrigins: e.conf.Server.CORSOrigins,
+	}))
+	r.Use(limitBody(e.conf.Server.MaxUploadBytes))
+	r.MaxMultipartMemory = e.conf.Server.MaxUploadBytes
+
+	r.POST("/search", search.NewRecogniseHandler(store, e.conf.Fingerprint, e.conf.Match))
+	r.POST("/search/batch", search.NewBatchHandler(store, e.conf.Fingerprint, e.conf.Match))
+	r.POST("/songs", upload.NewUploadHandler(store, e.conf.Fingerprint, e.conf.Match))
+	r.PUT("/songs/:id", upload.NewReplaceHandler(store, e.conf.Fingerprint))
+	r.DELETE("/songs/:id", upload.NewDeleteHandler(store))
+	r.GET("/duplicates", dedup.NewHandler(store, e.conf.Fingerprint, e.conf.Match, e.conf.Dedup))
+	r.GET("/listen", search.NewListenHandler(store, e.conf.Fingerprint, search.DefaultListenConfig(e.conf.Match)))
+
+	if err := r.Run(e.conf.Server.ListenAddr); err != nil {
+		return e.fail(err)
+	}
+	return ExitOK
+}
+
+// limitBody rejects request bodies larger than n bytes.
+func limitBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+func runDelete(e *env, args []string) int {
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		e.flags.Usage()
+		return ExitError
+	}
+	ids := make([]uint, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 0)
+		if err != nil || id == 0 {
+			return e.fail(fmt.Errorf("invalid song ID %q", arg))
+		}
+		ids = append(ids, uint(id))
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	existing, err := store.Songs(ids)
+	if err != nil {
+		return e.fail(err)
+	}
+	deleted := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := existing[id]; !ok {
+			return e.fail(fmt.Errorf("song %d does not exist", id))
+		}
+		if err := store.DeleteSong(id); err != nil {
+			return e.fail(err)
+		}
+		deleted = append(deleted, id)
+		if !e.json() {
+			fmt.Fprintf(e.stdout, "deleted song %d\n", id)
+		}
+	}
+	if e.json() {
+		e.writeJSON(map[string]any{"deleted": deleted})
+	}
+	return ExitOK
+}
+
+func runReplace(e *env, args []string) int {
+	title := e.flags.String("title", "", "new song title (default: keep the current one)")
+	artist := e.flags.String("artist", "", "new song artist (default: keep the current one)")
+	album := e.flags.String("album", "", "new song album (default: keep the current one)")
+	args, code, ok := e.parse(args)
+	if !ok {
+		return code
+	}
+	if len(args) != 2 {
+		e.flags.Usage()
+		return ExitError
+	}
+	id, err := strconv.ParseUint(args[0], 10, 0)
+	if err != nil || id == 0 {
+		return e.fail(fmt.Errorf("invalid song ID %q", args[0]))
+	}
+	songID, path := uint(id), args[1]
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	found, err := store.Songs([]uint{songID})
+	if err != nil {
+		return e.fail(err)
+	}
+	song, ok := found[songID]
+	if !ok {
+		return e.fail(fmt.Errorf("song %d does not exist", songID))
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return e.fail(err)
+	}
+	other, err := store.SongByChecksum(checksum)
+	if err == nil && other.ID != songID {
+		return e.fail(fmt.Errorf("%s is already in the catalog as song %d", path, other.ID))
+	}
+	if err != nil && !errors.Is(err, db.ErrSongNotFound) {
+		return e.fail(err)
+	}
+
+	buf, err := readAudio(path)
+	if err != nil {
+		return e.fail(err)
+	}
+	fingerprints, err := fingerprint.FingerprintAudio(buf, 0, e.conf.Fingerprint)
+	if err != nil {
+		return e.fail(err)
+	}
+	if len(fingerprints) == 0 {
+		return e.fail(fmt.Errorf("%s: audio produced no fingerprints", path))
+	}
+
+	if *title != "" {
+		song.Title = *title
+	}
+	if *artist != "" {
+		song.Artist = *artist
+	}
+	if *album != "" {
+		song.Album = *album
+	}
+	song.Duration = buf.Duration().Seconds()
+	song.SourcePath = path
+	song.ConfigID = e.conf.Fingerprint.ID()
+	song.Checksum = checksum
+	song.SampleRate = e.conf.Fingerprint.SampleRate
+	song.SourceSampleRate = buf.Format.SampleRate
+	song.IngestedAt = time.Time{}
+	if err := store.ReplaceSong(&song, fingerprints); err != nil {
+		return e.fail(err)
+	}
+
+	if e.json() {
+		e.writeJSON(songListing{Song: song, Fingerprints: len(fingerprints)})
+	} else {
+		fmt.Fprintf(e.stdout, "replaced song %d with %s (%d fingerprints)\n", songID, path, len(fingerprints))
+	}
+	return ExitOK
+}
+
+// fileChecksum returns the db.FileChecksum of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return db.FileChecksum(f)
+}
+
+type songListing struct {
+	db.Song
+	Fingerprints int `json:"fingerprints"`
+}
+
+func runList(e *env, args []string) int {
+	if _, code, ok := e.parse(args); !ok {
+		return code
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	songs, err := store.ListSongs()
+	if err != nil {
+		return e.fail(err)
+	}
+	counts, err := store.CountPerSong()
+	if err != nil {
+		return e.fail(err)
+	}
+
+	listing := make([]songListing, len(songs))
+	for i, song := range songs {
+		listing[i] = songListing{Song: song, Fingerprints: counts[song.ID]}
+	}
+	if e.json() {
+		e.writeJSON(listing)
+		return ExitOK
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tARTIST\tALBUM\tDURATION\tFINGERPRINTS\tINGESTED")
+	for _, s := range listing {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", s.ID, s.Title, s.Artist, s.Album,
+			formatDuration(s.Duration), s.Fingerprints, s.IngestedAt.Format(time.RFC3339))
+	}
+	w.Flush()
+	return ExitOK
+}
+
+type catalogStats struct {
+	Songs               int      `json:"songs"`
+	Fingerprints        int      `json:"fingerprints"`
+	TotalDuration       float64  `json:"total_duration_seconds"`
+	FingerprintsPerSong float64  `json:"fingerprints_per_song"`
+	FingerprintsPerSec  float64  `json:"fingerprints_per_second"`
+	ConfigIDs           []string `json:"config_ids"`
+}
+
+func runStats(e *env, args []string) int {
+	if _, code, ok := e.parse(args); !ok {
+		return code
+	}
+
+	store, closeStore, err := e.openStore()
+	if err != nil {
+		return e.fail(err)
+	}
+	defer closeStore()
+
+	songs, err := store.ListSongs()
+	if err != nil {
+		return e.fail(err)
+	}
+	counts, err := store.CountPerSong()
+	if err != nil {
+		return e.fail(err)
+	}
+
+	stats := catalogStats{Songs: len(songs), ConfigIDs: []string{}}
+	seenConfig := map[string]bool{}
+	for _, song := range songs {
+		stats.Fingerprints += counts[song.ID]
+		stats.TotalDuration += song.Duration
+		if !seenConfig[song.ConfigID] {
+			seenConfig[song.ConfigID] = true
+			stats.ConfigIDs = append(stats.ConfigIDs, song.ConfigID)
+		}
+	}
+	if stats.Songs > 0 {
+		stats.FingerprintsPerSong = float64(stats.Fingerprints) / float64(stats.Songs)
+	}
+	if stats.TotalDuration > 0 {
+		stats.FingerprintsPerSec = float64(stats.Fingerprints) / stats.TotalDuration
+	}
+
+	if e.json() {
+		e.writeJSON(stats)
+		return ExitOK
+	}
+	fmt.Fprintf(e.stdout, "songs:                 %d\n", stats.Songs)
+	fmt.Fprintf(e.stdout, "fingerprints:          %d\n", stats.Fingerprints)
+	fmt.Fprintf(e.stdout, "total duration:        %s\n", formatDuration(stats.TotalDuration))
+	fmt.Fprintf(e.stdout, "fingerprints per song: %.1f\n", stats.FingerprintsPerSong)
+	fmt.Fprintf(e.stdout, "fingerprints per sec:  %.1f\n", stats.FingerprintsPerSec)
+	fmt.Fprintf(e.stdout, "config IDs:            %v\n", stats.ConfigIDs)
+	return ExitOK
+}
+
+func formatDuration(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second).String()
+}
@@ -0,0 +1,339 @@
+// Package config loads runtime settings from defaults, an optional YAML or
+// TOML file, and SHAZAM_* environment variables, in increasing precedence.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/dedup"
+	"shazam/internal/fingerprint"
+	"shazam/internal/monitor"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the environment variable holding the config file path
+// used when Load is given an empty path.
+const ConfigFileEnv = "SHAZAM_CONFIG"
+
+type Config struct {
+	Database    DatabaseConfig                `yaml:"database" toml:"database"`
+	Server      ServerConfig                  `yaml:"server" toml:"server"`
+	Fingerprint fingerprint.FingerprintConfig `yaml:"fingerprint" toml:"fingerprint"`
+	Match       search.MatchConfig            `yaml:"match" toml:"match"`
+	Monitor     monitor.Config                `yaml:"monitor" toml:"monitor"`
+	Dedup       dedup.Config                  `yaml:"dedup" toml:"dedup"`
+	// IndexDir selects the embedded on-disk index instead of Postgres when set.
+	IndexDir string `yaml:"index_dir" toml:"index_dir"`
+	// FFmpegPath, if set, is used to decode formats without a built-in
+	// decoder, such as AAC/M4A.
+	FFmpegPath string `yaml:"ffmpeg_path" toml:"ffmpeg_path"`
+}
+
+type DatabaseConfig struct {
+	// URL is a complete DSN. When set, the individual fields are ignored.
+	URL      string `yaml:"url" toml:"url"`
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	Name     string `yaml:"name" toml:"name"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode"`
+	TimeZone string `yaml:"timezone" toml:"timezone"`
+	// AutoMigrate applies pending schema migrations when the store is
+	// opened. When off, a store with pending migrations is refused and
+	// `shazam migrate` must be run first.
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate"`
+	// HashPartitions splits the fingerprints table by hash prefix; see
+	// db.SchemaOptions.
+	HashPartitions int `yaml:"hash_partitions" toml:"hash_partitions"`
+	// BulkLoad is how fingerprints are written: "copy" streams them with
+	// the COPY protocol, "insert" uses batched INSERTs.
+	BulkLoad string `yaml:"bulk_load" toml:"bulk_load"`
+	// InsertBatchSize is the number of fingerprint rows per INSERT, used
+	// when BulkLoad is "insert" and when COPY is unavailable.
+	InsertBatchSize int `yaml:"insert_batch_size" toml:"insert_batch_size"`
+}
+
+type ServerConfig struct {
+	ListenAddr     string   `yaml:"listen_addr" toml:"listen_addr"`
+	CORSOrigins    []string `yaml:"cors_origins" toml:"cors_origins"`
+	MaxUploadBytes int64    `yaml:"max_upload_bytes" toml:"max_upload_bytes"`
+}
+
+// Default returns the settings used for anything not configured explicitly.
+func Default() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            5432,
+			User:            "postgres",
+			Name:            "shazam",
+			SSLMode:         "disable",
+			TimeZone:        "UTC",
+			AutoMigrate:     true,
+			BulkLoad:        db.LoadCopy,
+			InsertBatchSize: db.DefaultBatchSize,
+		},
+		Server: ServerConfig{
+			ListenAddr:     ":8081",
+			CORSOrigins:    []string{"*"},
+			MaxUploadBytes: 32 << 20,
+		},
+		Fingerprint: fingerprint.DefaultConfig(),
+		Match:       search.DefaultMatchConfig(),
+		Monitor:     monitor.DefaultConfig(),
+		Dedup:       dedup.DefaultConfig(),
+	}
+}
+
+// Load builds a Config from the defaults, the file at path (or at
+// $SHAZAM_CONFIG when path is empty; no file is read when both are empty),
+// and the environment, then validates it.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv(ConfigFileEnv)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("config file %s: unsupported extension, want .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides fields from SHAZAM_* variables. lookup is os.LookupEnv
+// outside of tests.
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	int64Var := func(name string, dst *int64) {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v, ok := lookup(name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = f
+		}
+	}
+
+	str("SHAZAM_DATABASE_URL", &c.Database.URL)
+	str("SHAZAM_DB_HOST", &c.Database.Host)
+	integer("SHAZAM_DB_PORT", &c.Database.Port)
+	str("SHAZAM_DB_USER", &c.Database.User)
+	str("SHAZAM_DB_PASSWORD", &c.Database.Password)
+	str("SHAZAM_DB_NAME", &c.Database.Name)
+	str("SHAZAM_DB_SSLMODE", &c.Database.SSLMode)
+	str("SHAZAM_DB_TIMEZONE", &c.Database.TimeZone)
+	boolean("SHAZAM_DB_AUTO_MIGRATE", &c.Database.AutoMigrate)
+	integer("SHAZAM_DB_HASH_PARTITIONS", &c.Database.HashPartitions)
+	str("SHAZAM_DB_BULK_LOAD", &c.Database.BulkLoad)
+	integer("SHAZAM_DB_INSERT_BATCH_SIZE", &c.Database.InsertBatchSize)
+
+	str("SHAZAM_LISTEN_ADDR", &c.Server.ListenAddr)
+	if v, ok := lookup("SHAZAM_CORS_ORIGINS"); ok {
+		c.Server.CORSOrigins = splitList(v)
+	}
+	int64Var("SHAZAM_MAX_UPLOAD_BYTES", &c.Server.MaxUploadBytes)
+
+	str("SHAZAM_INDEX_DIR", &c.IndexDir)
+	str("SHAZAM_FFMPEG_PATH", &c.FFmpegPath)
+
+	fp := &c.Fingerprint
+	integer("SHAZAM_FP_SAMPLE_RATE", &fp.SampleRate)
+	integer("SHAZAM_FP_WINDOW_SIZE", &fp.WindowSize)
+	integer("SHAZAM_FP_HOP_SIZE", &fp.HopSize)
+	float("SHAZAM_FP_LOWPASS_CUTOFF", &fp.LowpassCutoff)
+	integer("SHAZAM_FP_PEAK_NEIGHBORHOOD_SIZE", &fp.PeakNeighborhoodSize)
+	integer("SHAZAM_FP_PEAK_TARGET_DENSITY", &fp.PeakTargetDensity)
+	float("SHAZAM_FP_SECONDS_PER_CHUNK", &fp.SecondsPerChunk)
+	integer("SHAZAM_FP_FAN_OUT", &fp.FanOut)
+	float("SHAZAM_FP_DELTA_T_MIN", &fp.DeltaTMin)
+	float("SHAZAM_FP_DELTA_T_MAX", &fp.DeltaTMax)
+	str("SHAZAM_FP_HASH_MODE", &fp.HashMode)
+
+	integer("SHAZAM_MATCH_MAX_CANDIDATES", &c.Match.MaxCandidates)
+	integer("SHAZAM_MATCH_MIN_CANDIDATE_HITS", &c.Match.MinCandidateHits)
+	integer("SHAZAM_MATCH_MIN_MATCH_COUNT", &c.Match.MinMatchCount)
+	float("SHAZAM_MATCH_MIN_CONFIDENCE", &c.Match.MinConfidence)
+	integer("SHAZAM_MATCH_TOP_N", &c.Match.TopN)
+	float("SHAZAM_MATCH_MAX_SPEED_CHANGE", &c.Match.MaxSpeedChange)
+	integer("SHAZAM_MATCH_OFFSET_BIN_MS", &c.Match.OffsetBinMs)
+
+	float("SHAZAM_MONITOR_WINDOW_SECONDS", &c.Monitor.WindowSeconds)
+	float("SHAZAM_MONITOR_HOP_SECONDS", &c.Monitor.HopSeconds)
+	float("SHAZAM_MONITOR_MAX_GAP_SECONDS", &c.Monitor.MaxGapSeconds)
+	float("SHAZAM_MONITOR_OFFSET_TOLERANCE_SECONDS", &c.Monitor.OffsetToleranceSeconds)
+	integer("SHAZAM_MONITOR_MIN_WINDOWS", &c.Monitor.MinWindows)
+
+	float("SHAZAM_DEDUP_MIN_OVERLAP", &c.Dedup.MinOverlap)
+	float("SHAZAM_DEDUP_MIN_SIGNIFICANCE", &c.Dedup.MinSignificance)
+	integer("SHAZAM_DEDUP_BATCH_HASHES", &c.Dedup.BatchHashes)
+
+	return errors.Join(errs...)
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.IndexDir == "" && c.Database.URL == "" {
+		if c.Database.Host == "" {
+			errs = append(errs, errors.New("database.host is required"))
+		}
+		if c.Database.Port <= 0 || c.Database.Port > 65535 {
+			errs = append(errs, fmt.Errorf("database.port %d is out of range", c.Database.Port))
+		}
+		if c.Database.User == "" {
+			errs = append(errs, errors.New("database.user is required"))
+		}
+		if c.Database.Name == "" {
+			errs = append(errs, errors.New("database.name is required"))
+		}
+	}
+	if err := (db.SchemaOptions{HashPartitions: c.Database.HashPartitions}).Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("database: %w", err))
+	}
+	if c.Database.BulkLoad != db.LoadCopy && c.Database.BulkLoad != db.LoadInsert {
+		errs = append(errs, fmt.Errorf("database.bulk_load must be %q or %q, got %q", db.LoadCopy, db.LoadInsert, c.Database.BulkLoad))
+	}
+	if c.Database.InsertBatchSize < 1 || c.Database.InsertBatchSize > db.MaxBatchSize {
+		errs = append(errs, fmt.Errorf("database.insert_batch_size must be between 1 and %d, got %d", db.MaxBatchSize, c.Database.InsertBatchSize))
+	}
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("server.listen_addr: %w", err))
+	}
+	if len(c.Server.CORSOrigins) == 0 {
+		errs = append(errs, errors.New("server.cors_origins must list at least one origin"))
+	}
+	if c.Server.MaxUploadBytes <= 0 {
+		errs = append(errs, fmt.Errorf("server.max_upload_bytes must be positive, got %d", c.Server.MaxUploadBytes))
+	}
+	if err := c.Fingerprint.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("fingerprint: %w", err))
+	}
+	if err := c.Match.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("match: %w", err))
+	}
+	if err := c.Monitor.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("monitor: %w", err))
+	}
+	if err := c.Dedup.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("dedup: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// DSN returns the Postgres connection string for the database settings.
+func (d DatabaseConfig) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	parts := []string{
+		"host=" + quoteDSN(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"user=" + quoteDSN(d.User),
+		"dbname=" + quoteDSN(d.Name),
+	}
+	if d.Password != "" {
+		parts = append(parts, "password="+quoteDSN(d.Password))
+	}
+	if d.SSLMode != "" {
+		parts = append(parts, "sslmode="+quoteDSN(d.SSLMode))
+	}
+	if d.TimeZone != "" {
+		parts = append(parts, "TimeZone="+quoteDSN(d.TimeZone))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteDSN quotes a keyword/value DSN value when it contains characters that
+// would otherwise end it.
+func quoteDSN(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// clearEnv unsets every SHAZAM_* variable for the duration of the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "SHAZAM_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Both files set the same values.
+const yamlConfig = `
+database:
+  host: db.internal
+  port: 6543
+  name: catalog
+server:
+  listen_addr: "127.0.0.1:9000"
+  cors_origins: ["https://a.example"]
+fingerprint:
+  fan_out: 6
+monitor:
+  min_windows: 3
+`
+
+const tomlConfig = `
+[database]
+host = "db.internal"
+port = 6543
+name = "catalog"
+
+[server]
+listen_addr = "127.0.0.1:9000"
+cors_origins = ["https://a.example"]
+
+[fingerprint]
+fan_out = 6
+
+[monitor]
+min_windows = 3
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	for _, file := range []struct{ name, content string }{
+		{"config.yaml", yamlConfig},
+		{"config.yml", yamlConfig},
+		{"config.toml", tomlConfig},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			clearEnv(t)
+			path := writeFile(t, file.name, file.content)
+			t.Setenv("SHAZAM_DB_PORT", "7000")
+			t.Setenv("SHAZAM_CORS_ORIGINS", " https://b.example , https://c.example,")
+			t.Setenv("SHAZAM_MONITOR_MIN_WINDOWS", "4")
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Default()
+			// From the file.
+			want.Database.Host = "db.internal"
+			want.Database.Name = "catalog"
+			want.Server.ListenAddr = "127.0.0.1:9000"
+			want.Fingerprint.FanOut = 6
+			// From the environment, over the file.
+			want.Database.Port = 7000
+			want.Server.CORSOrigins = []string{"https://b.example", "https://c.example"}
+			want.Monitor.MinWindows = 4
+			if !reflect.DeepEqual(*cfg, want) {
+				t.Errorf("loaded\n%+v\nwant\n%+v", *cfg, want)
+			}
+		})
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	clearEnv(t)
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, Default()) {
+		t.Errorf("loaded %+v without a file or environment, want the defaults", *cfg)
+	}
+}
+
+func TestLoadConfigFileEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv(ConfigFileEnv, writeFile(t, "config.yaml", yamlConfig))
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Host != "db.internal" {
+		t.Errorf("database host %q, want the one from $%s", cfg.Database.Host, ConfigFileEnv)
+	}
+
+	// An explicit path wins over the variable.
+	cfg, err = Load(writeFile(t, "other.yaml", "database:\n  host: other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Host != "other" {
+		t.Errorf("database host %q, want the one from the explicit path", cfg.Database.Host)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	clearEnv(t)
+	cfg, err := Load(filepath.Join("..", "..", "config.example.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, Default()) {
+		t.Errorf("config.example.yaml loads as\n%+v\nwhich differs from the defaults\n%+v", *cfg, Default())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string // config file name; none if empty, a missing one if "-"
+		content string
+		env     map[string]string
+		want    []string // substrings of the error
+	}{
+		{name: "missing file", file: "-", want: []string{"reading config file"}},
+		{name: "unknown extension", file: "config.json", content: "{}", want: []string{"unsupported extension"}},
+		{name: "bad yaml", file: "config.yaml", content: "database: [", want: []string{"parsing config file"}},
+		{name: "bad toml", file: "config.toml", content: "[database", want: []string{"parsing config file"}},
+		{
+			name: "bad environment values",
+			env:  map[string]string{"SHAZAM_DB_PORT": "high", "SHAZAM_DB_AUTO_MIGRATE": "perhaps", "SHAZAM_FP_DELTA_T_MAX": "x"},
+			want: []string{"SHAZAM_DB_PORT", "SHAZAM_DB_AUTO_MIGRATE", "SHAZAM_FP_DELTA_T_MAX"},
+		},
+		{
+			name: "invalid settings",
+			file: "config.yaml",
+			content: `
+database:
+  port: 0
+  bulk_load: stream
+server:
+  listen_addr: nowhere
+fingerprint:
+  window_size: 1000
+`,
+			want: []string{"database.port", "database.bulk_load", "server.listen_addr", "fingerprint: window size"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			switch c.file {
+			case "":
+			case "-":
+				path = filepath.Join(t.TempDir(), "missing.yaml")
+			default:
+				path = writeFile(t, c.file, c.content)
+			}
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("loaded without error")
+			}
+			for _, want := range c.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateIndexDirNeedsNoDatabase(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.Name = "", 0, "", ""
+	if err := cfg.Validate(); err == nil {
+		t.Error("config without database settings or an index dir accepted")
+	}
+	cfg.IndexDir = "index"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("config with an index dir: %v", err)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	d := Default().Database
+	if got, want := d.DSN(), "host=localhost port=5432 user=postgres dbname=shazam sslmode=disable TimeZone=UTC"; got != want {
+		t.Errorf("default DSN %q, want %q", got, want)
+	}
+	d.Password = `it's a \secret`
+	d.Name = ""
+	if got, want := d.DSN(), `host=localhost port=5432 user=postgres dbname='' password='it\'s a \\secret' sslmode=disable TimeZone=UTC`; got != want {
+		t.Errorf("DSN %q, want %q", got, want)
+	}
+	d.URL = "postgres://u@h/db"
+	if got := d.DSN(); got != d.URL {
+		t.Errorf("DSN %q, want the URL %q", got, d.URL)
+	}
+}
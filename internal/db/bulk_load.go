@@ -0,0 +1,182 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+// Load methods for GormStore.LoadMethod.
+const (
+	// LoadCopy streams fingerprints with the COPY protocol.
+	LoadCopy = "copy"
+	// LoadInsert writes them as multi-row INSERTs of BatchSize rows.
+	LoadInsert = "insert"
+)
+
+// LoadStat sums up the fingerprint rows written with one load method.
+type LoadStat struct {
+	Method   string        `json:"method"`
+	Rows     int64         `json:"rows"`
+	Writes   int           `json:"writes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RowsPerSecond is the write throughput, counting only time spent writing.
+func (s LoadStat) RowsPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Rows) / s.Duration.Seconds()
+}
+
+// LoadReporter is implemented by stores that measure their fingerprint
+// writes.
+type LoadReporter interface {
+	// LoadStats returns the totals per load method used so far.
+	LoadStats() []LoadStat
+}
+
+// errCopyUnsupported means the connection does not go through pgx.
+var errCopyUnsupported = errors.New("COPY needs a pgx connection")
+
+// fingerprintColumns are the columns COPY fills, with the types migration 2
+// gives them; id takes its default. COPY sends binary values, so copyRow
+// must produce each as the Go type pgx encodes that column type from, and
+// the three have to change together.
+var fingerprintColumns = []struct{ name, sqlType string }{
+	{"hash", "integer"},
+	{"song_id", "bigint"},
+	{"anchor_time", "real"},
+	{"anchor_freq", "real"},
+	{"target_freq", "real"},
+	{"time_delta", "real"},
+}
+
+// copyRow returns the values of fp for fingerprintColumns.
+func copyRow(fp *Fingerprint) []any {
+	return []any{fp.Hash, int64(fp.SongID), float32(fp.AnchorTime),
+		float32(fp.AnchorFreq), float32(fp.TargetFreq), float32(fp.TimeDelta)}
+}
+
+// useCopy reports whether fingerprints are written with COPY.
+func (s *GormStore) useCopy() bool {
+	return s.LoadMethod != LoadInsert && !s.copyUnsupported.Load()
+}
+
+// transaction runs fn in a transaction. For COPY it runs on one pinned
+// connection with an explicit BEGIN rather than a database/sql transaction,
+// as COPY has to be issued on the transaction's own connection.
+func (s *GormStore) transaction(fn func(tx *gorm.DB) error) error {
+	if !s.useCopy() {
+		return s.DB.Transaction(fn)
+	}
+	return s.DB.Connection(func(conn *gorm.DB) error {
+		tx := conn.Session(&gorm.Session{SkipDefaultTransaction: true})
+		if err := tx.Exec("BEGIN").Error; err != nil {
+			return err
+		}
+		committed := false
+		defer func() {
+			if !committed {
+				tx.Exec("ROLLBACK")
+			}
+		}()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.Exec("COMMIT").Error; err != nil {
+			return err
+		}
+		committed = true
+		return nil
+	})
+}
+
+// writeFingerprints stores fingerprints through tx, with COPY when tx is
+// pinned to a pgx connection and batched INSERTs otherwise. tx must be a
+// transaction so a failed batch leaves no rows behind.
+func (s *GormStore) writeFingerprints(tx *gorm.DB, fingerprints []Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	start := time.Now()
+	if s.useCopy() {
+		err := copyFingerprints(tx, fingerprints)
+		if err == nil {
+			s.record(LoadCopy, len(fingerprints), time.Since(start))
+			return nil
+		}
+		if !errors.Is(err, errCopyUnsupported) {
+			return err
+		}
+		// Nothing was written; fall back for good.
+		if s.copyUnsupported.CompareAndSwap(false, true) {
+			log.Printf("bulk load: %v; falling back to batched inserts", err)
+		}
+		start = time.Now()
+	}
+	if err := tx.CreateInBatches(&fingerprints, s.BatchSize).Error; err != nil {
+		return err
+	}
+	s.record(LoadInsert, len(fingerprints), time.Since(start))
+	return nil
+}
+
+// copyFingerprints streams fingerprints into the fingerprints table with
+// COPY on the connection tx is pinned to.
+func copyFingerprints(tx *gorm.DB, fingerprints []Fingerprint) error {
+	conn, ok := tx.Statement.ConnPool.(*sql.Conn)
+	if !ok {
+		return fmt.Errorf("%w: not on a pinned connection", errCopyUnsupported)
+	}
+	return conn.Raw(func(driverConn any) error {
+		pc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("%w: driver connection is %T", errCopyUnsupported, driverConn)
+		}
+		rows := pgx.CopyFromSlice(len(fingerprints), func(i int) ([]any, error) {
+			return copyRow(&fingerprints[i]), nil
+		})
+		columns := make([]string, len(fingerprintColumns))
+		for i, c := range fingerprintColumns {
+			columns[i] = c.name
+		}
+		_, err := pc.Conn().CopyFrom(tx.Statement.Context, pgx.Identifier{"fingerprints"}, columns, rows)
+		return err
+	})
+}
+
+func (s *GormStore) record(method string, rows int, d time.Duration) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[string]*LoadStat)
+	}
+	stat := s.stats[method]
+	if stat == nil {
+		stat = &LoadStat{Method: method}
+		s.stats[method] = stat
+	}
+	stat.Rows += int64(rows)
+	stat.Writes++
+	stat.Duration += d
+}
+
+func (s *GormStore) LoadStats() []LoadStat {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	var stats []LoadStat
+	for _, method := range []string{LoadCopy, LoadInsert} {
+		if stat := s.stats[method]; stat != nil {
+			stats = append(stats, *stat)
+		}
+	}
+	return stats
+}
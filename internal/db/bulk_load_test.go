@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// copyTypes are the Go types pgx encodes each column type from in COPY's
+// binary format.
+var copyTypes = map[string]reflect.Type{
+	"integer": reflect.TypeOf(int32(0)),
+	"bigint":  reflect.TypeOf(int64(0)),
+	"real":    reflect.TypeOf(float32(0)),
+}
+
+func TestCopyRowMatchesColumnTypes(t *testing.T) {
+	fp := Fingerprint{Hash: -7, SongID: 1<<32 + 5, AnchorTime: 1.5, AnchorFreq: 440, TargetFreq: 880, TimeDelta: 0.25}
+	row := copyRow(&fp)
+	if len(row) != len(fingerprintColumns) {
+		t.Fatalf("copyRow returns %d values for %d columns", len(row), len(fingerprintColumns))
+	}
+	for i, c := range fingerprintColumns {
+		want, ok := copyTypes[c.sqlType]
+		if !ok {
+			t.Errorf("column %s has type %s, which COPY has no encoding for here", c.name, c.sqlType)
+			continue
+		}
+		if got := reflect.TypeOf(row[i]); got != want {
+			t.Errorf("column %s (%s) is sent as %v, want %v", c.name, c.sqlType, got, want)
+		}
+	}
+	want := []any{int32(-7), int64(1<<32 + 5), float32(1.5), float32(440), float32(880), float32(0.25)}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("copyRow = %v, want %v", row, want)
+	}
+}
+
+// txLogDriver is a database/sql driver that records the statements run on
+// it, including transaction boundaries, and fails any statement binding
+// the hash failHash.
+type txLogDriver struct {
+	mu  sync.Mutex
+	log []string
+}
+
+const failHash = math.MinInt32
+
+var txLog = &txLogDriver{}
+
+func init() {
+	sql.Register("txlog", txLog)
+}
+
+func (d *txLogDriver) Open(string) (driver.Conn, error) { return txLogConn{d}, nil }
+
+func (d *txLogDriver) record(stmt string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, stmt)
+}
+
+func (d *txLogDriver) reset() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log := d.log
+	d.log = nil
+	return log
+}
+
+type txLogConn struct{ d *txLogDriver }
+
+func (c txLogConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("txlog: prepared statements are not supported")
+}
+func (c txLogConn) Close() error { return nil }
+func (c txLogConn) Begin() (driver.Tx, error) {
+	c.d.record("BEGIN")
+	return txLogTx{c.d}, nil
+}
+
+func (c txLogConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	for _, arg := range args {
+		if v, ok := arg.Value.(int64); ok && v == failHash {
+			c.d.record("FAILED " + query)
+			return nil, errors.New("txlog: statement failed")
+		}
+	}
+	c.d.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c txLogConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(query)
+	return noRows{}, nil
+}
+
+type txLogTx struct{ d *txLogDriver }
+
+func (tx txLogTx) Commit() error   { tx.d.record("COMMIT"); return nil }
+func (tx txLogTx) Rollback() error { tx.d.record("ROLLBACK"); return nil }
+
+// checkTransaction checks that log is one transaction that ends in outcome,
+// COMMIT or ROLLBACK, and runs inserts INSERT statements.
+func checkTransaction(t *testing.T, name string, log []string, outcome string, inserts int) {
+	t.Helper()
+	if len(log) < 2 || log[0] != "BEGIN" || log[len(log)-1] != outcome {
+		t.Errorf("%s ran %q, want one transaction ending in %s", name, log, outcome)
+		return
+	}
+	n := 0
+	for _, stmt := range log[1 : len(log)-1] {
+		if stmt == "BEGIN" || stmt == "COMMIT" {
+			t.Errorf("%s ran %q, want a single transaction", name, log)
+		}
+		if strings.HasPrefix(stmt, "INSERT") || strings.HasPrefix(stmt, "FAILED INSERT") {
+			n++
+		}
+	}
+	if n != inserts {
+		t.Errorf("%s ran %d inserts in %q, want %d", name, n, log, inserts)
+	}
+}
+
+func TestInsertBatchFallback(t *testing.T) {
+	// Without gorm's implicit transactions, only the store's own keep a
+	// batch atomic.
+	DB, err := gorm.Open(postgres.New(postgres.Config{DriverName: "txlog"}), &gorm.Config{
+		Logger:                 logger.Default.LogMode(logger.Silent),
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(DB)
+	store.BatchSize = 2
+	fps := []Fingerprint{{Hash: 1, SongID: 1}, {Hash: 2, SongID: 1}, {Hash: 3, SongID: 1}}
+
+	// COPY needs pgx; the first write finds out, switches to inserts for
+	// good and writes the batch in the same transaction.
+	txLog.reset()
+	if err := store.InsertBatch(fps); err != nil {
+		t.Fatal(err)
+	}
+	checkTransaction(t, "first batch", txLog.reset(), "COMMIT", 2)
+	if store.useCopy() {
+		t.Error("store still uses COPY after it failed for want of pgx")
+	}
+	if err := store.InsertBatch(fps); err != nil {
+		t.Fatal(err)
+	}
+	checkTransaction(t, "second batch", txLog.reset(), "COMMIT", 2)
+	stats := store.LoadStats()
+	if len(stats) != 1 || stats[0].Method != LoadInsert || stats[0].Rows != 6 || stats[0].Writes != 2 {
+		t.Errorf("load stats %+v, want 6 rows in 2 insert writes", stats)
+	}
+
+	// A failing insert rolls back the ones before it.
+	bad := append(fps, Fingerprint{Hash: failHash, SongID: 1})
+	if err := store.InsertBatch(bad); err == nil {
+		t.Fatal("batch with a failing insert succeeded")
+	}
+	checkTransaction(t, "failing batch", txLog.reset(), "ROLLBACK", 2)
+}
@@ -0,0 +1,11 @@
+package db
+
+// CopyColumnTypes returns the columns COPY fills with the type it expects
+// each to have in the migrated schema.
+func CopyColumnTypes() map[string]string {
+	types := make(map[string]string, len(fingerprintColumns))
+	for _, c := range fingerprintColumns {
+		types[c.name] = c.sqlType
+	}
+	return types
+}
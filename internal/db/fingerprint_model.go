@@ -1,7 +1,9 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"log"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -13,22 +15,24 @@ type Fingerprint struct {
 	TargetFreq float64
 	TimeDelta  float64
 	AnchorTime float64
-	Hash       string `json:"hash"`
-	SongID     string
+	Hash       int32 `json:"hash"`
+	SongID     uint
 }
 
 var DB *gorm.DB
 
-var dsn = "host=localhost user=postgres password=8759 dbname=achiket port=5432 sslmode=disable TimeZone=Asia/Shanghai"
-
-func EstablishConn() *gorm.DB {
+// EstablishConn opens a Postgres connection for dsn and stores it in DB.
+func EstablishConn(dsn string) (*gorm.DB, error) {
+	if dsn == "" {
+		return nil, errors.New("database DSN is empty")
+	}
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("connecting to database: %w", err)
 	}
-	fmt.Println("connected to database")
+	log.Println("connected to database")
 	DB = db
-	return db
+	return db, nil
 }
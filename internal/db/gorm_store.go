@@ -0,0 +1,303 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultBatchSize is the number of rows written per INSERT by GormStore.
+const DefaultBatchSize = 4000
+
+// MaxBatchSize is the most fingerprint rows one INSERT can carry: each binds
+// a parameter per column, and a statement takes at most MAX_QUERY_PARAMS.
+const MaxBatchSize = MAX_QUERY_PARAMS / 6
+
+const (
+	// MAX_QUERY_PARAMS is the most parameters Postgres accepts in one
+	// statement.
+	MAX_QUERY_PARAMS = 65535
+	// MAX_QUERY_HASHES bounds the hashes bound to one statement. Longer
+	// lists are queried in chunks, leaving room for the song IDs bound next
+	// to them.
+	MAX_QUERY_HASHES = 32768
+)
+
+// GormStore is a FingerprintStore backed by the songs and fingerprints tables
+// of a GORM connection.
+type GormStore struct {
+	DB        *gorm.DB
+	BatchSize int
+	// LoadMethod is how fingerprints are written: LoadCopy, the default,
+	// or LoadInsert. COPY falls back to inserts on a non-pgx driver.
+	LoadMethod string
+
+	copyUnsupported atomic.Bool
+	statsMu         sync.Mutex
+	stats           map[string]*LoadStat
+}
+
+// NewGormStore returns a store using DB with the default batch size and
+// load method.
+func NewGormStore(DB *gorm.DB) *GormStore {
+	return &GormStore{DB: DB, BatchSize: DefaultBatchSize, LoadMethod: LoadCopy}
+}
+
+func (s *GormStore) CreateSong(song *Song) error {
+	return s.DB.Omit("Fingerprints").Create(song).Error
+}
+
+func (s *GormStore) AddSong(song *Song, fingerprints []Fingerprint) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Fingerprints").Create(song).Error; err != nil {
+			return err
+		}
+		if len(fingerprints) == 0 {
+			return nil
+		}
+		for i := range fingerprints {
+			fingerprints[i].SongID = song.ID
+		}
+		return s.writeFingerprints(tx, fingerprints)
+	})
+}
+
+func (s *GormStore) Songs(songIDs []uint) (map[uint]Song, error) {
+	var rows []Song
+	if len(songIDs) > 0 {
+		if err := s.DB.Where("id IN ?", songIDs).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	songs := make(map[uint]Song, len(rows))
+	for _, song := range rows {
+		songs[song.ID] = song
+	}
+	return songs, nil
+}
+
+func (s *GormStore) AddPlay(play *Play) error {
+	return s.DB.Create(play).Error
+}
+
+func (s *GormStore) ListPlays(source string) ([]Play, error) {
+	var plays []Play
+	query := s.DB.Order("source, stream_start, id")
+	if source != "" {
+		query = query.Where("source = ?", source)
+	}
+	err := query.Find(&plays).Error
+	return plays, err
+}
+
+func (s *GormStore) ListSongs() ([]Song, error) {
+	var songs []Song
+	err := s.DB.Order("id").Find(&songs).Error
+	return songs, err
+}
+
+func (s *GormStore) DeleteSong(songID uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("song_id = ?", songID).Delete(&Fingerprint{}).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&Song{}, songID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSongNotFound
+		}
+		return nil
+	})
+}
+
+func (s *GormStore) ReplaceSong(song *Song, fingerprints []Fingerprint) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		// Lock the row so concurrent replacements of one song are applied
+		// one after the other.
+		var existing Song
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&existing, song.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSongNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("song_id = ?", song.ID).Delete(&Fingerprint{}).Error; err != nil {
+			return err
+		}
+		if song.IngestedAt.IsZero() {
+			song.IngestedAt = time.Now()
+		}
+		if err := tx.Omit("Fingerprints").Save(song).Error; err != nil {
+			return err
+		}
+		if len(fingerprints) == 0 {
+			return nil
+		}
+		for i := range fingerprints {
+			fingerprints[i].SongID = song.ID
+		}
+		return s.writeFingerprints(tx, fingerprints)
+	})
+}
+
+func (s *GormStore) SongByChecksum(checksum string) (Song, error) {
+	var song Song
+	err := s.DB.Where("checksum = ?", checksum).Order("id").First(&song).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Song{}, ErrSongNotFound
+	}
+	return song, err
+}
+
+func (s *GormStore) InsertBatch(fingerprints []Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	// A single COPY is atomic by itself, but the batched inserts it may
+	// fall back to are not.
+	return s.transaction(func(tx *gorm.DB) error {
+		return s.writeFingerprints(tx, fingerprints)
+	})
+}
+
+func (s *GormStore) LookupHashes(hashes []int32) ([]Fingerprint, error) {
+	var fingerprints []Fingerprint
+	err := inChunks(uniqueHashes(hashes), MAX_QUERY_HASHES, func(chunk []int32) error {
+		var found []Fingerprint
+		if err := s.DB.Where("hash IN ?", chunk).Find(&found).Error; err != nil {
+			return err
+		}
+		fingerprints = append(fingerprints, found...)
+		return nil
+	})
+	return fingerprints, err
+}
+
+func (s *GormStore) LookupHashesForSongs(hashes []int32, songIDs []uint) ([]Fingerprint, error) {
+	var fingerprints []Fingerprint
+	if len(songIDs) == 0 {
+		return fingerprints, nil
+	}
+	// Chunks are queried separately, so a repeated hash must not be split
+	// across two of them.
+	hashes = uniqueHashes(hashes)
+	err := inChunks(songIDs, MAX_QUERY_PARAMS-MAX_QUERY_HASHES, func(songChunk []uint) error {
+		return inChunks(hashes, MAX_QUERY_HASHES, func(chunk []int32) error {
+			var found []Fingerprint
+			if err := s.DB.Where("hash IN ? AND song_id IN ?", chunk, songChunk).Find(&found).Error; err != nil {
+				return err
+			}
+			fingerprints = append(fingerprints, found...)
+			return nil
+		})
+	})
+	return fingerprints, err
+}
+
+type songCount struct {
+	SongID uint
+	Count  int
+}
+
+type hashSongCount struct {
+	Hash   int32
+	SongID uint
+	Count  int
+}
+
+func (s *GormStore) HitsPerSong(hashes []int32) (map[uint]int, error) {
+	hits := make(map[uint]int)
+	err := inChunks(uniqueHashes(hashes), MAX_QUERY_HASHES, func(chunk []int32) error {
+		counts, err := s.countPerSong(s.DB.Table("fingerprints").Where("hash IN ?", chunk))
+		for songID, n := range counts {
+			hits[songID] += n
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (s *GormStore) HitsPerHash(hashes []int32) (map[int32]map[uint]int, error) {
+	hits := make(map[int32]map[uint]int)
+	err := inChunks(uniqueHashes(hashes), MAX_QUERY_HASHES, func(chunk []int32) error {
+		var rows []hashSongCount
+		err := s.DB.Table("fingerprints").
+			Select("hash, song_id, COUNT(*) as count").
+			Where("hash IN ?", chunk).
+			Group("hash, song_id").
+			Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if hits[row.Hash] == nil {
+				hits[row.Hash] = make(map[uint]int)
+			}
+			hits[row.Hash][row.SongID] = row.Count
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (s *GormStore) CountPerSong() (map[uint]int, error) {
+	return s.countPerSong(s.DB.Table("fingerprints"))
+}
+
+func (s *GormStore) SongFingerprints(songIDs []uint) (map[uint][]Fingerprint, error) {
+	found := make(map[uint][]Fingerprint)
+	if len(songIDs) == 0 {
+		return found, nil
+	}
+	var fingerprints []Fingerprint
+	err := s.DB.Where("song_id IN ?", songIDs).Order("song_id, anchor_time, hash").Find(&fingerprints).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range fingerprints {
+		found[fp.SongID] = append(found[fp.SongID], fp)
+	}
+	return found, nil
+}
+
+// inChunks calls fn for consecutive chunks of at most size items, stopping
+// at the first error. It does not call fn for an empty list.
+func inChunks[T any](items []T, size int, fn func(chunk []T) error) error {
+	for len(items) > 0 {
+		chunk := items[:min(len(items), size)]
+		items = items[len(chunk):]
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GormStore) countPerSong(query *gorm.DB) (map[uint]int, error) {
+	var rows []songCount
+	err := query.
+		Select("song_id, COUNT(*) as count").
+		Group("song_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		counts[row.SongID] = row.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// paramLimitDriver is a database/sql driver that, like pgx, rejects
+// statements with more than MAX_QUERY_PARAMS parameters. It records the
+// arguments of every query and answers each with no rows.
+type paramLimitDriver struct {
+	mu      sync.Mutex
+	queries [][]driver.NamedValue
+}
+
+var limitDriver = &paramLimitDriver{}
+
+func init() {
+	sql.Register("paramlimit", limitDriver)
+}
+
+func (d *paramLimitDriver) Open(string) (driver.Conn, error) { return limitConn{d}, nil }
+
+func (d *paramLimitDriver) reset() [][]driver.NamedValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queries := d.queries
+	d.queries = nil
+	return queries
+}
+
+type limitConn struct{ d *paramLimitDriver }
+
+func (c limitConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("paramlimit: prepared statements are not supported")
+}
+func (c limitConn) Close() error              { return nil }
+func (c limitConn) Begin() (driver.Tx, error) { return nil, errors.New("paramlimit: no transactions") }
+
+func (c limitConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > MAX_QUERY_PARAMS {
+		return nil, errors.New("extended protocol limited to 65535 parameters")
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.queries = append(c.d.queries, args)
+	return noRows{}, nil
+}
+
+type noRows struct{}
+
+func (noRows) Columns() []string         { return nil }
+func (noRows) Close() error              { return nil }
+func (noRows) Next([]driver.Value) error { return io.EOF }
+
+func TestGormStoreChunksLongHashLists(t *testing.T) {
+	DB, err := gorm.Open(postgres.New(postgres.Config{DriverName: "paramlimit"}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(DB)
+
+	// Hashes start above every song ID so the two can be told apart among
+	// the bound arguments. Some hashes are repeated, as in a batch of
+	// clips of one song.
+	const firstHash = 1 << 20
+	const distinct = 2*MAX_QUERY_PARAMS + 1234
+	var hashes []int32
+	for i := range distinct {
+		hashes = append(hashes, int32(firstHash+i))
+		if i%10 == 0 {
+			hashes = append(hashes, int32(firstHash+i))
+		}
+	}
+	songIDs := []uint{1, 2, 3}
+
+	queries := map[string]func() error{
+		"LookupHashes": func() error {
+			_, err := store.LookupHashes(hashes)
+			return err
+		},
+		"LookupHashesForSongs": func() error {
+			_, err := store.LookupHashesForSongs(hashes, songIDs)
+			return err
+		},
+		"HitsPerSong": func() error {
+			_, err := store.HitsPerSong(hashes)
+			return err
+		},
+		"HitsPerHash": func() error {
+			_, err := store.HitsPerHash(hashes)
+			return err
+		},
+	}
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			limitDriver.reset()
+			if err := query(); err != nil {
+				t.Fatal(err)
+			}
+			statements := limitDriver.reset()
+			if len(statements) < 2 {
+				t.Fatalf("%d hashes sent in %d statements, want them chunked", len(hashes), len(statements))
+			}
+			bound := make(map[int64]int)
+			for _, args := range statements {
+				for _, arg := range args {
+					if v, ok := arg.Value.(int64); ok && v >= firstHash {
+						bound[v]++
+					}
+				}
+			}
+			if len(bound) != distinct {
+				t.Errorf("%d distinct hashes bound, want %d", len(bound), distinct)
+			}
+			for hash, n := range bound {
+				if n != 1 {
+					t.Fatalf("hash %d bound %d times, want once", hash, n)
+				}
+			}
+		})
+	}
+}
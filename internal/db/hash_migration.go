@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// HashLayout describes how fingerprint hashes are packed into an integer, so
+// existing rows can be rehashed from their stored frequencies and time deltas.
+type HashLayout struct {
+	BinHz           float64 // width of one frequency bin in Hz
+	FramesPerSecond float64 // spectrogram frames per second
+	FreqBits        int     // bits per frequency bin field
+	DeltaBits       int     // bits for the delta time field
+}
+
+// MigrateHexHashes converts a fingerprints table that still stores 40-character
+// hex SHA-1 hashes to packed integer hashes. Every row is rehashed from its
+// anchor_freq, target_freq and time_delta columns inside one transaction.
+// It is a no-op when the hash column is already an integer.
+func MigrateHexHashes(DB *gorm.DB, layout HashLayout) error {
+	var dataType string
+	err := DB.Raw(`SELECT data_type FROM information_schema.columns
+		WHERE table_name = 'fingerprints' AND column_name = 'hash'`).Scan(&dataType).Error
+	if err != nil {
+		return err
+	}
+	if dataType == "" || dataType == "integer" {
+		return nil
+	}
+
+	freqMask := 1<<layout.FreqBits - 1
+	deltaMask := 1<<layout.DeltaBits - 1
+	// Packing is done in bigint and folded into the int4 range so the result
+	// has the same bit pattern as PackHash.
+	packed := fmt.Sprintf(`(((round(anchor_freq / %[1]g)::bigint & %[3]d) << %[5]d)
+		| ((round(target_freq / %[1]g)::bigint & %[3]d) << %[6]d)
+		| (round(time_delta * %[2]g)::bigint & %[4]d))`,
+		layout.BinHz, layout.FramesPerSecond, freqMask, deltaMask,
+		layout.FreqBits+layout.DeltaBits, layout.DeltaBits)
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			`ALTER TABLE fingerprints ADD COLUMN hash_packed integer`,
+			fmt.Sprintf(`UPDATE fingerprints SET hash_packed =
+				(CASE WHEN %[1]s >= 2147483648 THEN %[1]s - 4294967296 ELSE %[1]s END)::integer`, packed),
+			`ALTER TABLE fingerprints DROP COLUMN hash`,
+			`ALTER TABLE fingerprints RENAME COLUMN hash_packed TO hash`,
+		}
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,178 @@
+package db_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"gorm.io/gorm"
+)
+
+// testDB connects to the database named by SHAZAM_TEST_DATABASE_URL and
+// skips the test when it is not set. Tests drop and recreate the tables
+// they use, so it must point at a throwaway database.
+func testDB(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	dsn := os.Getenv("SHAZAM_TEST_DATABASE_URL")
+	if dsn == "" {
+		tb.Skip("SHAZAM_TEST_DATABASE_URL is not set")
+	}
+	DB, err := db.EstablishConn(dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if sqlDB, err := DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return DB
+}
+
+func exec(tb testing.TB, DB *gorm.DB, statements ...string) {
+	tb.Helper()
+	for _, stmt := range statements {
+		if err := DB.Exec(stmt).Error; err != nil {
+			tb.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+func hexHash(anchorBin, targetBin, deltaFrames int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d|%d|%d", anchorBin, targetBin, deltaFrames)))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMigrateHexHashes(t *testing.T) {
+	DB := testDB(t)
+	cfg := fingerprint.DefaultConfig()
+	layout := db.HashLayout{
+		BinHz:           cfg.BinHz(),
+		FramesPerSecond: cfg.FramesPerSecond(),
+		FreqBits:        fingerprint.HashFreqBits,
+		DeltaBits:       fingerprint.HashDeltaBits,
+	}
+
+	exec(t, DB, `DROP TABLE IF EXISTS fingerprints CASCADE`,
+		`CREATE TABLE fingerprints (
+			id bigserial PRIMARY KEY,
+			hash varchar(40),
+			song_id bigint,
+			anchor_time double precision,
+			anchor_freq double precision,
+			target_freq double precision,
+			time_delta double precision)`)
+	t.Cleanup(func() { DB.Exec(`DROP TABLE IF EXISTS fingerprints CASCADE`) })
+
+	// Peaks lie on the spectrogram grid, so the stored frequencies and
+	// deltas are whole bins and frames, up to float rounding.
+	bins := [][3]int{
+		{0, 0, 0},
+		{1, 2, 3},
+		{372, 1021, 17},
+		{1<<(fingerprint.HashFreqBits-1) - 1, 5, 40},
+		{1 << (fingerprint.HashFreqBits - 1), 5, 40}, // sign bit set
+		{1<<fingerprint.HashFreqBits - 1, 1<<fingerprint.HashFreqBits - 1, 1<<fingerprint.HashDeltaBits - 1},
+	}
+	for _, b := range bins {
+		exec(t, DB, fmt.Sprintf(`INSERT INTO fingerprints
+			(hash, song_id, anchor_time, anchor_freq, target_freq, time_delta)
+			VALUES ('%s', 1, 0, %.17g, %.17g, %.17g)`,
+			hexHash(b[0], b[1], b[2]),
+			float64(b[0])*layout.BinHz, float64(b[1])*layout.BinHz, float64(b[2])/layout.FramesPerSecond))
+	}
+
+	if err := db.MigrateHexHashes(DB, layout); err != nil {
+		t.Fatal(err)
+	}
+	var got []int32
+	if err := DB.Raw(`SELECT hash FROM fingerprints ORDER BY id`).Scan(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(bins) {
+		t.Fatalf("%d rows after the migration, want %d", len(got), len(bins))
+	}
+	for i, b := range bins {
+		if want := fingerprint.PackHash(b[0], b[1], b[2]); got[i] != want {
+			t.Errorf("row %d (bins %v) rehashed to %d, PackHash gives %d", i, b, got[i], want)
+		}
+	}
+
+	// The column is an integer now, so a second run changes nothing.
+	if err := db.MigrateHexHashes(DB, layout); err != nil {
+		t.Fatal(err)
+	}
+	var again []int32
+	if err := DB.Raw(`SELECT hash FROM fingerprints ORDER BY id`).Scan(&again).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if again[i] != got[i] {
+			t.Fatalf("second run changed row %d from %d to %d", i, got[i], again[i])
+		}
+	}
+}
+
+// BenchmarkHashColumn loads the same fingerprints into a table keyed by hex
+// SHA-1 hashes and one keyed by packed hashes, reports the size of each hash
+// index per row and times looking up a clip's worth of hashes.
+func BenchmarkHashColumn(b *testing.B) {
+	DB := testDB(b)
+	const rows, queryHashes = 200000, 1200
+
+	for _, column := range []struct{ name, typ string }{{"hex", "varchar(40)"}, {"packed", "integer"}} {
+		b.Run(column.name, func(b *testing.B) {
+			table := "bench_fingerprints_" + column.name
+			exec(b, DB, `DROP TABLE IF EXISTS `+table,
+				fmt.Sprintf(`CREATE TABLE %s (hash %s, song_id integer, anchor_time real)`, table, column.typ))
+			b.Cleanup(func() { DB.Exec(`DROP TABLE IF EXISTS ` + table) })
+
+			rng := rand.New(rand.NewSource(1))
+			hashes := make([]any, rows)
+			for i := range hashes {
+				a, t, d := rng.Intn(1<<fingerprint.HashFreqBits), rng.Intn(1<<fingerprint.HashFreqBits), rng.Intn(1<<fingerprint.HashDeltaBits)
+				if column.name == "hex" {
+					hashes[i] = hexHash(a, t, d)
+				} else {
+					hashes[i] = fingerprint.PackHash(a, t, d)
+				}
+			}
+			for start := 0; start < rows; start += 5000 {
+				chunk := hashes[start:min(rows, start+5000)]
+				values := strings.Repeat("(?, ?, ?), ", len(chunk))
+				args := make([]any, 0, 3*len(chunk))
+				for _, h := range chunk {
+					args = append(args, h, rng.Intn(1000), rng.Float64()*300)
+				}
+				stmt := fmt.Sprintf(`INSERT INTO %s (hash, song_id, anchor_time) VALUES %s`, table, strings.TrimSuffix(values, ", "))
+				if err := DB.Exec(stmt, args...).Error; err != nil {
+					b.Fatal(err)
+				}
+			}
+			exec(b, DB, fmt.Sprintf(`CREATE INDEX %[1]s_hash ON %[1]s (hash)`, table), `ANALYZE `+table)
+
+			var indexBytes int64
+			DB.Raw(`SELECT pg_relation_size(?::regclass)`, table+"_hash").Scan(&indexBytes)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				query := make([]any, queryHashes)
+				for j := range query {
+					query[j] = hashes[(i*queryHashes+j)%rows]
+				}
+				var found int64
+				if err := DB.Raw(`SELECT count(*) FROM `+table+` WHERE hash IN ?`, query).Scan(&found).Error; err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(indexBytes)/rows, "index-B/row")
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a FingerprintStore that keeps everything in process memory.
+// It is intended for unit tests and small deployments.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	songs  map[uint]Song
+	nextID uint
+	byHash map[int32][]Fingerprint
+	counts map[uint]int
+	plays  []Play
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		songs:  make(map[uint]Song),
+		nextID: 1,
+		byHash: make(map[int32][]Fingerprint),
+		counts: make(map[uint]int),
+	}
+}
+
+func (s *MemoryStore) AddPlay(play *Play) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	play.ID = uint(len(s.plays) + 1)
+	if play.DetectedAt.IsZero() {
+		play.DetectedAt = time.Now()
+	}
+	s.plays = append(s.plays, *play)
+	return nil
+}
+
+func (s *MemoryStore) ListPlays(source string) ([]Play, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var plays []Play
+	for _, play := range s.plays {
+		if source == "" || play.Source == source {
+			plays = append(plays, play)
+		}
+	}
+	SortPlays(plays)
+	return plays, nil
+}
+
+func (s *MemoryStore) CreateSong(song *Song) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createSongLocked(song)
+	return nil
+}
+
+func (s *MemoryStore) createSongLocked(song *Song) {
+	song.ID = s.nextID
+	s.nextID++
+	if song.IngestedAt.IsZero() {
+		song.IngestedAt = time.Now()
+	}
+	stored := *song
+	stored.Fingerprints = nil
+	s.songs[song.ID] = stored
+}
+
+func (s *MemoryStore) AddSong(song *Song, fingerprints []Fingerprint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createSongLocked(song)
+	for i := range fingerprints {
+		fingerprints[i].SongID = song.ID
+		s.byHash[fingerprints[i].Hash] = append(s.byHash[fingerprints[i].Hash], fingerprints[i])
+	}
+	if len(fingerprints) > 0 {
+		s.counts[song.ID] += len(fingerprints)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Songs(songIDs []uint) (map[uint]Song, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	songs := make(map[uint]Song, len(songIDs))
+	for _, id := range songIDs {
+		if song, ok := s.songs[id]; ok {
+			songs[id] = song
+		}
+	}
+	return songs, nil
+}
+
+func (s *MemoryStore) ListSongs() ([]Song, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	songs := make([]Song, 0, len(s.songs))
+	for _, song := range s.songs {
+		songs = append(songs, song)
+	}
+	sort.Slice(songs, func(i, j int) bool { return songs[i].ID < songs[j].ID })
+	return songs, nil
+}
+
+func (s *MemoryStore) DeleteSong(songID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.songs[songID]; !ok {
+		return ErrSongNotFound
+	}
+	s.removeFingerprintsLocked(songID)
+	delete(s.songs, songID)
+	return nil
+}
+
+func (s *MemoryStore) ReplaceSong(song *Song, fingerprints []Fingerprint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.songs[song.ID]; !ok {
+		return ErrSongNotFound
+	}
+	s.removeFingerprintsLocked(song.ID)
+	if song.IngestedAt.IsZero() {
+		song.IngestedAt = time.Now()
+	}
+	stored := *song
+	stored.Fingerprints = nil
+	s.songs[song.ID] = stored
+	for i := range fingerprints {
+		fingerprints[i].SongID = song.ID
+		s.byHash[fingerprints[i].Hash] = append(s.byHash[fingerprints[i].Hash], fingerprints[i])
+	}
+	if len(fingerprints) > 0 {
+		s.counts[song.ID] = len(fingerprints)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SongByChecksum(checksum string) (Song, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found Song
+	for _, song := range s.songs {
+		if song.Checksum == checksum && (found.ID == 0 || song.ID < found.ID) {
+			found = song
+		}
+	}
+	if found.ID == 0 {
+		return Song{}, ErrSongNotFound
+	}
+	return found, nil
+}
+
+// removeFingerprintsLocked drops every fingerprint of songID.
+func (s *MemoryStore) removeFingerprintsLocked(songID uint) {
+	if s.counts[songID] > 0 {
+		for hash, fps := range s.byHash {
+			kept := fps[:0]
+			for _, fp := range fps {
+				if fp.SongID != songID {
+					kept = append(kept, fp)
+				}
+			}
+			if len(kept) == 0 {
+				delete(s.byHash, hash)
+			} else {
+				s.byHash[hash] = kept
+			}
+		}
+	}
+	delete(s.counts, songID)
+}
+
+func (s *MemoryStore) InsertBatch(fingerprints []Fingerprint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fp := range fingerprints {
+		if _, ok := s.songs[fp.SongID]; !ok {
+			return fmt.Errorf("fingerprint references unknown song %d", fp.SongID)
+		}
+	}
+	for _, fp := range fingerprints {
+		s.byHash[fp.Hash] = append(s.byHash[fp.Hash], fp)
+		s.counts[fp.SongID]++
+	}
+	return nil
+}
+
+func (s *MemoryStore) LookupHashes(hashes []int32) ([]Fingerprint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var fingerprints []Fingerprint
+	for _, hash := range uniqueHashes(hashes) {
+		fingerprints = append(fingerprints, s.byHash[hash]...)
+	}
+	return fingerprints, nil
+}
+
+func (s *MemoryStore) LookupHashesForSongs(hashes []int32, songIDs []uint) ([]Fingerprint, error) {
+	wanted := make(map[uint]bool, len(songIDs))
+	for _, id := range songIDs {
+		wanted[id] = true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var fingerprints []Fingerprint
+	for _, hash := range uniqueHashes(hashes) {
+		for _, fp := range s.byHash[hash] {
+			if wanted[fp.SongID] {
+				fingerprints = append(fingerprints, fp)
+			}
+		}
+	}
+	return fingerprints, nil
+}
+
+func (s *MemoryStore) HitsPerSong(hashes []int32) (map[uint]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hits := make(map[uint]int)
+	for _, hash := range uniqueHashes(hashes) {
+		for _, fp := range s.byHash[hash] {
+			hits[fp.SongID]++
+		}
+	}
+	return hits, nil
+}
+
+func (s *MemoryStore) HitsPerHash(hashes []int32) (map[int32]map[uint]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hits := make(map[int32]map[uint]int)
+	for _, hash := range uniqueHashes(hashes) {
+		for _, fp := range s.byHash[hash] {
+			if hits[hash] == nil {
+				hits[hash] = make(map[uint]int)
+			}
+			hits[hash][fp.SongID]++
+		}
+	}
+	return hits, nil
+}
+
+func (s *MemoryStore) CountPerSong() (map[uint]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[uint]int, len(s.counts))
+	for songID, n := range s.counts {
+		counts[songID] = n
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) SongFingerprints(songIDs []uint) (map[uint][]Fingerprint, error) {
+	wanted := make(map[uint]bool, len(songIDs))
+	for _, id := range songIDs {
+		wanted[id] = true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := make(map[uint][]Fingerprint)
+	for _, fps := range s.byHash {
+		for _, fp := range fps {
+			if wanted[fp.SongID] {
+				found[fp.SongID] = append(found[fp.SongID], fp)
+			}
+		}
+	}
+	for _, fps := range found {
+		SortByAnchorTime(fps)
+	}
+	return found, nil
+}
+
+// SortByAnchorTime orders fingerprints by anchor time, then by hash.
+func SortByAnchorTime(fingerprints []Fingerprint) {
+	sort.Slice(fingerprints, func(i, j int) bool {
+		a, b := fingerprints[i], fingerprints[j]
+		if a.AnchorTime != b.AnchorTime {
+			return a.AnchorTime < b.AnchorTime
+		}
+		return a.Hash < b.Hash
+	})
+}
+
+// uniqueHashes drops repeated hashes so each posting list is visited once,
+// matching the semantics of "hash IN ?".
+func uniqueHashes(hashes []int32) []int32 {
+	seen := make(map[int32]struct{}, len(hashes))
+	unique := make([]int32, 0, len(hashes))
+	for _, hash := range hashes {
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = struct{}{}
+			unique = append(unique, hash)
+		}
+	}
+	return unique
+}
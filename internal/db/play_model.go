@@ -0,0 +1,39 @@
+package db
+
+import (
+	"sort"
+	"time"
+)
+
+// Play is one uninterrupted airing of a catalog song detected in a monitored
+// stream. Times are in seconds: StreamStart and StreamEnd from the start of
+// the stream, RefOffset the position within the song at StreamStart.
+type Play struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Source      string    `gorm:"index;not null" json:"source"` // stream URL or file monitored
+	SongID      uint      `gorm:"index;not null" json:"song_id"`
+	Title       string    `json:"title"`
+	Artist      string    `json:"artist,omitempty"`
+	StreamStart float64   `json:"stream_start_seconds"`
+	StreamEnd   float64   `json:"stream_end_seconds"`
+	RefOffset   float64   `json:"ref_offset_seconds"`
+	Speed       float64   `json:"speed"`
+	Confidence  float64   `json:"confidence"` // best confidence of any window of the play
+	Windows     int       `json:"windows"`    // matched windows merged into the play
+	PlayedAt    time.Time `json:"played_at"`  // wall-clock time of StreamStart
+	DetectedAt  time.Time `gorm:"autoCreateTime" json:"detected_at"`
+}
+
+// SortPlays orders plays by source, then stream start, then ID.
+func SortPlays(plays []Play) {
+	sort.Slice(plays, func(i, j int) bool {
+		a, b := plays[i], plays[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.StreamStart != b.StreamStart {
+			return a.StreamStart < b.StreamStart
+		}
+		return a.ID < b.ID
+	})
+}
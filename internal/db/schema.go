@@ -0,0 +1,332 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// The Postgres schema is built by the numbered migrations below. Each is
+// applied in its own transaction together with its row in
+// schema_migrations, so the recorded version is always the schema's real
+// one. Migrations are only ever appended; a released one is never edited.
+
+// MAX_HASH_PARTITIONS bounds SchemaOptions.HashPartitions.
+const MAX_HASH_PARTITIONS = 256
+
+// SchemaOptions are the choices a migration may depend on.
+type SchemaOptions struct {
+	// Layout is used to rehash legacy hex hashes; see MigrateHexHashes.
+	Layout HashLayout
+	// HashPartitions, if above 1, splits the fingerprints table into that
+	// many partitions by hash prefix, i.e. by the top bits of the hash. It
+	// must be a power of two and is applied when the table is rebuilt by
+	// migration 2; changing it later means migrating down past 2 and up
+	// again.
+	HashPartitions int
+}
+
+// Validate reports whether the options can be applied.
+func (o SchemaOptions) Validate() error {
+	n := o.HashPartitions
+	if n < 0 || n > MAX_HASH_PARTITIONS || n > 1 && n&(n-1) != 0 {
+		return fmt.Errorf("hash partitions must be 0 or a power of two up to %d, got %d", MAX_HASH_PARTITIONS, n)
+	}
+	return nil
+}
+
+// Migration is one step of the schema. Down undoes Up.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB, opts SchemaOptions) error
+	Down    func(tx *gorm.DB, opts SchemaOptions) error
+}
+
+// Migrations lists every schema step in version order.
+var Migrations = []Migration{
+	{1, "baseline", upBaseline, downBaseline},
+	{2, "compact_fingerprints", upCompactFingerprints, downCompactFingerprints},
+}
+
+// LatestSchemaVersion is the version Migrate brings a database to.
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// ErrSchemaOutdated is returned by CheckSchema when migrations are pending.
+var ErrSchemaOutdated = errors.New("database schema is out of date")
+
+// SchemaVersion returns the version of the last applied migration, 0 for a
+// database never migrated.
+func SchemaVersion(DB *gorm.DB) (int, error) {
+	if err := ensureVersionTable(DB); err != nil {
+		return 0, err
+	}
+	return currentVersion(DB)
+}
+
+// CheckSchema returns ErrSchemaOutdated unless the database is at
+// LatestSchemaVersion.
+func CheckSchema(DB *gorm.DB) error {
+	version, err := SchemaVersion(DB)
+	if err != nil {
+		return err
+	}
+	if version != LatestSchemaVersion() {
+		return fmt.Errorf("%w: at version %d, want %d", ErrSchemaOutdated, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Migrate applies every pending migration.
+func Migrate(DB *gorm.DB, opts SchemaOptions) error {
+	return MigrateTo(DB, LatestSchemaVersion(), opts)
+}
+
+// MigrateTo applies the Up steps or, to go back, the Down steps that bring
+// the schema to version; 0 removes it entirely. Concurrent callers are
+// serialised, and a step already applied by another caller is not redone.
+func MigrateTo(DB *gorm.DB, version int, opts SchemaOptions) error {
+	if version < 0 || version > LatestSchemaVersion() {
+		return fmt.Errorf("schema version %d does not exist; the latest is %d", version, LatestSchemaVersion())
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if err := ensureVersionTable(DB); err != nil {
+		return err
+	}
+	for {
+		done := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLockID).Error; err != nil {
+				return err
+			}
+			current, err := currentVersion(tx)
+			if err != nil {
+				return err
+			}
+			switch {
+			case current < version:
+				m := Migrations[current]
+				if err := m.Up(tx, opts); err != nil {
+					return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+				}
+				return tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name).Error
+			case current > version:
+				m := Migrations[current-1]
+				if err := m.Down(tx, opts); err != nil {
+					return fmt.Errorf("reverting migration %d %s: %w", m.Version, m.Name, err)
+				}
+				return tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version).Error
+			}
+			done = true
+			return nil
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrationLockID keys the advisory lock held while a migration runs.
+const migrationLockID = 0x5348415a // "SHAZ"
+
+func ensureVersionTable(DB *gorm.DB) error {
+	return DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`).Error
+}
+
+func currentVersion(DB *gorm.DB) (int, error) {
+	var version int
+	err := DB.Raw(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version).Error
+	return version, err
+}
+
+// execAll runs statements in order, stopping at the first error.
+func execAll(tx *gorm.DB, statements ...string) error {
+	for _, stmt := range statements {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumns are the columns of a table as created by the AutoMigrate
+// calls that preceded versioned migrations.
+type tableColumns struct {
+	table   string
+	columns []string
+	extra   []string // constraints, only applied when the table is created
+}
+
+var baselineTables = []tableColumns{
+	{"songs", []string{
+		"id bigserial PRIMARY KEY",
+		"title text NOT NULL DEFAULT ''",
+		"artist text",
+		"album text",
+		"duration decimal",
+		"source_path text",
+		"config_id text NOT NULL DEFAULT ''",
+		"checksum text",
+		"sample_rate bigint",
+		"source_sample_rate bigint",
+		"ingested_at timestamptz",
+	}, nil},
+	{"fingerprints", []string{
+		"anchor_freq decimal",
+		"target_freq decimal",
+		"time_delta decimal",
+		"anchor_time decimal",
+		"hash integer",
+		"song_id bigint",
+	}, []string{"CONSTRAINT fk_songs_fingerprints FOREIGN KEY (song_id) REFERENCES songs(id) ON DELETE CASCADE"}},
+	{"plays", []string{
+		"id bigserial PRIMARY KEY",
+		"source text NOT NULL DEFAULT ''",
+		"song_id bigint NOT NULL DEFAULT 0",
+		"title text",
+		"artist text",
+		"stream_start decimal",
+		"stream_end decimal",
+		"ref_offset decimal",
+		"speed decimal",
+		"confidence decimal",
+		"windows bigint",
+		"played_at timestamptz",
+		"detected_at timestamptz",
+	}, nil},
+}
+
+// upBaseline brings a database of any earlier release to the schema the
+// last AutoMigrate-based release left: legacy hash and song ID formats are
+// converted, and missing tables and columns are added. ListPlays filters
+// by source and orders by stream position, so plays get one index covering
+// both in place of the source index AutoMigrate created.
+func upBaseline(tx *gorm.DB, opts SchemaOptions) error {
+	if err := MigrateHexHashes(tx, opts.Layout); err != nil {
+		return err
+	}
+	if err := MigrateSongIDs(tx); err != nil {
+		return err
+	}
+	for _, t := range baselineTables {
+		create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.table, strings.Join(append(t.columns, t.extra...), ", "))
+		if err := tx.Exec(create).Error; err != nil {
+			return err
+		}
+		for _, column := range t.columns {
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", t.table, column)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return execAll(tx,
+		`CREATE INDEX IF NOT EXISTS idx_songs_source_path ON songs (source_path)`,
+		`CREATE INDEX IF NOT EXISTS idx_songs_checksum ON songs (checksum)`,
+		`DROP INDEX IF EXISTS idx_plays_source`,
+		`CREATE INDEX IF NOT EXISTS idx_plays_source_start ON plays (source, stream_start, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_plays_song_id ON plays (song_id)`,
+	)
+}
+
+// downBaseline drops the tables. Legacy formats are not restored.
+func downBaseline(tx *gorm.DB, opts SchemaOptions) error {
+	return execAll(tx,
+		`DROP TABLE IF EXISTS plays`,
+		`DROP TABLE IF EXISTS fingerprints`,
+		`DROP TABLE IF EXISTS songs`,
+	)
+}
+
+// upCompactFingerprints rebuilds the fingerprints table with a primary key,
+// 4-byte columns instead of decimals, the indexes lookups need and, if
+// asked for, partitions by hash prefix. song_id stays bigint to match
+// songs.id. The bulk loader encodes rows for these column types; see
+// fingerprintColumns. Rows are copied in hash order so
+// each hash's postings are stored together.
+func upCompactFingerprints(tx *gorm.DB, opts SchemaOptions) error {
+	primaryKey, partitionBy := "PRIMARY KEY (id)", ""
+	if opts.HashPartitions > 1 {
+		// The partition key has to be part of the primary key.
+		primaryKey, partitionBy = "PRIMARY KEY (hash, id)", " PARTITION BY RANGE (hash)"
+	}
+	statements := []string{
+		`CREATE TABLE fingerprints_new (
+			id bigserial,
+			hash integer NOT NULL,
+			song_id bigint NOT NULL,
+			anchor_time real NOT NULL,
+			anchor_freq real NOT NULL,
+			target_freq real NOT NULL,
+			time_delta real NOT NULL,
+			` + primaryKey + `,
+			CONSTRAINT fk_songs_fingerprints FOREIGN KEY (song_id) REFERENCES songs(id) ON DELETE CASCADE
+		)` + partitionBy,
+	}
+	statements = append(statements, hashPartitions("fingerprints_new", opts.HashPartitions)...)
+	statements = append(statements,
+		`INSERT INTO fingerprints_new (hash, song_id, anchor_time, anchor_freq, target_freq, time_delta)
+			SELECT hash, song_id, anchor_time, anchor_freq, target_freq, time_delta FROM fingerprints
+			WHERE hash IS NOT NULL AND song_id IS NOT NULL
+			ORDER BY hash`,
+		`DROP TABLE fingerprints`,
+		`ALTER TABLE fingerprints_new RENAME TO fingerprints`,
+		`ALTER SEQUENCE fingerprints_new_id_seq RENAME TO fingerprints_id_seq`,
+		`ALTER INDEX fingerprints_new_pkey RENAME TO fingerprints_pkey`,
+		`CREATE INDEX idx_fingerprints_hash_song ON fingerprints (hash, song_id)`,
+		`CREATE INDEX idx_fingerprints_song ON fingerprints (song_id)`,
+	)
+	return execAll(tx, statements...)
+}
+
+// hashPartitions returns the statements creating n range partitions of
+// table that split the int32 hash space evenly, so partition i holds the
+// hashes whose top log2(n) bits, read with the sign bit flipped, are i.
+func hashPartitions(table string, n int) []string {
+	if n <= 1 {
+		return nil
+	}
+	width := int64(1<<32) / int64(n)
+	statements := make([]string, n)
+	for i := range statements {
+		from, to := "MINVALUE", "MAXVALUE"
+		if i > 0 {
+			from = fmt.Sprint(int64(math.MinInt32) + int64(i)*width)
+		}
+		if i < n-1 {
+			to = fmt.Sprint(int64(math.MinInt32) + int64(i+1)*width)
+		}
+		statements[i] = fmt.Sprintf(`CREATE TABLE fingerprints_p%03d PARTITION OF %s FOR VALUES FROM (%s) TO (%s)`, i, table, from, to)
+	}
+	return statements
+}
+
+// downCompactFingerprints rebuilds the fingerprints table as baseline left
+// it.
+func downCompactFingerprints(tx *gorm.DB, opts SchemaOptions) error {
+	return execAll(tx,
+		`CREATE TABLE fingerprints_old (
+			anchor_freq decimal,
+			target_freq decimal,
+			time_delta decimal,
+			anchor_time decimal,
+			hash integer,
+			song_id bigint,
+			CONSTRAINT fk_songs_fingerprints FOREIGN KEY (song_id) REFERENCES songs(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO fingerprints_old (anchor_freq, target_freq, time_delta, anchor_time, hash, song_id)
+			SELECT anchor_freq, target_freq, time_delta, anchor_time, hash, song_id FROM fingerprints`,
+		`DROP TABLE fingerprints`,
+		`ALTER TABLE fingerprints_old RENAME TO fingerprints`,
+	)
+}
@@ -0,0 +1,205 @@
+package db_test
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"shazam/internal/db"
+
+	"gorm.io/gorm"
+)
+
+func TestSchemaOptionsValidate(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 16, db.MAX_HASH_PARTITIONS} {
+		if err := (db.SchemaOptions{HashPartitions: n}).Validate(); err != nil {
+			t.Errorf("%d partitions: %v", n, err)
+		}
+	}
+	for _, n := range []int{-1, 3, 12, 2 * db.MAX_HASH_PARTITIONS} {
+		if err := (db.SchemaOptions{HashPartitions: n}).Validate(); err == nil {
+			t.Errorf("%d partitions accepted", n)
+		}
+	}
+}
+
+// freshSchema drops everything the migrations create.
+func freshSchema(tb testing.TB, DB *gorm.DB) {
+	tb.Helper()
+	drop := []string{
+		`DROP TABLE IF EXISTS plays CASCADE`,
+		`DROP TABLE IF EXISTS fingerprints CASCADE`,
+		`DROP TABLE IF EXISTS songs CASCADE`,
+		`DROP TABLE IF EXISTS schema_migrations`,
+	}
+	exec(tb, DB, drop...)
+	tb.Cleanup(func() {
+		for _, stmt := range drop {
+			DB.Exec(stmt)
+		}
+	})
+}
+
+func columnType(t *testing.T, DB *gorm.DB, table, column string) string {
+	t.Helper()
+	var dataType string
+	err := DB.Raw(`SELECT data_type FROM information_schema.columns WHERE table_name = ? AND column_name = ?`,
+		table, column).Scan(&dataType).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataType
+}
+
+func indexExists(t *testing.T, DB *gorm.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := DB.Raw(`SELECT count(*) FROM pg_indexes WHERE indexname = ?`, name).Scan(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	DB := testDB(t)
+	freshSchema(t, DB)
+
+	if version, err := db.SchemaVersion(DB); err != nil || version != 0 {
+		t.Fatalf("fresh database at version %d, err %v; want 0", version, err)
+	}
+	if err := db.CheckSchema(DB); !errors.Is(err, db.ErrSchemaOutdated) {
+		t.Errorf("CheckSchema on a fresh database: %v, want ErrSchemaOutdated", err)
+	}
+
+	if err := db.MigrateTo(DB, 1, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.SchemaVersion(DB); version != 1 {
+		t.Errorf("at version %d after migrating to 1", version)
+	}
+	if !indexExists(t, DB, "idx_plays_source_start") || indexExists(t, DB, "idx_plays_source") {
+		t.Error("baseline should index plays by source and stream start only")
+	}
+
+	if err := db.Migrate(DB, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again is a no-op.
+	if err := db.Migrate(DB, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckSchema(DB); err != nil {
+		t.Fatal(err)
+	}
+	var applied []int
+	if err := DB.Raw(`SELECT version FROM schema_migrations ORDER BY version`).Scan(&applied).Error; err != nil {
+		t.Fatal(err)
+	}
+	var want []int
+	for _, m := range db.Migrations {
+		want = append(want, m.Version)
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("schema_migrations holds versions %v, want %v", applied, want)
+	}
+	// The bulk loader encodes its COPY rows for these types.
+	for column, want := range db.CopyColumnTypes() {
+		if got := columnType(t, DB, "fingerprints", column); got != want {
+			t.Errorf("fingerprints.%s is %s, COPY sends %s", column, got, want)
+		}
+	}
+
+	if err := db.MigrateTo(DB, 0, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.SchemaVersion(DB); version != 0 {
+		t.Errorf("at version %d after migrating down to 0", version)
+	}
+	if DB.Migrator().HasTable("fingerprints") || DB.Migrator().HasTable("songs") {
+		t.Error("tables left behind after migrating down to 0")
+	}
+	if err := db.MigrateTo(DB, db.LatestSchemaVersion()+1, db.SchemaOptions{}); err == nil {
+		t.Error("migrated to a version that does not exist")
+	}
+}
+
+func TestSongIDsAbove32Bits(t *testing.T) {
+	DB := testDB(t)
+	freshSchema(t, DB)
+	if err := db.Migrate(DB, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, DB, `SELECT setval('songs_id_seq', 3000000000)`)
+
+	for _, method := range []string{db.LoadCopy, db.LoadInsert} {
+		store := db.NewGormStore(DB)
+		store.LoadMethod = method
+		song := db.Song{Title: method, ConfigID: "test"}
+		hash := int32(len(method))
+		if err := store.AddSong(&song, []db.Fingerprint{{Hash: hash, AnchorTime: 1}}); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if song.ID <= math.MaxInt32 {
+			t.Fatalf("%s: song ID %d does not need 64 bits", method, song.ID)
+		}
+		fps, err := store.LookupHashes([]int32{hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fps) != 1 || fps[0].SongID != song.ID {
+			t.Errorf("%s: stored %+v, want one fingerprint of song %d", method, fps, song.ID)
+		}
+	}
+}
+
+func TestMigrateHashPartitions(t *testing.T) {
+	DB := testDB(t)
+	freshSchema(t, DB)
+	if err := db.Migrate(DB, db.SchemaOptions{HashPartitions: 4}); err != nil {
+		t.Fatal(err)
+	}
+	var partitions int
+	err := DB.Raw(`SELECT count(*) FROM pg_inherits WHERE inhparent = 'fingerprints'::regclass`).Scan(&partitions).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partitions != 4 {
+		t.Fatalf("%d partitions, want 4", partitions)
+	}
+
+	store := db.NewGormStore(DB)
+	song := db.Song{Title: "partitioned", ConfigID: "test"}
+	want := map[int32]string{
+		math.MinInt32: "fingerprints_p000",
+		-1 << 30:      "fingerprints_p001",
+		-1:            "fingerprints_p001",
+		0:             "fingerprints_p002",
+		1<<30 - 1:     "fingerprints_p002",
+		1 << 30:       "fingerprints_p003",
+		math.MaxInt32: "fingerprints_p003",
+	}
+	var fps []db.Fingerprint
+	for hash := range want {
+		fps = append(fps, db.Fingerprint{Hash: hash})
+	}
+	if err := store.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+	var rows []struct {
+		Hash      int32
+		Partition string
+	}
+	err = DB.Raw(`SELECT hash, tableoid::regclass::text AS partition FROM fingerprints`).Scan(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows stored, want %d", len(rows), len(want))
+	}
+	for _, row := range rows {
+		if row.Partition != want[row.Hash] {
+			t.Errorf("hash %d stored in %s, want %s", row.Hash, row.Partition, want[row.Hash])
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// MigrateSongIDs converts a fingerprints table whose song_id column still
+// holds file paths into one that references the songs table. A song is
+// created for every distinct path, titled after the file name and carrying
+// the config recorded in the legacy song_configs table, if any. It is a
+// no-op once song_id is numeric.
+func MigrateSongIDs(DB *gorm.DB) error {
+	var dataType string
+	err := DB.Raw(`SELECT data_type FROM information_schema.columns
+		WHERE table_name = 'fingerprints' AND column_name = 'song_id'`).Scan(&dataType).Error
+	if err != nil {
+		return err
+	}
+	if dataType != "text" && dataType != "character varying" {
+		return nil
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if !tx.Migrator().HasTable(&Song{}) {
+			if err := tx.Migrator().CreateTable(&Song{}); err != nil {
+				return err
+			}
+		}
+
+		configJoin := `SELECT f.song_id, '' AS config_id FROM (SELECT DISTINCT song_id FROM fingerprints) f`
+		if tx.Migrator().HasTable("song_configs") {
+			configJoin = `SELECT f.song_id, COALESCE(sc.config_id, '') AS config_id
+				FROM (SELECT DISTINCT song_id FROM fingerprints) f
+				LEFT JOIN song_configs sc ON sc.song_id = f.song_id`
+		}
+
+		statements := []string{
+			`INSERT INTO songs (title, source_path, config_id, duration, ingested_at)
+				SELECT regexp_replace(legacy.song_id, '^.*/|\.[^./]*$', '', 'g'), legacy.song_id, legacy.config_id, 0, now()
+				FROM (` + configJoin + `) legacy`,
+			`ALTER TABLE fingerprints ADD COLUMN song_ref bigint`,
+			`UPDATE fingerprints f SET song_ref = s.id FROM songs s WHERE s.source_path = f.song_id`,
+			`ALTER TABLE fingerprints DROP COLUMN song_id`,
+			`ALTER TABLE fingerprints RENAME COLUMN song_ref TO song_id`,
+			`DROP TABLE IF EXISTS song_configs`,
+		}
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Song is a catalog entry. Its fingerprints reference it by ID and are
+// removed with it.
+type Song struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	Title      string  `gorm:"not null" json:"title"`
+	Artist     string  `json:"artist,omitempty"`
+	Album      string  `json:"album,omitempty"`
+	Duration   float64 `json:"duration_seconds"` // length of the ingested audio in seconds
+	SourcePath string  `gorm:"index" json:"source_path,omitempty"`
+	ConfigID   string  `gorm:"not null" json:"config_id"` // fingerprint.FingerprintConfig.ID() used at ingest
+	// Checksum is the FileChecksum of the ingested file, so the same file
+	// is recognised when it is ingested again.
+	Checksum string `gorm:"index" json:"checksum,omitempty"`
+	// SampleRate is the analysis rate the audio was resampled to before
+	// fingerprinting; SourceSampleRate is the rate it was decoded at.
+	SampleRate       int       `json:"sample_rate"`
+	SourceSampleRate int       `json:"source_sample_rate,omitempty"`
+	IngestedAt       time.Time `gorm:"autoCreateTime" json:"ingested_at"`
+
+	Fingerprints []Fingerprint `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// FileChecksum returns the hex-encoded SHA-256 of the content of r.
+func FileChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TitleFromPath derives a default song title from a file path by dropping the
+// directory and extension.
+func TitleFromPath(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
@@ -0,0 +1,63 @@
+package db
+
+import "errors"
+
+// ErrSongNotFound is returned for operations on a song that is not stored.
+var ErrSongNotFound = errors.New("song not found")
+
+// FingerprintStore is the storage backend behind ingestion and matching.
+// Implementations must be safe for concurrent use.
+type FingerprintStore interface {
+	// CreateSong stores song and assigns its ID. Fingerprints can only be
+	// inserted for songs that exist.
+	CreateSong(song *Song) error
+	// Songs returns the stored songs with the given IDs. Unknown IDs are
+	// absent from the map.
+	Songs(songIDs []uint) (map[uint]Song, error)
+	// ListSongs returns every song in ID order.
+	ListSongs() ([]Song, error)
+	// AddSong stores song together with its fingerprints, assigning the
+	// song ID and setting SongID on every fingerprint. Either both are
+	// stored or neither is.
+	AddSong(song *Song, fingerprints []Fingerprint) error
+	// DeleteSong removes a song and its fingerprints, or returns
+	// ErrSongNotFound.
+	DeleteSong(songID uint) error
+	// ReplaceSong swaps the metadata and fingerprints of the stored song
+	// with ID song.ID for song and fingerprints, setting SongID on every
+	// fingerprint. Either the song is fully replaced or it is left as it
+	// was. It returns ErrSongNotFound if there is no such song.
+	ReplaceSong(song *Song, fingerprints []Fingerprint) error
+	// SongByChecksum returns the song with the lowest ID whose Checksum is
+	// checksum, or ErrSongNotFound.
+	SongByChecksum(checksum string) (Song, error)
+
+	// InsertBatch stores fingerprints. It may split them into several writes.
+	InsertBatch(fingerprints []Fingerprint) error
+	// LookupHashes returns every stored fingerprint whose hash is in hashes.
+	LookupHashes(hashes []int32) ([]Fingerprint, error)
+	// LookupHashesForSongs is LookupHashes restricted to fingerprints of
+	// the songs in songIDs.
+	LookupHashesForSongs(hashes []int32, songIDs []uint) ([]Fingerprint, error)
+	// HitsPerSong returns, for each song with at least one fingerprint whose
+	// hash is in hashes, the number of such fingerprints.
+	HitsPerSong(hashes []int32) (map[uint]int, error)
+	// HitsPerHash is HitsPerSong broken down by hash: for each hash in
+	// hashes, the number of fingerprints of each song carrying it.
+	HitsPerHash(hashes []int32) (map[int32]map[uint]int, error)
+	// CountPerSong returns the total number of fingerprints stored per song.
+	CountPerSong() (map[uint]int, error)
+	// SongFingerprints returns the fingerprints of each song in songIDs in
+	// anchor time order. Songs without fingerprints are absent.
+	SongFingerprints(songIDs []uint) (map[uint][]Fingerprint, error)
+}
+
+// PlayLog records the plays found by broadcast monitoring.
+// Implementations must be safe for concurrent use.
+type PlayLog interface {
+	// AddPlay stores play and assigns its ID.
+	AddPlay(play *Play) error
+	// ListPlays returns the plays detected in source, or in every source
+	// if it is empty, in stream order.
+	ListPlays(source string) ([]Play, error)
+}
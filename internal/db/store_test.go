@@ -0,0 +1,167 @@
+package db_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"shazam/internal/db"
+)
+
+// testSong returns a song with every metadata field set.
+func testSong(title, checksum string) db.Song {
+	return db.Song{
+		Title:            title,
+		Artist:           "Artist",
+		Album:            "Album",
+		Duration:         187.25,
+		SourcePath:       "music/" + title + ".flac",
+		ConfigID:         "fp2-test",
+		Checksum:         checksum,
+		SampleRate:       44100,
+		SourceSampleRate: 48000,
+		// Postgres keeps microseconds.
+		IngestedAt: time.Date(2024, 3, 9, 14, 30, 15, 123456000, time.UTC),
+	}
+}
+
+// sameSong reports whether got is want as stored, whatever time zone the
+// store reads IngestedAt back in.
+func sameSong(got, want db.Song) bool {
+	if !got.IngestedAt.Equal(want.IngestedAt) {
+		return false
+	}
+	got.IngestedAt, want.IngestedAt = time.Time{}, time.Time{}
+	got.Fingerprints, want.Fingerprints = nil, nil
+	return reflect.DeepEqual(got, want)
+}
+
+// checkSongRoundTrip stores songs with metadata in store and checks they read
+// back intact, with their fingerprints referencing them by ID.
+func checkSongRoundTrip(t *testing.T, store db.FingerprintStore) {
+	a := testSong("a", "aaaa")
+	fps := []db.Fingerprint{{Hash: 11, AnchorTime: 1}, {Hash: 12, AnchorTime: 2}}
+	if err := store.AddSong(&a, fps); err != nil {
+		t.Fatal(err)
+	}
+	if a.ID == 0 {
+		t.Fatal("AddSong assigned no ID")
+	}
+	for _, fp := range fps {
+		if fp.SongID != a.ID {
+			t.Errorf("fingerprint %d references song %d, want %d", fp.Hash, fp.SongID, a.ID)
+		}
+	}
+	b := testSong("b", "bbbb")
+	b.Artist, b.Album, b.SourceSampleRate = "", "", 0
+	if err := store.AddSong(&b, []db.Fingerprint{{Hash: 11, AnchorTime: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if b.ID <= a.ID {
+		t.Errorf("second song got ID %d, not above %d", b.ID, a.ID)
+	}
+
+	songs, err := store.Songs([]uint{a.ID, b.ID, b.ID + 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 || !sameSong(songs[a.ID], a) || !sameSong(songs[b.ID], b) {
+		t.Errorf("Songs returned %+v, want %+v and %+v", songs, a, b)
+	}
+	list, err := store.ListSongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !sameSong(list[0], a) || !sameSong(list[1], b) {
+		t.Errorf("ListSongs returned %+v, want a then b", list)
+	}
+	if got, err := store.SongByChecksum("bbbb"); err != nil || !sameSong(got, b) {
+		t.Errorf("SongByChecksum found %+v, %v; want %+v", got, err, b)
+	}
+	if _, err := store.SongByChecksum("cccc"); !errors.Is(err, db.ErrSongNotFound) {
+		t.Errorf("SongByChecksum of an unknown checksum: %v, want ErrSongNotFound", err)
+	}
+
+	found, err := store.LookupHashes([]int32{11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := map[uint]bool{}
+	for _, fp := range found {
+		owners[fp.SongID] = true
+	}
+	if len(found) != 2 || !owners[a.ID] || !owners[b.ID] {
+		t.Errorf("hash 11 found in %+v, want one fingerprint of each song", found)
+	}
+
+	// Replacing a song keeps its ID and swaps everything else.
+	replaced := testSong("a, remastered", "aaab")
+	replaced.ID = a.ID
+	if err := store.ReplaceSong(&replaced, []db.Fingerprint{{Hash: 13, AnchorTime: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if songs, err := store.Songs([]uint{a.ID}); err != nil || !sameSong(songs[a.ID], replaced) {
+		t.Errorf("replaced song reads back as %+v, %v; want %+v", songs[a.ID], err, replaced)
+	}
+	counts, err := store.CountPerSong()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint]int{a.ID: 1, b.ID: 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts %v after the replace, want %v", counts, want)
+	}
+
+	// Deleting a song removes its fingerprints with it.
+	if err := store.DeleteSong(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteSong(b.ID); !errors.Is(err, db.ErrSongNotFound) {
+		t.Errorf("deleting song %d twice: %v, want ErrSongNotFound", b.ID, err)
+	}
+	if found, err := store.LookupHashes([]int32{11}); err != nil || len(found) != 0 {
+		t.Errorf("hash 11 still found in %+v, %v after its songs were replaced and deleted", found, err)
+	}
+	missing := db.Song{ID: b.ID, Title: "gone", ConfigID: "fp2-test"}
+	if err := store.ReplaceSong(&missing, nil); !errors.Is(err, db.ErrSongNotFound) {
+		t.Errorf("replacing a deleted song: %v, want ErrSongNotFound", err)
+	}
+}
+
+func TestMemoryStoreSongs(t *testing.T) {
+	checkSongRoundTrip(t, db.NewMemoryStore())
+}
+
+func TestGormStoreSongs(t *testing.T) {
+	DB := testDB(t)
+	freshSchema(t, DB)
+	if err := db.Migrate(DB, db.SchemaOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkSongRoundTrip(t, db.NewGormStore(DB))
+}
+
+func TestFileChecksum(t *testing.T) {
+	sum, err := db.FileChecksum(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; sum != want {
+		t.Errorf("checksum of abc is %s, want %s", sum, want)
+	}
+}
+
+func TestTitleFromPath(t *testing.T) {
+	cases := map[string]string{
+		"music/Artist - Song.flac": "Artist - Song",
+		"song.wav":                 "song",
+		"/abs/dir/no extension":    "no extension",
+		"dir/archive.tar.gz":       "archive.tar",
+	}
+	for path, want := range cases {
+		if got := db.TitleFromPath(path); got != want {
+			t.Errorf("TitleFromPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
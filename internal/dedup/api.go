@@ -0,0 +1,49 @@
+package dedup
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewHandler returns a handler for GET /duplicates. It runs Find over store
+// and answers with the Report. The optional min_overlap query parameter, a
+// fraction in (0, 1], overrides c.MinOverlap. As a run reads the whole
+// catalog, only one runs at a time; requests arriving meanwhile get 409
+// Conflict.
+func NewHandler(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc search.MatchConfig, c Config) gin.HandlerFunc {
+	var running sync.Mutex
+	return func(ctx *gin.Context) {
+		run := c
+		if v := ctx.Query("min_overlap"); v != "" {
+			overlap, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_overlap: " + err.Error()})
+				return
+			}
+			run.MinOverlap = overlap
+		}
+		if err := run.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !running.TryLock() {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "A duplicate search is already running"})
+			return
+		}
+		defer running.Unlock()
+		report, err := Find(store, cfg, mc, run)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search for duplicates: " + err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+}
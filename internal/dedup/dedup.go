@@ -0,0 +1,267 @@
+// Package dedup finds songs that are in the catalog more than once: the same
+// master under another file name, a remaster, or a clipped or extended
+// version.
+//
+// Every song's own fingerprints are matched against the rest of the index as
+// if they were a query. Two songs whose fingerprints line up at one offset
+// for a large enough share of the shorter song are duplicates, and
+// duplicates of duplicates are gathered into clusters.
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+const (
+	// MIN_OVERLAP is the default share of the shorter song's fingerprints
+	// that must line up with the other song.
+	MIN_OVERLAP = 0.02
+	// MIN_SIGNIFICANCE is the default significance, as -log10 of the
+	// chance probability, the alignment must reach. It is far above what a
+	// clip query needs because a whole song is matched, and ratio hashes,
+	// searched over many speeds, line up by chance more readily.
+	MIN_SIGNIFICANCE = 50.0
+	// BATCH_HASHES is the default number of fingerprints matched together;
+	// see search.MatchMany. Songs are batched until their fingerprints
+	// reach it, which bounds the hashes looked up in one go whatever the
+	// song lengths.
+	BATCH_HASHES = 50000
+)
+
+// Config decides which song pairs are reported as duplicates.
+type Config struct {
+	MinOverlap      float64 `yaml:"min_overlap" toml:"min_overlap"`
+	MinSignificance float64 `yaml:"min_significance" toml:"min_significance"`
+	BatchHashes     int     `yaml:"batch_hashes" toml:"batch_hashes"`
+}
+
+// DefaultConfig returns the configuration used when none is supplied.
+func DefaultConfig() Config {
+	return Config{
+		MinOverlap:      MIN_OVERLAP,
+		MinSignificance: MIN_SIGNIFICANCE,
+		BatchHashes:     BATCH_HASHES,
+	}
+}
+
+// Validate reports the first setting outside its range.
+func (c Config) Validate() error {
+	switch {
+	case c.MinOverlap <= 0 || c.MinOverlap > 1:
+		return fmt.Errorf("min overlap must be in (0, 1], got %g", c.MinOverlap)
+	case c.MinSignificance < 0:
+		return fmt.Errorf("min significance must not be negative, got %g", c.MinSignificance)
+	case c.BatchHashes < 1:
+		return fmt.Errorf("batch hashes must be positive, got %d", c.BatchHashes)
+	}
+	return nil
+}
+
+// Pair is two songs found to be duplicates, SongA having the lower ID.
+type Pair struct {
+	SongA uint `json:"song_a"`
+	SongB uint `json:"song_b"`
+	// OverlapPercent is the share of the shorter song's fingerprints that
+	// line up with the other song, in percent.
+	OverlapPercent float64 `json:"overlap_percent"`
+	// OffsetSeconds is the position in song B at which song A starts;
+	// negative when A starts before B.
+	OffsetSeconds float64 `json:"offset_seconds"`
+	// Speed is how fast A plays relative to B. It is always 1 unless the
+	// catalog uses ratio hashes.
+	Speed        float64 `json:"speed"`
+	MatchCount   int     `json:"match_count"`
+	Significance float64 `json:"significance"`
+}
+
+// Cluster is a group of songs linked by duplicate pairs.
+type Cluster struct {
+	Songs []db.Song `json:"songs"`
+	Pairs []Pair    `json:"pairs"`
+}
+
+// Report is the outcome of a deduplication run.
+type Report struct {
+	Clusters []Cluster `json:"clusters"`
+	// Songs is the number of songs compared; Skipped counts those left out
+	// because they were indexed under another fingerprint config or have
+	// no fingerprints.
+	Songs   int `json:"songs"`
+	Skipped int `json:"skipped"`
+}
+
+// Find compares every song of store indexed under cfg with the rest of the
+// catalog. mc bounds the candidates each song is scored against and the
+// aligned hashes a pair needs; its confidence threshold is not used, as a
+// song with several duplicates has no single clear best match.
+func Find(store db.FingerprintStore, cfg fingerprint.FingerprintConfig, mc search.MatchConfig, c Config) (*Report, error) {
+	songs, err := store.ListSongs()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := store.CountPerSong()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	byID := make(map[uint]db.Song)
+	var songIDs []uint
+	for _, song := range songs {
+		if song.ConfigID != cfg.ID() || counts[song.ID] == 0 {
+			report.Skipped++
+			continue
+		}
+		byID[song.ID] = song
+		songIDs = append(songIDs, song.ID)
+	}
+	report.Songs = len(songIDs)
+
+	// Every song finds itself first, so leave room for one more candidate.
+	mc.MaxCandidates++
+	pairs := make(map[[2]uint]Pair)
+	for len(songIDs) > 0 {
+		batch := nextBatch(songIDs, counts, c.BatchHashes)
+		songIDs = songIDs[len(batch):]
+
+		fingerprints, err := store.SongFingerprints(batch)
+		if err != nil {
+			return nil, err
+		}
+		queries := make([][]db.Fingerprint, len(batch))
+		for i, songID := range batch {
+			queries[i] = fingerprints[songID]
+		}
+		results, err := search.MatchMany(queries, cfg, mc, store)
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			if result.Err != nil && !errors.Is(result.Err, search.ErrIncompatibleConfig) {
+				return nil, result.Err
+			}
+			for _, m := range result.Matches {
+				other, ok := byID[m.Song.ID]
+				if !ok || other.ID == batch[i] || m.MatchCount < mc.MinMatchCount || m.Significance < c.MinSignificance {
+					continue
+				}
+				shorter := min(counts[batch[i]], counts[other.ID])
+				overlap := float64(m.MatchCount) / float64(max(shorter, 1))
+				if overlap < c.MinOverlap {
+					continue
+				}
+				pair := orient(batch[i], m, overlap)
+				key := [2]uint{pair.SongA, pair.SongB}
+				// Each pair is usually found from both sides; keep the
+				// better aligned.
+				if prev, seen := pairs[key]; !seen || pair.MatchCount > prev.MatchCount {
+					pairs[key] = pair
+				}
+			}
+		}
+	}
+
+	report.Clusters = cluster(pairs, byID)
+	return report, nil
+}
+
+// nextBatch returns the songs at the front of songIDs whose fingerprints
+// add up to at most maxHashes, and at least one song.
+func nextBatch(songIDs []uint, counts map[uint]int, maxHashes int) []uint {
+	n, hashes := 1, counts[songIDs[0]]
+	for n < len(songIDs) && hashes+counts[songIDs[n]] <= maxHashes {
+		hashes += counts[songIDs[n]]
+		n++
+	}
+	return songIDs[:n]
+}
+
+// orient turns m, the match of the song querySongID against another song,
+// into a Pair from the lower ID's point of view.
+func orient(querySongID uint, m search.MatchedSongOptimized, overlap float64) Pair {
+	pair := Pair{
+		SongA:          querySongID,
+		SongB:          m.Song.ID,
+		OverlapPercent: math.Min(100, overlap*100),
+		OffsetSeconds:  float64(m.MatchOffset) / 1000,
+		Speed:          m.Speed,
+		MatchCount:     m.MatchCount,
+		Significance:   m.Significance,
+	}
+	if pair.SongA > pair.SongB {
+		// The query starts at OffsetSeconds into the other song and plays
+		// Speed times as fast, so the other song starts -OffsetSeconds/Speed
+		// into the query.
+		pair.SongA, pair.SongB = pair.SongB, pair.SongA
+		pair.OffsetSeconds = -pair.OffsetSeconds / pair.Speed
+		pair.Speed = 1 / pair.Speed
+	}
+	return pair
+}
+
+// cluster groups the songs linked by pairs, lowest song ID first within and
+// across clusters.
+func cluster(pairs map[[2]uint]Pair, songs map[uint]db.Song) []Cluster {
+	parent := make(map[uint]uint)
+	var root func(uint) uint
+	root = func(id uint) uint {
+		p, ok := parent[id]
+		if !ok || p == id {
+			return id
+		}
+		r := root(p)
+		parent[id] = r
+		return r
+	}
+	for key := range pairs {
+		a, b := root(key[0]), root(key[1])
+		if a != b {
+			parent[max(a, b)] = min(a, b)
+		}
+	}
+
+	byRoot := make(map[uint]*Cluster)
+	var roots []uint
+	members := make(map[uint]bool)
+	add := func(id uint) {
+		if members[id] {
+			return
+		}
+		members[id] = true
+		r := root(id)
+		if byRoot[r] == nil {
+			byRoot[r] = &Cluster{}
+			roots = append(roots, r)
+		}
+		byRoot[r].Songs = append(byRoot[r].Songs, songs[id])
+	}
+	for key, pair := range pairs {
+		add(key[0])
+		add(key[1])
+		c := byRoot[root(key[0])]
+		c.Pairs = append(c.Pairs, pair)
+	}
+
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+	clusters := make([]Cluster, 0, len(roots))
+	for _, r := range roots {
+		c := byRoot[r]
+		sort.Slice(c.Songs, func(i, j int) bool { return c.Songs[i].ID < c.Songs[j].ID })
+		sort.Slice(c.Pairs, func(i, j int) bool {
+			a, b := c.Pairs[i], c.Pairs[j]
+			if a.SongA != b.SongA {
+				return a.SongA < b.SongA
+			}
+			return a.SongB < b.SongB
+		})
+		clusters = append(clusters, *c)
+	}
+	return clusters
+}
@@ -0,0 +1,266 @@
+package dedup
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+func TestNextBatchCapsHashes(t *testing.T) {
+	counts := map[uint]int{1: 30000, 2: 15000, 3: 10000, 4: 80000, 5: 5000, 6: 5000}
+	songIDs := []uint{1, 2, 3, 4, 5, 6}
+
+	var batches [][]uint
+	for len(songIDs) > 0 {
+		batch := nextBatch(songIDs, counts, 50000)
+		songIDs = songIDs[len(batch):]
+		batches = append(batches, batch)
+	}
+
+	// A song over the cap still gets a batch of its own.
+	want := [][]uint{{1, 2}, {3}, {4}, {5, 6}}
+	if !slices.EqualFunc(batches, want, slices.Equal) {
+		t.Fatalf("batches %v, want %v", batches, want)
+	}
+}
+
+// scaleSong returns seconds of audio at rate made of a low and a high tone
+// that move to random notes of a pentatonic scale five times a second,
+// seeded by seed. Distinct songs share many hashes, as songs in one key do,
+// but line them up only by chance.
+func scaleSong(seed int64, rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	scale := []float64{0, 2, 4, 7, 9, 12, 14, 16, 19, 21}
+	note := func(base float64) float64 { return base * math.Pow(2, scale[rng.Intn(len(scale))]/12) }
+	samples := make([]float64, int(seconds*float64(rate)))
+	step := rate / 5
+	var f1, f2 float64
+	for i := range samples {
+		if i%step == 0 {
+			f1, f2 = note(220), note(1760)
+		}
+		t := float64(i) / float64(rate)
+		samples[i] = 0.4*math.Sin(2*math.Pi*f1*t) + 0.3*math.Sin(2*math.Pi*f2*t)
+	}
+	return samples
+}
+
+// remaster returns samples at gain with noise of the given amplitude, the
+// way another master of the same recording differs from it.
+func remaster(samples []float64, gain, noise float64) []float64 {
+	rng := rand.New(rand.NewSource(int64(len(samples))))
+	out := make([]float64, len(samples))
+	for i, s := range samples {
+		out[i] = gain*s + noise*(rng.Float64()*2-1)
+	}
+	return out
+}
+
+// addSong fingerprints samples under cfg into store and returns the song ID.
+func addSong(t *testing.T, store *db.MemoryStore, cfg fingerprint.FingerprintConfig, title string, samples []float64) uint {
+	t.Helper()
+	fps, err := fingerprint.Fingerprint(&samples, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	song := db.Song{
+		Title: title, ConfigID: cfg.ID(), SampleRate: cfg.SampleRate,
+		Duration: float64(len(samples)) / float64(cfg.SampleRate),
+	}
+	if err := store.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+	return song.ID
+}
+
+func songIDs(songs []db.Song) []uint {
+	ids := make([]uint, len(songs))
+	for i, song := range songs {
+		ids[i] = song.ID
+	}
+	return ids
+}
+
+func TestFind(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	rate := cfg.SampleRate
+	store := db.NewMemoryStore()
+	a := scaleSong(1, rate, 30)
+	c := scaleSong(3, rate, 30)
+
+	original := addSong(t, store, cfg, "a", a)
+	copied := addSong(t, store, cfg, "a (copy)", a)
+	clipped := addSong(t, store, cfg, "a (radio edit)", a[8*rate:20*rate])
+	distinct := addSong(t, store, cfg, "b", scaleSong(2, rate, 30))
+	other := addSong(t, store, cfg, "c", c)
+	remastered := addSong(t, store, cfg, "c (remaster)", remaster(c, 0.7, 0.1))
+
+	// Songs under another config and songs without fingerprints are left
+	// out.
+	if err := store.AddSong(&db.Song{Title: "other config", ConfigID: "other"}, []db.Fingerprint{{Hash: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateSong(&db.Song{Title: "empty", ConfigID: cfg.ID()}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Find(store, cfg, search.DefaultMatchConfig(), DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Songs != 6 || report.Skipped != 2 {
+		t.Errorf("compared %d songs and skipped %d, want 6 and 2", report.Songs, report.Skipped)
+	}
+	if len(report.Clusters) != 2 {
+		t.Fatalf("clusters %+v, want 2", report.Clusters)
+	}
+	first, second := report.Clusters[0], report.Clusters[1]
+	if got := songIDs(first.Songs); !slices.Equal(got, []uint{original, copied, clipped}) {
+		t.Errorf("first cluster holds songs %v, want %v", got, []uint{original, copied, clipped})
+	}
+	if got := songIDs(second.Songs); !slices.Equal(got, []uint{other, remastered}) {
+		t.Errorf("second cluster holds songs %v, want %v", got, []uint{other, remastered})
+	}
+	for _, cluster := range report.Clusters {
+		for _, song := range cluster.Songs {
+			if song.ID == distinct {
+				t.Errorf("distinct song %d clustered with %v", distinct, songIDs(cluster.Songs))
+			}
+		}
+	}
+
+	// Every duplicate is paired with every other, at the offset where the
+	// lower ID starts in the higher.
+	type key struct{ a, b uint }
+	wantOffsets := map[key]float64{
+		{original, copied}:  0,
+		{original, clipped}: -8,
+		{copied, clipped}:   -8,
+		{other, remastered}: 0,
+	}
+	pairs := append(first.Pairs, second.Pairs...)
+	if len(pairs) != len(wantOffsets) {
+		t.Errorf("pairs %+v, want %d", pairs, len(wantOffsets))
+	}
+	for _, p := range pairs {
+		want, ok := wantOffsets[key{p.SongA, p.SongB}]
+		if !ok {
+			t.Errorf("unexpected pair %+v", p)
+			continue
+		}
+		if math.Abs(p.OffsetSeconds-want) > 0.1 {
+			t.Errorf("pair %d-%d at offset %gs, want %gs", p.SongA, p.SongB, p.OffsetSeconds, want)
+		}
+		if p.Speed != 1 {
+			t.Errorf("pair %d-%d at speed %g, want 1", p.SongA, p.SongB, p.Speed)
+		}
+		if p.Significance < MIN_SIGNIFICANCE {
+			t.Errorf("pair %d-%d reported with significance %.0f", p.SongA, p.SongB, p.Significance)
+		}
+		if p.SongB == copied && p.OverlapPercent < 99 {
+			t.Errorf("identical copy overlaps %.1f%%", p.OverlapPercent)
+		}
+	}
+}
+
+// TestMinOverlapSeparatesSongs backs MIN_OVERLAP: with no overlap or
+// significance threshold, the chance alignments of distinct songs stay well
+// below it, and a noisy remaster is well above it.
+func TestMinOverlapSeparatesSongs(t *testing.T) {
+	cfg := fingerprint.DefaultConfig()
+	rate := cfg.SampleRate
+	store := db.NewMemoryStore()
+	var songs []uint
+	for seed := int64(1); seed <= 6; seed++ {
+		songs = append(songs, addSong(t, store, cfg, "synth", scaleSong(seed, rate, 30)))
+	}
+	c := scaleSong(1, rate, 30)
+	remastered := addSong(t, store, cfg, "remaster", remaster(c, 0.7, 0.1))
+
+	mc := search.DefaultMatchConfig()
+	mc.MinMatchCount = 1
+	report, err := Find(store, cfg, mc, Config{MinOverlap: 1e-9, BatchHashes: BATCH_HASHES})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Clusters) != 1 {
+		t.Fatalf("clusters %+v, want one of every song", report.Clusters)
+	}
+	found := false
+	for _, p := range report.Clusters[0].Pairs {
+		if p.SongA == songs[0] && p.SongB == remastered {
+			found = true
+			if p.OverlapPercent < 2*MIN_OVERLAP*100 || p.Significance < MIN_SIGNIFICANCE {
+				t.Errorf("remaster overlaps %.2f%% with significance %.0f", p.OverlapPercent, p.Significance)
+			}
+			continue
+		}
+		if p.OverlapPercent > MIN_OVERLAP*100/2 || p.Significance >= MIN_SIGNIFICANCE {
+			t.Errorf("distinct songs %d and %d overlap %.2f%% with significance %.0f",
+				p.SongA, p.SongB, p.OverlapPercent, p.Significance)
+		}
+	}
+	if !found {
+		t.Error("remaster not paired with its original")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	m := search.MatchedSongOptimized{Song: db.Song{ID: 3}, MatchOffset: 4000, Speed: 1.25, MatchCount: 40, Significance: 60}
+
+	// Song 5 starts 4s into song 3 and plays 1.25 times as fast, so song 3
+	// starts 3.2s before song 5.
+	pair := orient(5, m, 0.5)
+	want := Pair{SongA: 3, SongB: 5, OverlapPercent: 50, OffsetSeconds: -3.2, Speed: 0.8, MatchCount: 40, Significance: 60}
+	if math.Abs(pair.OffsetSeconds-want.OffsetSeconds) > 1e-9 || math.Abs(pair.Speed-want.Speed) > 1e-9 {
+		t.Errorf("oriented pair %+v, want %+v", pair, want)
+	}
+	pair.OffsetSeconds, pair.Speed = want.OffsetSeconds, want.Speed
+	if pair != want {
+		t.Errorf("oriented pair %+v, want %+v", pair, want)
+	}
+
+	// A query with the lower ID is kept as it is, and overlap is capped.
+	if pair := orient(1, m, 1.5); pair.SongA != 1 || pair.SongB != 3 || pair.OffsetSeconds != 4 || pair.OverlapPercent != 100 {
+		t.Errorf("oriented pair %+v, want 1-3 at 4s with 100%% overlap", pair)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	songs := make(map[uint]db.Song)
+	for id := uint(1); id <= 9; id++ {
+		songs[id] = db.Song{ID: id}
+	}
+	pairs := make(map[[2]uint]Pair)
+	for _, ids := range [][2]uint{{7, 9}, {2, 8}, {4, 7}, {2, 5}, {5, 8}} {
+		pairs[ids] = Pair{SongA: ids[0], SongB: ids[1]}
+	}
+
+	clusters := cluster(pairs, songs)
+	want := [][]uint{{2, 5, 8}, {4, 7, 9}}
+	if len(clusters) != len(want) {
+		t.Fatalf("clusters %+v, want %v", clusters, want)
+	}
+	for i, c := range clusters {
+		if got := songIDs(c.Songs); !slices.Equal(got, want[i]) {
+			t.Errorf("cluster %d holds songs %v, want %v", i, got, want[i])
+		}
+		for j := 1; j < len(c.Pairs); j++ {
+			a, b := c.Pairs[j-1], c.Pairs[j]
+			if a.SongA > b.SongA || a.SongA == b.SongA && a.SongB > b.SongB {
+				t.Errorf("cluster %d pairs out of order: %+v", i, c.Pairs)
+			}
+		}
+	}
+	if got := len(clusters[0].Pairs) + len(clusters[1].Pairs); got != len(pairs) {
+		t.Errorf("%d pairs in clusters, want %d", got, len(pairs))
+	}
+	if clusters := cluster(nil, songs); clusters == nil || len(clusters) != 0 {
+		t.Errorf("no pairs cluster into %v, want an empty list", clusters)
+	}
+}
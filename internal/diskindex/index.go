@@ -0,0 +1,734 @@
+// Package diskindex implements db.FingerprintStore as a self-contained
+// inverted index in a single directory, for deployments without Postgres.
+//
+// Each InsertBatch writes one immutable segment of postings sorted by hash.
+// Lookups binary-search every segment through a read-only memory map, and
+// Compact merges all segments into one while dropping deleted songs. The
+// directory must only be opened by one process at a time.
+package diskindex
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shazam/internal/db"
+)
+
+const (
+	manifestFile = "MANIFEST"
+	songLogFile  = "songs.log"
+
+	// DefaultMaxSegments is the segment count above which InsertBatch
+	// compacts automatically.
+	DefaultMaxSegments = 32
+)
+
+type manifest struct {
+	NextSegment int      `json:"next_segment"`
+	Segments    []string `json:"segments"`
+}
+
+// Index is an on-disk fingerprint index. It is safe for concurrent use.
+type Index struct {
+	// MaxSegments triggers an automatic Compact after an insert leaves more
+	// segments than this. Zero disables automatic compaction.
+	MaxSegments int
+
+	mu       sync.RWMutex
+	dir      string
+	manifest manifest
+	segments []*segment
+	songs    *songTable
+	counts   map[uint32]int
+	songLog  *os.File
+
+	// playMu guards the play log, which is independent of the postings.
+	playMu     sync.Mutex
+	nextPlayID uint
+}
+
+var _ db.FingerprintStore = (*Index)(nil)
+
+// Open opens the index stored in dir, creating the directory if needed.
+func Open(dir string) (*Index, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	idx := &Index{
+		MaxSegments: DefaultMaxSegments,
+		dir:         dir,
+		counts:      make(map[uint32]int),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	switch {
+	case os.IsNotExist(err):
+		idx.manifest = manifest{NextSegment: 1}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &idx.manifest); err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+	}
+
+	logPath := filepath.Join(dir, songLogFile)
+	var logSize int64
+	if idx.songs, logSize, err = readSongLog(logPath); err != nil {
+		return nil, err
+	}
+	if idx.songLog, err = openSongLog(logPath, logSize); err != nil {
+		return nil, err
+	}
+
+	for _, name := range idx.manifest.Segments {
+		seg, err := openSegment(filepath.Join(dir, name), name)
+		if err != nil {
+			idx.Close()
+			return nil, err
+		}
+		idx.segments = append(idx.segments, seg)
+		for i := 0; i < seg.count; i++ {
+			key := seg.postingAt(i).song
+			if id, ok := idx.songs.owner(key); ok {
+				idx.counts[id]++
+			}
+			// Postings written for a replacement that never got logged
+			// must not come alive under a song created later.
+			idx.songs.nextID = max(idx.songs.nextID, key+1)
+		}
+	}
+
+	idx.removeStrayFiles()
+	return idx, nil
+}
+
+// Close releases the memory maps and the song log.
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var firstErr error
+	for _, seg := range idx.segments {
+		if err := seg.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	idx.segments = nil
+	if idx.songLog != nil {
+		if err := idx.songLog.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		idx.songLog = nil
+	}
+	return firstErr
+}
+
+// removeStrayFiles deletes segments and temp files left behind by a crash
+// between writing a file and committing the manifest.
+func (idx *Index) removeStrayFiles() {
+	live := make(map[string]bool, len(idx.manifest.Segments))
+	for _, name := range idx.manifest.Segments {
+		live[name] = true
+	}
+	entries, err := os.ReadDir(idx.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		stray := strings.HasSuffix(name, ".tmp") ||
+			(strings.HasPrefix(name, "seg-") && !live[name])
+		if stray {
+			os.Remove(filepath.Join(idx.dir, name))
+		}
+	}
+}
+
+func (idx *Index) nextSegmentName() string {
+	name := fmt.Sprintf("seg-%08d.dat", idx.manifest.NextSegment)
+	idx.manifest.NextSegment++
+	return name
+}
+
+// writeManifest atomically replaces the manifest with m.
+func (idx *Index) writeManifest(m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(idx.dir, manifestFile), data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (idx *Index) CreateSong(song *db.Song) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.createSongLocked(song)
+}
+
+func (idx *Index) createSongLocked(song *db.Song) error {
+	stored := *song
+	stored.ID = uint(idx.songs.nextID)
+	stored.Fingerprints = nil
+	if stored.IngestedAt.IsZero() {
+		stored.IngestedAt = time.Now()
+	}
+	ev := songEvent{Op: opAdd, ID: idx.songs.nextID, Song: &stored}
+	if err := appendEvents(idx.songLog, []songEvent{ev}); err != nil {
+		return err
+	}
+	if err := idx.songs.apply(ev); err != nil {
+		return err
+	}
+	song.ID = stored.ID
+	song.IngestedAt = stored.IngestedAt
+	return nil
+}
+
+func (idx *Index) Songs(songIDs []uint) (map[uint]db.Song, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	songs := make(map[uint]db.Song, len(songIDs))
+	for _, id := range songIDs {
+		if song, ok := idx.songs.live[uint32(id)]; ok {
+			songs[id] = song
+		}
+	}
+	return songs, nil
+}
+
+func (idx *Index) ListSongs() ([]db.Song, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	songs := make([]db.Song, 0, len(idx.songs.live))
+	for _, song := range idx.songs.live {
+		songs = append(songs, song)
+	}
+	sort.Slice(songs, func(i, j int) bool { return songs[i].ID < songs[j].ID })
+	return songs, nil
+}
+
+// AddSong logs the song and then writes its fingerprints as one segment. If
+// the segment cannot be written the song is deleted again; a crash in
+// between leaves a song without fingerprints, which ingest treats as not
+// ingested.
+func (idx *Index) AddSong(song *db.Song, fingerprints []db.Fingerprint) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := idx.createSongLocked(song); err != nil {
+		return err
+	}
+	for i := range fingerprints {
+		fingerprints[i].SongID = song.ID
+	}
+	if err := idx.insertBatchLocked(fingerprints); err != nil {
+		idx.deleteSongLocked(song.ID)
+		song.ID = 0
+		return err
+	}
+	return nil
+}
+
+func (idx *Index) DeleteSong(songID uint) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.songs.live[uint32(songID)]; !ok {
+		return db.ErrSongNotFound
+	}
+	return idx.deleteSongLocked(songID)
+}
+
+// ReplaceSong writes the new fingerprints as a segment under a fresh posting
+// key, then logs the replacement. The log write is the commit point: before
+// it the new postings belong to no song, after it the old ones do not.
+func (idx *Index) ReplaceSong(song *db.Song, fingerprints []db.Fingerprint) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id := uint32(song.ID)
+	if _, ok := idx.songs.live[id]; !ok {
+		return db.ErrSongNotFound
+	}
+	key := idx.songs.nextID
+	idx.songs.nextID++
+	postings := make([]posting, len(fingerprints))
+	for i := range fingerprints {
+		fingerprints[i].SongID = song.ID
+		postings[i] = newPosting(fingerprints[i], key)
+	}
+	if len(postings) > 0 {
+		if err := idx.addSegmentLocked(postings); err != nil {
+			return err
+		}
+	}
+
+	stored := *song
+	stored.Fingerprints = nil
+	if stored.IngestedAt.IsZero() {
+		stored.IngestedAt = time.Now()
+	}
+	ev := songEvent{Op: opReplace, ID: id, Key: key, Song: &stored}
+	if err := appendEvents(idx.songLog, []songEvent{ev}); err != nil {
+		return err
+	}
+	if err := idx.songs.apply(ev); err != nil {
+		return err
+	}
+	song.IngestedAt = stored.IngestedAt
+	idx.counts[id] = len(postings)
+	return idx.maybeMergeLocked()
+}
+
+func (idx *Index) SongByChecksum(checksum string) (db.Song, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var found db.Song
+	for _, song := range idx.songs.live {
+		if song.Checksum == checksum && (found.ID == 0 || song.ID < found.ID) {
+			found = song
+		}
+	}
+	if found.ID == 0 {
+		return db.Song{}, db.ErrSongNotFound
+	}
+	return found, nil
+}
+
+func (idx *Index) deleteSongLocked(songID uint) error {
+	id := uint32(songID)
+	if _, ok := idx.songs.live[id]; !ok {
+		return nil
+	}
+	ev := songEvent{Op: opDelete, ID: id}
+	if err := appendEvents(idx.songLog, []songEvent{ev}); err != nil {
+		return err
+	}
+	idx.songs.apply(ev)
+	delete(idx.counts, id)
+	return nil
+}
+
+func (idx *Index) InsertBatch(fingerprints []db.Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.insertBatchLocked(fingerprints)
+}
+
+func (idx *Index) insertBatchLocked(fingerprints []db.Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	postings := make([]posting, len(fingerprints))
+	for i, fp := range fingerprints {
+		id := uint32(fp.SongID)
+		if _, ok := idx.songs.live[id]; !ok {
+			return fmt.Errorf("fingerprint references unknown song %d", fp.SongID)
+		}
+		postings[i] = newPosting(fp, idx.songs.keys[id])
+	}
+
+	if err := idx.addSegmentLocked(postings); err != nil {
+		return err
+	}
+	for _, fp := range fingerprints {
+		idx.counts[uint32(fp.SongID)]++
+	}
+	return idx.maybeMergeLocked()
+}
+
+func newPosting(fp db.Fingerprint, key uint32) posting {
+	return posting{
+		hash:       fp.Hash,
+		song:       key,
+		anchorTime: fp.AnchorTime,
+		anchorFreq: fp.AnchorFreq,
+		targetFreq: fp.TargetFreq,
+		timeDelta:  fp.TimeDelta,
+	}
+}
+
+// addSegmentLocked writes postings as a new segment and adds it to the
+// manifest.
+func (idx *Index) addSegmentLocked(postings []posting) error {
+	sortPostings(postings)
+	seg, err := idx.writeSegment(postings)
+	if err != nil {
+		return err
+	}
+
+	next := idx.manifest
+	next.Segments = append(append([]string(nil), idx.manifest.Segments...), seg.name)
+	if err := idx.writeManifest(next); err != nil {
+		seg.close()
+		os.Remove(filepath.Join(idx.dir, seg.name))
+		return err
+	}
+	idx.manifest = next
+	idx.segments = append(idx.segments, seg)
+	return nil
+}
+
+// maybeMergeLocked compacts automatically once there are more than
+// MaxSegments segments.
+func (idx *Index) maybeMergeLocked() error {
+	if idx.MaxSegments > 0 && len(idx.segments) > idx.MaxSegments {
+		return idx.mergeLocked(idx.smallSegments(), false)
+	}
+	return nil
+}
+
+// smallSegments returns the smaller half of the segments. Merging only these
+// on automatic compaction keeps the cost of ingest proportional to the new
+// data rather than to the size of the index.
+func (idx *Index) smallSegments() []*segment {
+	segs := append([]*segment(nil), idx.segments...)
+	sort.Slice(segs, func(i, j int) bool { return segs[i].count < segs[j].count })
+	return segs[:len(segs)/2+1]
+}
+
+// writeSegment writes sorted postings to a new segment file and opens it.
+func (idx *Index) writeSegment(postings []posting) (*segment, error) {
+	name := idx.nextSegmentName()
+	path := filepath.Join(idx.dir, name)
+	sw, err := createSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range postings {
+		if err := sw.write(&postings[i]); err != nil {
+			sw.abort()
+			return nil, err
+		}
+	}
+	if err := sw.finish(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return openSegment(path, name)
+}
+
+// eachPosting calls fn for every live posting whose hash is in hashes, with
+// its song set to the owning song ID. The caller must hold idx.mu.
+func (idx *Index) eachPosting(hashes []int32, fn func(posting)) {
+	sorted := append([]int32(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, hash := range sorted {
+		if i > 0 && sorted[i-1] == hash {
+			continue
+		}
+		for _, seg := range idx.segments {
+			seg.find(hash, func(p posting) {
+				if id, ok := idx.songs.owner(p.song); ok {
+					p.song = id
+					fn(p)
+				}
+			})
+		}
+	}
+}
+
+func (p *posting) fingerprint() db.Fingerprint {
+	return db.Fingerprint{
+		AnchorFreq: p.anchorFreq,
+		TargetFreq: p.targetFreq,
+		TimeDelta:  p.timeDelta,
+		AnchorTime: p.anchorTime,
+		Hash:       p.hash,
+		SongID:     uint(p.song),
+	}
+}
+
+func (idx *Index) LookupHashes(hashes []int32) ([]db.Fingerprint, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var fingerprints []db.Fingerprint
+	idx.eachPosting(hashes, func(p posting) {
+		fingerprints = append(fingerprints, p.fingerprint())
+	})
+	return fingerprints, nil
+}
+
+func (idx *Index) LookupHashesForSongs(hashes []int32, songIDs []uint) ([]db.Fingerprint, error) {
+	wanted := make(map[uint32]bool, len(songIDs))
+	for _, id := range songIDs {
+		wanted[uint32(id)] = true
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var fingerprints []db.Fingerprint
+	idx.eachPosting(hashes, func(p posting) {
+		if wanted[p.song] {
+			fingerprints = append(fingerprints, p.fingerprint())
+		}
+	})
+	return fingerprints, nil
+}
+
+func (idx *Index) HitsPerSong(hashes []int32) (map[uint]int, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	hits := make(map[uint]int)
+	idx.eachPosting(hashes, func(p posting) {
+		hits[uint(p.song)]++
+	})
+	return hits, nil
+}
+
+func (idx *Index) HitsPerHash(hashes []int32) (map[int32]map[uint]int, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	hits := make(map[int32]map[uint]int)
+	idx.eachPosting(hashes, func(p posting) {
+		if hits[p.hash] == nil {
+			hits[p.hash] = make(map[uint]int)
+		}
+		hits[p.hash][uint(p.song)]++
+	})
+	return hits, nil
+}
+
+// SongFingerprints scans every segment, as postings are ordered by hash
+// rather than song; ask for many songs at once rather than one at a time.
+func (idx *Index) SongFingerprints(songIDs []uint) (map[uint][]db.Fingerprint, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	wanted := make(map[uint32]bool, len(songIDs))
+	for _, id := range songIDs {
+		if _, ok := idx.songs.live[uint32(id)]; ok && idx.counts[uint32(id)] > 0 {
+			wanted[uint32(id)] = true
+		}
+	}
+	found := make(map[uint][]db.Fingerprint)
+	if len(wanted) == 0 {
+		return found, nil
+	}
+	for _, seg := range idx.segments {
+		for i := 0; i < seg.count; i++ {
+			p := seg.postingAt(i)
+			if id, ok := idx.songs.owner(p.song); ok && wanted[id] {
+				p.song = id
+				found[uint(id)] = append(found[uint(id)], p.fingerprint())
+			}
+		}
+	}
+	for _, fps := range found {
+		db.SortByAnchorTime(fps)
+	}
+	return found, nil
+}
+
+func (idx *Index) CountPerSong() (map[uint]int, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	counts := make(map[uint]int, len(idx.counts))
+	for id, n := range idx.counts {
+		if _, ok := idx.songs.live[id]; ok && n > 0 {
+			counts[uint(id)] = n
+		}
+	}
+	return counts, nil
+}
+
+// Segments returns the number of segments in the index.
+func (idx *Index) Segments() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.segments)
+}
+
+// Compact merges every segment into one, dropping postings of deleted songs,
+// and rewrites the song log to contain only live songs.
+func (idx *Index) Compact() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.mergeLocked(idx.segments, true)
+}
+
+// mergeLocked replaces victims with a single merged segment. Postings of
+// deleted songs are dropped. When full is set, victims must be every segment
+// and the song log is rewritten as well; this is only safe once no posting
+// refers to a deleted song, since the rewrite forgets deleted songs.
+func (idx *Index) mergeLocked(victims []*segment, full bool) error {
+	merging := make(map[string]bool, len(victims))
+	for _, seg := range victims {
+		merging[seg.name] = true
+	}
+	var kept []*segment
+	next := manifest{NextSegment: idx.manifest.NextSegment}
+	for _, seg := range idx.segments {
+		if !merging[seg.name] {
+			kept = append(kept, seg)
+			next.Segments = append(next.Segments, seg.name)
+		}
+	}
+	var merged *segment
+
+	name := fmt.Sprintf("seg-%08d.dat", next.NextSegment)
+	next.NextSegment++
+	path := filepath.Join(idx.dir, name)
+	sw, err := createSegment(path)
+	if err != nil {
+		return err
+	}
+	err = mergeSegments(victims, func(p *posting) error {
+		if _, ok := idx.songs.owner(p.song); !ok {
+			return nil
+		}
+		return sw.write(p)
+	})
+	if err != nil {
+		sw.abort()
+		return err
+	}
+	if err := sw.finish(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if sw.count > 0 {
+		if merged, err = openSegment(path, name); err != nil {
+			os.Remove(path)
+			return err
+		}
+		next.Segments = append(next.Segments, name)
+	} else {
+		os.Remove(path)
+	}
+
+	if err := idx.writeManifest(next); err != nil {
+		if merged != nil {
+			merged.close()
+		}
+		os.Remove(path)
+		return err
+	}
+
+	idx.manifest = next
+	idx.segments = kept
+	if merged != nil {
+		idx.segments = append(idx.segments, merged)
+	}
+	for _, seg := range victims {
+		seg.close()
+		os.Remove(filepath.Join(idx.dir, seg.name))
+	}
+
+	if !full {
+		return nil
+	}
+	return idx.rewriteSongLog()
+}
+
+// rewriteSongLog replaces the song log with a snapshot of the live songs.
+func (idx *Index) rewriteSongLog() error {
+	path := filepath.Join(idx.dir, songLogFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := appendEvents(tmp, idx.songs.snapshot()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	idx.songLog.Close()
+	idx.songLog, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	return err
+}
+
+// mergeSegments calls fn for every posting of segs in hash order.
+func mergeSegments(segs []*segment, fn func(*posting) error) error {
+	h := make(cursorHeap, 0, len(segs))
+	for _, seg := range segs {
+		if seg.count > 0 {
+			h = append(h, &cursor{seg: seg, cur: seg.postingAt(0)})
+		}
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		c := h[0]
+		if err := fn(&c.cur); err != nil {
+			return err
+		}
+		c.pos++
+		if c.pos < c.seg.count {
+			c.cur = c.seg.postingAt(c.pos)
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+type cursor struct {
+	seg *segment
+	pos int
+	cur posting
+}
+
+type cursorHeap []*cursor
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return h[i].cur.hash < h[j].cur.hash }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(*cursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,305 @@
+package diskindex
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"shazam/internal/db"
+)
+
+// prints returns one fingerprint per hash, anchored a frame apart.
+func prints(hashes ...int32) []db.Fingerprint {
+	fps := make([]db.Fingerprint, len(hashes))
+	for i, h := range hashes {
+		fps[i] = db.Fingerprint{Hash: h, AnchorTime: float64(i) * 0.1, AnchorFreq: 440, TargetFreq: 880, TimeDelta: 0.2}
+	}
+	return fps
+}
+
+func openIndex(t *testing.T, dir string) *Index {
+	t.Helper()
+	idx, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+func addSong(t *testing.T, idx *Index, title string, fps []db.Fingerprint) uint {
+	t.Helper()
+	song := db.Song{Title: title, ConfigID: "test"}
+	if err := idx.AddSong(&song, fps); err != nil {
+		t.Fatal(err)
+	}
+	return song.ID
+}
+
+// hits returns the songs holding each of hashes, sorted.
+func hits(t *testing.T, idx *Index, hashes ...int32) map[int32][]uint {
+	t.Helper()
+	fps, err := idx.LookupHashes(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[int32][]uint)
+	for _, fp := range fps {
+		found[fp.Hash] = append(found[fp.Hash], fp.SongID)
+	}
+	for _, ids := range found {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return found
+}
+
+func checkHits(t *testing.T, idx *Index, want map[int32][]uint) {
+	t.Helper()
+	var hashes []int32
+	for h := range want {
+		hashes = append(hashes, h)
+	}
+	got := hits(t, idx, hashes...)
+	for h, ids := range want {
+		if len(ids) == 0 {
+			ids = nil
+		}
+		if !reflect.DeepEqual(got[h], ids) {
+			t.Errorf("hash %d is held by songs %v, want %v", h, got[h], ids)
+		}
+	}
+}
+
+func TestLookupAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	idx.MaxSegments = 0
+	a := addSong(t, idx, "a", prints(1, 2, 3))
+	b := addSong(t, idx, "b", prints(3, 4, -5))
+	c := addSong(t, idx, "c", prints(-5, 3, 6, 6))
+	if n := idx.Segments(); n != 3 {
+		t.Fatalf("%d segments after three songs, want 3", n)
+	}
+
+	want := map[int32][]uint{1: {a}, 2: {a}, 3: {a, b, c}, 4: {b}, -5: {b, c}, 6: {c, c}, 7: nil}
+	checkHits(t, idx, want)
+
+	found, err := idx.LookupHashesForSongs([]int32{3, -5}, []uint{c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("%d postings of song %d for hashes 3 and -5, want 2", len(found), c)
+	}
+	perSong, err := idx.HitsPerSong([]int32{3, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint]int{a: 1, b: 1, c: 3}; !reflect.DeepEqual(perSong, want) {
+		t.Errorf("hits per song %v, want %v", perSong, want)
+	}
+	songFps, err := idx.SongFingerprints([]uint{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := songFps[b]; len(got) != 3 || got[0].Hash != 3 || got[2].Hash != -5 {
+		t.Errorf("fingerprints of song %d are %+v, want hashes 3, 4, -5 in anchor order", b, got)
+	}
+
+	// Everything survives a reopen.
+	idx.Close()
+	idx = openIndex(t, dir)
+	checkHits(t, idx, want)
+	counts, err := idx.CountPerSong()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint]int{a: 3, b: 3, c: 4}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts after reopen %v, want %v", counts, want)
+	}
+}
+
+func TestReplaceAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	idx.MaxSegments = 0
+	a := addSong(t, idx, "a", prints(1, 2))
+	b := addSong(t, idx, "b", prints(2, 3))
+
+	replaced := db.Song{ID: a, Title: "a, remastered", ConfigID: "test"}
+	if err := idx.ReplaceSong(&replaced, prints(4, 5, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.DeleteSong(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.DeleteSong(b); err != db.ErrSongNotFound {
+		t.Errorf("deleting song %d twice: %v, want ErrSongNotFound", b, err)
+	}
+
+	// The old postings of a and all of b are tombstoned, not removed.
+	want := map[int32][]uint{1: nil, 2: {a}, 3: nil, 4: {a}, 5: {a}}
+	check := func(when string) {
+		t.Helper()
+		checkHits(t, idx, want)
+		songs, err := idx.ListSongs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(songs) != 1 || songs[0].ID != a || songs[0].Title != "a, remastered" {
+			t.Errorf("%s: songs %+v, want only the replaced song %d", when, songs, a)
+		}
+		counts, err := idx.CountPerSong()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[uint]int{a: 3}; !reflect.DeepEqual(counts, want) {
+			t.Errorf("%s: counts %v, want %v", when, counts, want)
+		}
+	}
+	check("before reopen")
+	idx.Close()
+	idx = openIndex(t, dir)
+	check("after reopen")
+}
+
+func TestAutomaticMerge(t *testing.T) {
+	idx := openIndex(t, t.TempDir())
+	idx.MaxSegments = 3
+	want := make(map[int32][]uint)
+	for i := range 10 {
+		h := int32(100 + i)
+		id := addSong(t, idx, "song", prints(h, 1))
+		want[h] = []uint{id}
+		want[1] = append(want[1], id)
+		if n := idx.Segments(); n > idx.MaxSegments {
+			t.Fatalf("%d segments after song %d, MaxSegments is %d", n, i+1, idx.MaxSegments)
+		}
+	}
+	checkHits(t, idx, want)
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	idx.MaxSegments = 0
+	a := addSong(t, idx, "a", prints(1, 2))
+	b := addSong(t, idx, "b", prints(2, 3))
+	c := addSong(t, idx, "c", prints(3, 4))
+	replaced := db.Song{ID: c, Title: "c", ConfigID: "test"}
+	if err := idx.ReplaceSong(&replaced, prints(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.DeleteSong(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idx.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.Segments(); n != 1 {
+		t.Fatalf("%d segments after Compact, want 1", n)
+	}
+	if count := idx.segments[0].count; count != 3 {
+		t.Errorf("merged segment holds %d postings, want the 3 live ones", count)
+	}
+	want := map[int32][]uint{1: {a}, 2: {a}, 3: nil, 4: nil, 5: {c}}
+	checkHits(t, idx, want)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("%d files in the index after Compact, want the manifest, song log and one segment", len(entries))
+	}
+
+	// The rewritten log still knows the deleted and replaced IDs were used.
+	idx.Close()
+	idx = openIndex(t, dir)
+	checkHits(t, idx, want)
+	if d := addSong(t, idx, "d", prints(6)); d <= c+1 {
+		t.Errorf("new song got ID %d, which may have been used before compaction", d)
+	}
+}
+
+func TestOpenTruncatesTornSongLog(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	a := addSong(t, idx, "a", prints(1))
+	idx.Close()
+
+	logPath := filepath.Join(dir, songLogFile)
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash partway through appending an event.
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"add","id":2,"song":{"ti`)
+	f.Close()
+
+	idx = openIndex(t, dir)
+	if after, err := os.Stat(logPath); err != nil || after.Size() != info.Size() {
+		t.Fatalf("song log is %d bytes after Open, want the %d before the torn write", after.Size(), info.Size())
+	}
+	b := addSong(t, idx, "b", prints(2))
+	idx.Close()
+
+	// The event appended after recovery is readable.
+	idx = openIndex(t, dir)
+	songs, err := idx.ListSongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 || songs[0].ID != a || songs[1].ID != b {
+		t.Errorf("songs %+v after recovery, want %d and %d", songs, a, b)
+	}
+	checkHits(t, idx, map[int32][]uint{1: {a}, 2: {b}})
+}
+
+func TestOpenRejectsCorruptSongLog(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	addSong(t, idx, "a", prints(1))
+	idx.Close()
+
+	logPath := filepath.Join(dir, songLogFile)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte("not json\n"), data...)
+	if err := os.WriteFile(logPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := Open(dir); err == nil {
+		idx.Close()
+		t.Error("opened a song log corrupted before its last event")
+	}
+}
+
+func TestOpenRemovesStrayFiles(t *testing.T) {
+	dir := t.TempDir()
+	idx := openIndex(t, dir)
+	a := addSong(t, idx, "a", prints(1))
+	idx.Close()
+
+	// Files written before a crash kept the manifest from naming them.
+	for _, name := range []string{"seg-99999999.dat", manifestFile + ".tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx = openIndex(t, dir)
+	for _, name := range []string{"seg-99999999.dat", manifestFile + ".tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", name, err)
+		}
+	}
+	checkHits(t, idx, map[int32][]uint{1: {a}})
+}
@@ -0,0 +1,97 @@
+package diskindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"shazam/internal/db"
+)
+
+// The play log is an append-only file with one JSON-encoded db.Play per
+// line. Plays are written once and never changed, so unlike the song log it
+// needs no ops and survives compaction untouched.
+const playLogFile = "plays.log"
+
+var _ db.PlayLog = (*Index)(nil)
+
+func (idx *Index) AddPlay(play *db.Play) error {
+	idx.playMu.Lock()
+	defer idx.playMu.Unlock()
+
+	path := filepath.Join(idx.dir, playLogFile)
+	if idx.nextPlayID == 0 {
+		plays, err := readPlayLog(path)
+		if err != nil {
+			return err
+		}
+		idx.nextPlayID = uint(len(plays)) + 1
+	}
+
+	stored := *play
+	stored.ID = idx.nextPlayID
+	if stored.DetectedAt.IsZero() {
+		stored.DetectedAt = time.Now()
+	}
+	line, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	idx.nextPlayID++
+	*play = stored
+	return nil
+}
+
+func (idx *Index) ListPlays(source string) ([]db.Play, error) {
+	idx.playMu.Lock()
+	defer idx.playMu.Unlock()
+
+	plays, err := readPlayLog(filepath.Join(idx.dir, playLogFile))
+	if err != nil {
+		return nil, err
+	}
+	matching := plays[:0]
+	for _, play := range plays {
+		if source == "" || play.Source == source {
+			matching = append(matching, play)
+		}
+	}
+	db.SortPlays(matching)
+	return matching, nil
+}
+
+func readPlayLog(path string) ([]db.Play, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var plays []db.Play
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var play db.Play
+		if err := json.Unmarshal(scanner.Bytes(), &play); err != nil {
+			return nil, fmt.Errorf("play log line %d: %w", line, err)
+		}
+		plays = append(plays, play)
+	}
+	return plays, scanner.Err()
+}
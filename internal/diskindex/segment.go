@@ -0,0 +1,168 @@
+package diskindex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// A segment file is a 16-byte header followed by fixed-width postings sorted
+// by hash, so a lookup is a binary search directly over the mapped bytes:
+//
+//	header:  magic [8]byte | count uint64
+//	posting: hash int32 | song uint32 | anchorTime, anchorFreq, targetFreq, timeDelta float64
+//
+// All integers and floats are little-endian.
+const (
+	segmentMagic = "SHZSEG01"
+	headerSize   = 16
+	postingSize  = 40
+)
+
+var errCorruptSegment = errors.New("corrupt segment")
+
+// posting is one fingerprint as stored on disk. song is the db.Song ID.
+type posting struct {
+	hash       int32
+	song       uint32
+	anchorTime float64
+	anchorFreq float64
+	targetFreq float64
+	timeDelta  float64
+}
+
+func (p *posting) encode(b []byte) {
+	binary.LittleEndian.PutUint32(b[0:], uint32(p.hash))
+	binary.LittleEndian.PutUint32(b[4:], p.song)
+	binary.LittleEndian.PutUint64(b[8:], math.Float64bits(p.anchorTime))
+	binary.LittleEndian.PutUint64(b[16:], math.Float64bits(p.anchorFreq))
+	binary.LittleEndian.PutUint64(b[24:], math.Float64bits(p.targetFreq))
+	binary.LittleEndian.PutUint64(b[32:], math.Float64bits(p.timeDelta))
+}
+
+func decodePosting(b []byte) posting {
+	return posting{
+		hash:       int32(binary.LittleEndian.Uint32(b[0:])),
+		song:       binary.LittleEndian.Uint32(b[4:]),
+		anchorTime: math.Float64frombits(binary.LittleEndian.Uint64(b[8:])),
+		anchorFreq: math.Float64frombits(binary.LittleEndian.Uint64(b[16:])),
+		targetFreq: math.Float64frombits(binary.LittleEndian.Uint64(b[24:])),
+		timeDelta:  math.Float64frombits(binary.LittleEndian.Uint64(b[32:])),
+	}
+}
+
+// segment is an open, read-only segment file.
+type segment struct {
+	name  string
+	data  []byte
+	count int
+	close func() error
+}
+
+func openSegment(path, name string) (*segment, error) {
+	data, closeFn, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize || string(data[:8]) != segmentMagic {
+		closeFn()
+		return nil, fmt.Errorf("%s: %w", name, errCorruptSegment)
+	}
+	count := binary.LittleEndian.Uint64(data[8:])
+	if uint64(len(data)) != headerSize+count*postingSize {
+		closeFn()
+		return nil, fmt.Errorf("%s: %w: size does not match %d postings", name, errCorruptSegment, count)
+	}
+	return &segment{name: name, data: data, count: int(count), close: closeFn}, nil
+}
+
+func (s *segment) hashAt(i int) int32 {
+	off := headerSize + i*postingSize
+	return int32(binary.LittleEndian.Uint32(s.data[off:]))
+}
+
+func (s *segment) postingAt(i int) posting {
+	off := headerSize + i*postingSize
+	return decodePosting(s.data[off : off+postingSize])
+}
+
+// find calls fn for every posting with the given hash.
+func (s *segment) find(hash int32, fn func(posting)) {
+	i := sort.Search(s.count, func(i int) bool { return s.hashAt(i) >= hash })
+	for ; i < s.count && s.hashAt(i) == hash; i++ {
+		fn(s.postingAt(i))
+	}
+}
+
+// segmentWriter streams postings, which must arrive in hash order, into a
+// new segment file. The header count is patched in by finish.
+type segmentWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	count uint64
+	buf   [postingSize]byte
+}
+
+func createSegment(path string) (*segmentWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sw := &segmentWriter{f: f, w: bufio.NewWriterSize(f, 1<<20)}
+	var header [headerSize]byte
+	copy(header[:], segmentMagic)
+	if _, err := sw.w.Write(header[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *segmentWriter) write(p *posting) error {
+	p.encode(sw.buf[:])
+	sw.count++
+	_, err := sw.w.Write(sw.buf[:])
+	return err
+}
+
+// finish flushes, patches the header, syncs and closes the file.
+func (sw *segmentWriter) finish() error {
+	if err := sw.w.Flush(); err != nil {
+		sw.f.Close()
+		return err
+	}
+	var count [8]byte
+	binary.LittleEndian.PutUint64(count[:], sw.count)
+	if _, err := sw.f.WriteAt(count[:], 8); err != nil {
+		sw.f.Close()
+		return err
+	}
+	if err := sw.f.Sync(); err != nil {
+		sw.f.Close()
+		return err
+	}
+	return sw.f.Close()
+}
+
+// abort discards a partially written segment.
+func (sw *segmentWriter) abort() {
+	sw.f.Close()
+	os.Remove(sw.f.Name())
+}
+
+func sortPostings(postings []posting) {
+	sort.Slice(postings, func(i, j int) bool {
+		a, b := &postings[i], &postings[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		if a.song != b.song {
+			return a.song < b.song
+		}
+		return a.anchorTime < b.anchorTime
+	})
+}
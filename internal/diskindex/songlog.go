@@ -0,0 +1,194 @@
+package diskindex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"shazam/internal/db"
+)
+
+// The song log is an append-only file of JSON events holding the song
+// metadata. Postings refer to songs by a posting key, which is the song ID
+// until the song is replaced. Deleting a song only appends a tombstone; its
+// postings are skipped on lookup and dropped by Compact. Replacing a song
+// writes the new postings under a fresh key and then appends a replace
+// event moving the song to that key, so the old postings die and the new
+// ones come alive in the same write.
+const (
+	opAdd     = "add"
+	opReplace = "replace"
+	opDelete  = "delete"
+	opNextID  = "next_id" // written by compaction so deleted IDs are never reused
+)
+
+type songEvent struct {
+	Op   string   `json:"op"`
+	ID   uint32   `json:"id"`
+	Key  uint32   `json:"key,omitempty"` // posting key, if not ID
+	Song *db.Song `json:"song,omitempty"`
+}
+
+// songTable is the in-memory state rebuilt from the song log. IDs and
+// posting keys are drawn from the same counter, so a key never belongs to
+// two songs.
+type songTable struct {
+	live   map[uint32]db.Song
+	keys   map[uint32]uint32 // song ID to posting key
+	owners map[uint32]uint32 // posting key to song ID
+	nextID uint32
+}
+
+func newSongTable() *songTable {
+	return &songTable{
+		live:   make(map[uint32]db.Song),
+		keys:   make(map[uint32]uint32),
+		owners: make(map[uint32]uint32),
+		nextID: 1,
+	}
+}
+
+// owner returns the live song whose postings are stored under key.
+func (t *songTable) owner(key uint32) (uint32, bool) {
+	id, ok := t.owners[key]
+	return id, ok
+}
+
+// forget drops the posting key of song id.
+func (t *songTable) forget(id uint32) {
+	if key, ok := t.keys[id]; ok {
+		delete(t.owners, key)
+		delete(t.keys, id)
+	}
+}
+
+func (t *songTable) apply(ev songEvent) error {
+	switch ev.Op {
+	case opAdd, opReplace:
+		if ev.Song == nil {
+			return fmt.Errorf("%s event for song %d has no metadata", ev.Op, ev.ID)
+		}
+		key := ev.Key
+		if key == 0 {
+			key = ev.ID
+		}
+		t.forget(ev.ID)
+		t.live[ev.ID] = *ev.Song
+		t.keys[ev.ID] = key
+		t.owners[key] = ev.ID
+		t.nextID = max(t.nextID, ev.ID+1, key+1)
+	case opDelete:
+		delete(t.live, ev.ID)
+		t.forget(ev.ID)
+	case opNextID:
+		if ev.ID > t.nextID {
+			t.nextID = ev.ID
+		}
+	default:
+		return fmt.Errorf("unknown song log op %q", ev.Op)
+	}
+	return nil
+}
+
+// snapshot returns the events that recreate the live songs, used to rewrite
+// the log during compaction.
+func (t *songTable) snapshot() []songEvent {
+	events := make([]songEvent, 0, len(t.live)+1)
+	events = append(events, songEvent{Op: opNextID, ID: t.nextID})
+	for id, song := range t.live {
+		song := song
+		ev := songEvent{Op: opAdd, ID: id, Song: &song}
+		if key := t.keys[id]; key != id {
+			ev.Key = key
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// readSongLog replays the song log at path. It also returns the length of
+// the log up to the end of its last complete event, which is less than the
+// file size after a torn write.
+func readSongLog(path string) (*songTable, int64, error) {
+	table := newSongTable()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return table, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	var valid int64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Every event ends in a newline, so anything after the
+			// last one is a torn final write.
+			return table, valid, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var ev songEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			// A torn final write from a crash is ignored; anything
+			// earlier is real corruption.
+			if _, err := r.Peek(1); err == io.EOF {
+				return table, valid, nil
+			}
+			return nil, 0, fmt.Errorf("song log line %d: %w", line, err)
+		}
+		if err := table.apply(ev); err != nil {
+			return nil, 0, fmt.Errorf("song log line %d: %w", line, err)
+		}
+		valid += int64(len(data))
+	}
+}
+
+// openSongLog opens the song log for appending, first cutting off whatever
+// follows the valid events so new ones do not land on a torn line.
+func openSongLog(path string, valid int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != valid {
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// appendEvents writes events to the log and syncs it.
+func appendEvents(f *os.File, events []songEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,131 @@
+package fingerprint
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// FingerprintConfig holds every parameter that influences the fingerprints
+// produced by the pipeline. Two fingerprints are only comparable when they
+// were produced under configs with the same ID.
+type FingerprintConfig struct {
+	// SampleRate is the expected audio sample rate (Hz).
+	SampleRate int `yaml:"sample_rate" toml:"sample_rate"`
+	// WindowSize is the number of samples per analysis frame. Must be a power of two.
+	WindowSize int `yaml:"window_size" toml:"window_size"`
+	// HopSize is the number of samples to advance for each frame (overlap = WindowSize - HopSize).
+	HopSize int `yaml:"hop_size" toml:"hop_size"`
+	// LowpassCutoff is the cutoff frequency (Hz) of the filter applied before analysis.
+	LowpassCutoff float64 `yaml:"lowpass_cutoff" toml:"lowpass_cutoff"`
+
+	// PeakNeighborhoodSize is the side length of the time/frequency square a peak must dominate.
+	PeakNeighborhoodSize int `yaml:"peak_neighborhood_size" toml:"peak_neighborhood_size"`
+	// PeakTargetDensity is the number of peaks kept per SecondsPerChunk of audio.
+	PeakTargetDensity int `yaml:"peak_target_density" toml:"peak_target_density"`
+	// SecondsPerChunk is the length of the chunks peaks are thinned over.
+	SecondsPerChunk float64 `yaml:"seconds_per_chunk" toml:"seconds_per_chunk"`
+
+	// FanOut is the number of target peaks paired with each anchor peak.
+	FanOut int `yaml:"fan_out" toml:"fan_out"`
+	// DeltaTMin and DeltaTMax bound the time (seconds) between anchor and target peaks.
+	DeltaTMin float64 `yaml:"delta_t_min" toml:"delta_t_min"`
+	DeltaTMax float64 `yaml:"delta_t_max" toml:"delta_t_max"`
+
+	// HashMode selects how peaks are hashed: HashModePairs (the default,
+	// also when empty) or HashModeRatio.
+	HashMode string `yaml:"hash_mode" toml:"hash_mode"`
+}
+
+// Hash modes. Pair hashes encode absolute frequencies and delta times and
+// only match audio played at its original speed and pitch. Ratio hashes
+// encode frequency and time ratios within peak triplets, which survive
+// time-stretching and pitch-shifting, at the cost of more collisions. Low
+// frequency ratios are only as precise as the FFT bins, so ratio hashes
+// benefit from a larger WindowSize.
+const (
+	HashModePairs = "pairs"
+	HashModeRatio = "ratio"
+)
+
+// RatioHashes reports whether c produces ratio hashes.
+func (c FingerprintConfig) RatioHashes() bool {
+	return c.HashMode == HashModeRatio
+}
+
+// DefaultConfig returns the configuration used when none is supplied.
+func DefaultConfig() FingerprintConfig {
+	return FingerprintConfig{
+		SampleRate:           SampleRate,
+		WindowSize:           WindowSize,
+		HopSize:              HopSize,
+		LowpassCutoff:        LowpassCutoff,
+		PeakNeighborhoodSize: PEAK_NEIGHBORHOOD_SIZE,
+		PeakTargetDensity:    PEAK_TARGET_DENSITY,
+		SecondsPerChunk:      SECONDS_PER_CHUNK,
+		FanOut:               FAN_OUT,
+		DeltaTMin:            DeltaTMin,
+		DeltaTMax:            DeltaTMax,
+	}
+}
+
+// Validate reports the first parameter that would make the pipeline produce
+// meaningless or no output.
+func (c FingerprintConfig) Validate() error {
+	switch {
+	case c.SampleRate <= 0:
+		return fmt.Errorf("sample rate must be positive, got %d", c.SampleRate)
+	case c.WindowSize < 2 || c.WindowSize&(c.WindowSize-1) != 0:
+		return fmt.Errorf("window size must be a power of two, got %d", c.WindowSize)
+	case c.HopSize <= 0 || c.HopSize > c.WindowSize:
+		return fmt.Errorf("hop size must be in (0, %d], got %d", c.WindowSize, c.HopSize)
+	case c.LowpassCutoff <= 0 || c.LowpassCutoff >= float64(c.SampleRate)/2:
+		return fmt.Errorf("lowpass cutoff must be in (0, %d) Hz, got %g", c.SampleRate/2, c.LowpassCutoff)
+	case c.PeakNeighborhoodSize < 1 || c.PeakNeighborhoodSize%2 == 0:
+		return fmt.Errorf("peak neighborhood size must be a positive odd number, got %d", c.PeakNeighborhoodSize)
+	case c.PeakTargetDensity <= 0:
+		return fmt.Errorf("peak target density must be positive, got %d", c.PeakTargetDensity)
+	case c.SecondsPerChunk <= 0:
+		return fmt.Errorf("seconds per chunk must be positive, got %g", c.SecondsPerChunk)
+	case c.FanOut <= 0:
+		return fmt.Errorf("fan out must be positive, got %d", c.FanOut)
+	case c.DeltaTMin < 0 || c.DeltaTMax <= c.DeltaTMin:
+		return errors.New("delta time bounds must satisfy 0 <= DeltaTMin < DeltaTMax")
+	case c.HashMode != "" && c.HashMode != HashModePairs && c.HashMode != HashModeRatio:
+		return fmt.Errorf("hash mode must be %q or %q, got %q", HashModePairs, HashModeRatio, c.HashMode)
+	case c.RatioHashes() && c.FanOut < 2:
+		return fmt.Errorf("ratio hashes need a fan out of at least 2, got %d", c.FanOut)
+	}
+	return nil
+}
+
+// ID returns a short identifier derived from every parameter of the config.
+// It is stored with each song so the matcher can refuse to compare
+// fingerprints produced under different settings.
+func (c FingerprintConfig) ID() string {
+	canonical := fmt.Sprintf("sr=%d;win=%d;hop=%d;lp=%g;nbh=%d;density=%d;chunk=%g;fan=%d;dtmin=%g;dtmax=%g",
+		c.SampleRate, c.WindowSize, c.HopSize, c.LowpassCutoff,
+		c.PeakNeighborhoodSize, c.PeakTargetDensity, c.SecondsPerChunk,
+		c.FanOut, c.DeltaTMin, c.DeltaTMax)
+	// Pair hashes predate the mode, so only other modes are named and the
+	// IDs of existing catalogs stay valid.
+	if c.RatioHashes() {
+		canonical += ";mode=" + c.HashMode
+	}
+	sum := sha1.Sum([]byte(canonical))
+	// The prefix versions the algorithm itself: fp2 orders peaks that share
+	// a frame by frequency, which changes which targets each anchor pairs
+	// with.
+	return "fp2-" + hex.EncodeToString(sum[:6])
+}
+
+// FramesPerSecond is the number of spectrogram frames per second of audio.
+func (c FingerprintConfig) FramesPerSecond() float64 {
+	return float64(c.SampleRate) / float64(c.HopSize)
+}
+
+// BinHz is the width of one spectrogram bin in Hz.
+func (c FingerprintConfig) BinHz() float64 {
+	return float64(c.SampleRate) / float64(c.WindowSize)
+}
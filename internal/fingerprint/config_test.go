@@ -0,0 +1,85 @@
+package fingerprint
+
+import "testing"
+
+func TestConfigIDStable(t *testing.T) {
+	// Songs are stored with these IDs, so a change to how the ID is derived
+	// orphans every existing catalog. Bump the fp prefix deliberately when
+	// the fingerprints themselves change, and update the IDs here.
+	cfg := DefaultConfig()
+	if id := cfg.ID(); id != "fp2-1f4e5ed53cc3" {
+		t.Errorf("default config ID is %s, want fp2-1f4e5ed53cc3", id)
+	}
+	cfg.HashMode = HashModeRatio
+	if id := cfg.ID(); id != "fp2-f44aa39a17ba" {
+		t.Errorf("ratio config ID is %s, want fp2-f44aa39a17ba", id)
+	}
+
+	// Pair hashes are the default whether or not the mode is spelled out.
+	pairs := DefaultConfig()
+	pairs.HashMode = HashModePairs
+	if pairs.ID() != DefaultConfig().ID() {
+		t.Errorf("explicit pair mode has ID %s, the default %s", pairs.ID(), DefaultConfig().ID())
+	}
+}
+
+func TestConfigIDCoversEveryParameter(t *testing.T) {
+	changes := map[string]func(*FingerprintConfig){
+		"sample rate":            func(c *FingerprintConfig) { c.SampleRate = 22050 },
+		"window size":            func(c *FingerprintConfig) { c.WindowSize *= 2 },
+		"hop size":               func(c *FingerprintConfig) { c.HopSize /= 2 },
+		"lowpass cutoff":         func(c *FingerprintConfig) { c.LowpassCutoff += 0.5 },
+		"peak neighborhood size": func(c *FingerprintConfig) { c.PeakNeighborhoodSize += 2 },
+		"peak target density":    func(c *FingerprintConfig) { c.PeakTargetDensity++ },
+		"seconds per chunk":      func(c *FingerprintConfig) { c.SecondsPerChunk *= 2 },
+		"fan out":                func(c *FingerprintConfig) { c.FanOut++ },
+		"delta t min":            func(c *FingerprintConfig) { c.DeltaTMin += 0.01 },
+		"delta t max":            func(c *FingerprintConfig) { c.DeltaTMax += 0.01 },
+		"hash mode":              func(c *FingerprintConfig) { c.HashMode = HashModeRatio },
+	}
+	seen := map[string]string{DefaultConfig().ID(): "default"}
+	for name, change := range changes {
+		cfg := DefaultConfig()
+		change(&cfg)
+		id := cfg.ID()
+		if other, ok := seen[id]; ok {
+			t.Errorf("changing the %s gives ID %s, the same as %s", name, id, other)
+		}
+		seen[id] = name
+		if cfg.ID() != id {
+			t.Errorf("ID of the config with another %s is not deterministic", name)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, mode := range []string{"", HashModePairs, HashModeRatio} {
+		cfg := DefaultConfig()
+		cfg.HashMode = mode
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("default config with hash mode %q: %v", mode, err)
+		}
+	}
+	bad := map[string]func(*FingerprintConfig){
+		"zero sample rate":          func(c *FingerprintConfig) { c.SampleRate = 0 },
+		"window not a power of two": func(c *FingerprintConfig) { c.WindowSize = 3000 },
+		"hop past window":           func(c *FingerprintConfig) { c.HopSize = c.WindowSize + 1 },
+		"zero hop":                  func(c *FingerprintConfig) { c.HopSize = 0 },
+		"cutoff at nyquist":         func(c *FingerprintConfig) { c.LowpassCutoff = float64(c.SampleRate) / 2 },
+		"even neighborhood":         func(c *FingerprintConfig) { c.PeakNeighborhoodSize = 4 },
+		"zero density":              func(c *FingerprintConfig) { c.PeakTargetDensity = 0 },
+		"zero chunk":                func(c *FingerprintConfig) { c.SecondsPerChunk = 0 },
+		"zero fan out":              func(c *FingerprintConfig) { c.FanOut = 0 },
+		"inverted delta bounds":     func(c *FingerprintConfig) { c.DeltaTMin, c.DeltaTMax = 2, 1 },
+		"negative delta min":        func(c *FingerprintConfig) { c.DeltaTMin = -1 },
+		"unknown hash mode":         func(c *FingerprintConfig) { c.HashMode = "triplets" },
+		"ratio with fan out 1":      func(c *FingerprintConfig) { c.HashMode, c.FanOut = HashModeRatio, 1 },
+	}
+	for name, change := range bad {
+		cfg := DefaultConfig()
+		change(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package fingerprint
 
 import (
+	"fmt"
 	"math"
+	"math/cmplx"
 )
 
 func FFT(x []complex128) []complex128 {
@@ -32,3 +34,141 @@ func FFT(x []complex128) []complex128 {
 	}
 	return result
 }
+
+// FFTPlan is a precomputed radix-2 transform of a fixed size. The twiddle
+// factors and bit-reversal permutation are computed once in NewFFTPlan so
+// that Transform and RealTransform run in place without allocating.
+//
+// A plan owns a scratch buffer and is therefore not safe for concurrent use;
+// create one plan per goroutine.
+type FFTPlan struct {
+	n        int
+	twiddles []complex128 // twiddles[k] = exp(-2πik/n), k < n/2
+	rev      []int        // bit-reversed index for every position
+
+	half   *FFTPlan     // n/2-point plan used by RealTransform
+	packed []complex128 // n/2 scratch used by RealTransform
+	realTw []complex128 // exp(-2πik/n), k <= n/2, used to split the packed spectrum
+}
+
+// NewFFTPlan builds a plan for n-point transforms. n must be a power of two.
+func NewFFTPlan(n int) (*FFTPlan, error) {
+	p, err := newComplexPlan(n)
+	if err != nil {
+		return nil, err
+	}
+	if n >= 2 {
+		p.half, _ = newComplexPlan(n / 2)
+		p.packed = make([]complex128, n/2)
+		p.realTw = make([]complex128, n/2+1)
+		for k := range p.realTw {
+			angle := -2 * math.Pi * float64(k) / float64(n)
+			p.realTw[k] = complex(math.Cos(angle), math.Sin(angle))
+		}
+	}
+	return p, nil
+}
+
+func newComplexPlan(n int) (*FFTPlan, error) {
+	if n <= 0 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("fft size %d is not a power of two", n)
+	}
+
+	bits := 0
+	for 1<<bits < n {
+		bits++
+	}
+
+	p := &FFTPlan{
+		n:        n,
+		twiddles: make([]complex128, n/2),
+		rev:      make([]int, n),
+	}
+	for k := range p.twiddles {
+		angle := -2 * math.Pi * float64(k) / float64(n)
+		p.twiddles[k] = complex(math.Cos(angle), math.Sin(angle))
+	}
+	for i := range p.rev {
+		r := 0
+		for b := 0; b < bits; b++ {
+			if i&(1<<b) != 0 {
+				r |= 1 << (bits - 1 - b)
+			}
+		}
+		p.rev[i] = r
+	}
+	return p, nil
+}
+
+// Size returns the transform length of the plan.
+func (p *FFTPlan) Size() int {
+	return p.n
+}
+
+// Transform computes the forward DFT of x in place. len(x) must equal Size().
+func (p *FFTPlan) Transform(x []complex128) {
+	n := p.n
+	if len(x) != n {
+		panic(fmt.Sprintf("fft: input length %d does not match plan size %d", len(x), n))
+	}
+
+	for i, r := range p.rev {
+		if i < r {
+			x[i], x[r] = x[r], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size >> 1
+		step := n / size
+		for start := 0; start < n; start += size {
+			for k := 0; k < half; k++ {
+				t := p.twiddles[k*step] * x[start+k+half]
+				u := x[start+k]
+				x[start+k] = u + t
+				x[start+k+half] = u - t
+			}
+		}
+	}
+}
+
+// RealTransform computes the DFT of the real signal in and writes the first
+// len(out) bins to out. len(in) must equal Size() and len(out) must not
+// exceed it.
+//
+// The input is packed into an n/2-point complex transform and the spectrum is
+// recovered using Hermitian symmetry, roughly halving the work of Transform.
+// Bins above n/2 are filled with the conjugate mirror of the lower half.
+func (p *FFTPlan) RealTransform(in []float64, out []complex128) {
+	n := p.n
+	if len(in) != n {
+		panic(fmt.Sprintf("fft: input length %d does not match plan size %d", len(in), n))
+	}
+	if len(out) > n {
+		panic(fmt.Sprintf("fft: output length %d exceeds plan size %d", len(out), n))
+	}
+	if n == 1 {
+		if len(out) > 0 {
+			out[0] = complex(in[0], 0)
+		}
+		return
+	}
+
+	h := n / 2
+	z := p.packed
+	for i := 0; i < h; i++ {
+		z[i] = complex(in[2*i], in[2*i+1])
+	}
+	p.half.Transform(z)
+
+	for k := 0; k <= h && k < len(out); k++ {
+		zk := z[k%h]
+		zc := cmplx.Conj(z[(h-k)%h])
+		even := (zk + zc) / 2
+		odd := (zk - zc) / complex(0, 2)
+		out[k] = even + p.realTw[k]*odd
+	}
+	for k := h + 1; k < len(out); k++ {
+		out[k] = cmplx.Conj(out[n-k])
+	}
+}
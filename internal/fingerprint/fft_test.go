@@ -0,0 +1,124 @@
+package fingerprint
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// fftTolerance bounds the difference from FFT relative to the largest bin.
+const fftTolerance = 1e-9
+
+func randomSignal(rng *rand.Rand, n int) []float64 {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = rng.Float64()*2 - 1
+	}
+	return x
+}
+
+func toComplex(x []float64) []complex128 {
+	c := make([]complex128, len(x))
+	for i, v := range x {
+		c[i] = complex(v, 0)
+	}
+	return c
+}
+
+func maxAbs(x []complex128) float64 {
+	m := 0.0
+	for _, v := range x {
+		m = math.Max(m, cmplx.Abs(v))
+	}
+	return m
+}
+
+func checkSpectrum(t *testing.T, name string, got, want []complex128) {
+	t.Helper()
+	scale := math.Max(1, maxAbs(want))
+	for k := range got {
+		if d := cmplx.Abs(got[k] - want[k]); d > fftTolerance*scale {
+			t.Fatalf("%s: bin %d is %v, FFT gives %v (off by %g)", name, k, got[k], want[k], d)
+		}
+	}
+}
+
+func TestFFTPlanMatchesFFT(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 4, 8, 64, 512, 4096} {
+		plan, err := NewFFTPlan(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signal := randomSignal(rng, n)
+		want := FFT(toComplex(signal))
+
+		// A complex input exercises the butterflies with both parts set.
+		complexIn := make([]complex128, n)
+		for i := range complexIn {
+			complexIn[i] = complex(rng.Float64()-0.5, rng.Float64()-0.5)
+		}
+		wantComplex := FFT(complexIn)
+		plan.Transform(complexIn)
+		checkSpectrum(t, "Transform", complexIn, wantComplex)
+
+		full := make([]complex128, n)
+		plan.RealTransform(signal, full)
+		checkSpectrum(t, "RealTransform", full, want)
+
+		// Only the requested bins are written.
+		lower := make([]complex128, n/2+1)
+		if n == 1 {
+			lower = lower[:1]
+		}
+		plan.RealTransform(signal, lower)
+		checkSpectrum(t, "RealTransform lower half", lower, want[:len(lower)])
+	}
+}
+
+func TestNewFFTPlanRejectsSizes(t *testing.T) {
+	for _, n := range []int{0, -4, 3, 1000} {
+		if _, err := NewFFTPlan(n); err == nil {
+			t.Errorf("NewFFTPlan(%d) succeeded, want an error", n)
+		}
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	signal := toComplex(randomSignal(rand.New(rand.NewSource(1)), WindowSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FFT(signal)
+	}
+}
+
+func BenchmarkFFTPlan(b *testing.B) {
+	plan, err := NewFFTPlan(WindowSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signal := toComplex(randomSignal(rand.New(rand.NewSource(1)), WindowSize))
+	x := make([]complex128, WindowSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(x, signal)
+		plan.Transform(x)
+	}
+}
+
+func BenchmarkFFTPlanReal(b *testing.B) {
+	plan, err := NewFFTPlan(WindowSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signal := randomSignal(rand.New(rand.NewSource(1)), WindowSize)
+	out := make([]complex128, WindowSize/2+1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan.RealTransform(signal, out)
+	}
+}
@@ -2,14 +2,19 @@ package fingerprint
 
 import (
 	"fmt"
+	"log"
 	"math"
+	"shazam/internal/audio"
 	"shazam/internal/db"
 	"time"
 )
 
-// frameSize: Number of audio samples per analysis frame. Larger values improve frequency resolution, but reduce time resolution.
-// hopSize: Number of samples to advance for each frame (overlap = frameSize - hopSize).
-// sampleRate: Expected audio sample rate (Hz).
+// Default values for FingerprintConfig; see the field docs there.
+//
+// WindowSize: Number of audio samples per analysis frame. Larger values improve frequency resolution, but reduce time resolution.
+// HopSize: Number of samples to advance for each frame (overlap = WindowSize - HopSize).
+// SampleRate: Expected audio sample rate (Hz).
+// LowpassCutoff: Cutoff frequency (Hz) applied before the spectrogram.
 // window: Window size for local peak detection in the spectrogram.
 // threshold: Minimum dB value for a point to be considered as a peak.
 // maxPeaks: Maximum number of peaks to detect per frame.
@@ -23,6 +28,7 @@ const (
 	DeltaTMin                   = 0.1
 	DeltaTMax                   = 2.0
 	DeltaFMax                   = 1000.0
+	LowpassCutoff               = 1000.0
 )
 
 var FREQ_BANDS = [][]float64{
@@ -40,31 +46,47 @@ type Peak struct {
 	Amp  float64
 }
 
-func Fingerprint(data *[]float64, fileName string) []db.Fingerprint {
-	start := time.Now().Nanosecond()
+// FingerprintAudio mixes buf down to mono, resamples it to cfg.SampleRate and
+// fingerprints it, so audio is always analysed at the same rate whatever it
+// was recorded at.
+func FingerprintAudio(buf *audio.Buffer, songID uint, cfg FingerprintConfig) ([]db.Fingerprint, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint config: %w", err)
+	}
+	mono, err := buf.Normalize(cfg.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return Fingerprint(&mono.Data, songID, cfg)
+}
+
+// Fingerprint fingerprints mono samples that are already at cfg.SampleRate.
+func Fingerprint(data *[]float64, songID uint, cfg FingerprintConfig) ([]db.Fingerprint, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint config: %w", err)
+	}
+	start := time.Now()
 
 	var PEAKS []Peak
 
-	fmt.Printf("LENGTH OF DATA : %v\n", len(*data))
-	lpData := LowpassFilter(*data, 1000, SampleRate)
-	spectrogram := Spectrogram(lpData)
-	fmt.Printf("LENGTH OF SPECTROGRAM : %v\n", len(spectrogram))
+	if len(*data) == 0 {
+		return nil, nil
+	}
+	lpData := LowpassFilter(*data, cfg.LowpassCutoff, float64(cfg.SampleRate))
+	spectrogram, err := Spectrogram(lpData, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	peaks := ExtractRobustPeaks(spectrogram, fileName)
+	peaks := ExtractRobustPeaks(spectrogram, songID, cfg)
 
 	PEAKS = append(PEAKS, peaks...)
-	fmt.Printf("LENGTH OF PEAKS : %v\n", len(PEAKS))
 
-	pairs := FindPeakRelationships(PEAKS, fileName)
-	fmt.Printf("LENGTH OF PEAK PAIRS %v\n", len(pairs))
-	end := time.Now().Nanosecond()
+	pairs := FindPeakRelationships(PEAKS, songID, cfg)
+	log.Printf("Fingerprinted %d samples (%d frames, %d peaks, %d pairs) in %v.\n",
+		len(*data), len(spectrogram), len(PEAKS), len(pairs), time.Since(start))
 
-	timeto := end - start
-	fmt.Printf("END : %v\n", end)
-	fmt.Printf("START : %v\n", start)
-	fmt.Printf("TIME TO READ : %v\n", timeto)
-
-	return pairs
+	return pairs, nil
 
 }
 func NormalizeInt16Array(samples []int) []float64 {
@@ -83,9 +105,7 @@ func NormalizeInt16(sample int) float64 {
 
 func LowpassFilter(sample []float64, cutoffFreq, samplerate float64) []float64 {
 	res := make([]float64, len(sample))
-	rc := 1 / (2 * math.Pi * cutoffFreq)
-	dt := 1 / samplerate
-	a := dt / (rc + dt)
+	a := lowpassCoefficient(cutoffFreq, samplerate)
 	res[0] = a * sample[0]
 	for i := 1; i < len(sample); i++ {
 		res[i] = a*sample[i] + (1-a)*sample[i-1]
@@ -95,3 +115,9 @@ func LowpassFilter(sample []float64, cutoffFreq, samplerate float64) []float64 {
 	return res
 
 }
+
+func lowpassCoefficient(cutoffFreq, samplerate float64) float64 {
+	rc := 1 / (2 * math.Pi * cutoffFreq)
+	dt := 1 / samplerate
+	return dt / (rc + dt)
+}
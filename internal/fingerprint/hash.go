@@ -0,0 +1,77 @@
+package fingerprint
+
+import "math"
+
+// A fingerprint hash packs the anchor frequency bin, target frequency bin and
+// anchor-to-target distance in frames into 32 bits:
+//
+//	bits 31..21  anchor frequency bin (HashFreqBits)
+//	bits 20..10  target frequency bin (HashFreqBits)
+//	bits  9..0   delta time in frames (HashDeltaBits)
+//
+// Values wider than their field are masked, so hashes stay well defined for
+// any config; the defaults never exceed them.
+const (
+	HashFreqBits  = 11
+	HashDeltaBits = 10
+
+	hashFreqMask  = 1<<HashFreqBits - 1
+	hashDeltaMask = 1<<HashDeltaBits - 1
+)
+
+// PackHash combines the quantized components of a peak pair into a hash. The
+// result is the uint32 bit pattern reinterpreted as int32 so it fits a
+// Postgres integer column.
+func PackHash(anchorBin, targetBin, deltaFrames int) int32 {
+	h := uint32(anchorBin&hashFreqMask)<<(HashFreqBits+HashDeltaBits) |
+		uint32(targetBin&hashFreqMask)<<HashDeltaBits |
+		uint32(deltaFrames&hashDeltaMask)
+	return int32(h)
+}
+
+// A ratio hash describes a peak triplet (anchor a, targets b and c, with b no
+// later than c) by quantities that do not change when the audio is sped up,
+// slowed down or pitch-shifted:
+//
+//	bits 19..16  (tb-ta)/(tc-ta), in 1/16 steps (RatioTimeBits)
+//	bits 15..8   log2(fb/fa), in 1/24 octave steps (RatioFreqBits)
+//	bits  7..0   log2(fc/fa), in 1/24 octave steps (RatioFreqBits)
+//
+// Peak times are whole frames and triplets span only a few of them, so the
+// time ratio is kept coarse. Frequency ratios beyond RatioFreqRange octaves
+// are clamped.
+const (
+	RatioTimeBits  = 4
+	RatioFreqBits  = 8
+	RatioFreqSteps = 24 // per octave
+	RatioFreqRange = 5  // octaves either way
+
+	ratioFreqOffset = 1 << (RatioFreqBits - 1)
+)
+
+// PackRatioHash combines the time ratio (in (0, 1]) and the two frequency
+// ratios of a peak triplet into a hash.
+func PackRatioHash(timeRatio, freqRatioB, freqRatioC float64) int32 {
+	timeLevels := 1 << RatioTimeBits
+	t := min(int(timeRatio*float64(timeLevels)), timeLevels-1)
+	h := uint32(t)<<(2*RatioFreqBits) |
+		uint32(quantizeFreqRatio(freqRatioB))<<RatioFreqBits |
+		uint32(quantizeFreqRatio(freqRatioC))
+	return int32(h)
+}
+
+func quantizeFreqRatio(ratio float64) int {
+	// Clamp before converting so a zero ratio (-Inf) stays well defined.
+	limit := float64(RatioFreqRange * RatioFreqSteps)
+	steps := max(-limit, min(limit, math.Round(math.Log2(ratio)*RatioFreqSteps)))
+	return int(steps) + ratioFreqOffset
+}
+
+// UnpackHash splits a hash produced by PackHash back into its components.
+func UnpackHash(hash int32) (anchorBin, targetBin, deltaFrames int) {
+	h := uint32(hash)
+	anchorBin = int(h >> (HashFreqBits + HashDeltaBits) & hashFreqMask)
+	targetBin = int(h >> HashDeltaBits & hashFreqMask)
+	deltaFrames = int(h & hashDeltaMask)
+	return anchorBin, targetBin, deltaFrames
+}
@@ -0,0 +1,103 @@
+package fingerprint
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestPackHashRoundTrip(t *testing.T) {
+	const maxFreq, maxDelta = hashFreqMask, hashDeltaMask
+	cases := [][3]int{
+		{0, 0, 0},
+		{1, 1, 1},
+		{maxFreq, 0, 0},
+		{0, maxFreq, 0},
+		{0, 0, maxDelta},
+		{maxFreq, maxFreq, maxDelta},
+		{maxFreq - 1, 1, maxDelta - 1},
+		// The top anchor bit is the int32 sign bit.
+		{1 << (HashFreqBits - 1), 0, 0},
+		{1<<(HashFreqBits-1) - 1, maxFreq, maxDelta},
+		{372, 1021, 17},
+	}
+	for _, c := range cases {
+		hash := PackHash(c[0], c[1], c[2])
+		a, b, d := UnpackHash(hash)
+		if a != c[0] || b != c[1] || d != c[2] {
+			t.Errorf("UnpackHash(PackHash%v) = (%d, %d, %d)", c, a, b, d)
+		}
+	}
+
+	if hash := PackHash(1<<(HashFreqBits-1), 0, 0); hash >= 0 {
+		t.Errorf("hash with the top bit set is %d, want it negative", hash)
+	}
+	if got, want := PackHash(maxFreq, maxFreq, maxDelta), int32(-1); got != want {
+		t.Errorf("all fields at their maximum pack to %d, want %d", got, want)
+	}
+}
+
+func TestPackHashMasksWideValues(t *testing.T) {
+	// A value one past its field wraps to zero rather than spilling into
+	// the neighbouring field.
+	if got, want := PackHash(hashFreqMask+1, 5, 7), PackHash(0, 5, 7); got != want {
+		t.Errorf("wide anchor bin packs to %d, want %d", got, want)
+	}
+	if got, want := PackHash(3, hashFreqMask+1, 7), PackHash(3, 0, 7); got != want {
+		t.Errorf("wide target bin packs to %d, want %d", got, want)
+	}
+	if got, want := PackHash(3, 5, hashDeltaMask+1), PackHash(3, 5, 0); got != want {
+		t.Errorf("wide delta packs to %d, want %d", got, want)
+	}
+}
+
+// BenchmarkHashIndex compares an in-memory index keyed by the legacy
+// 40-character hex SHA-1 hashes with one keyed by packed hashes. It reports
+// the bytes each key takes and times the lookup of a clip's worth of hashes.
+// See BenchmarkHashColumn in the db package for the Postgres equivalent.
+func BenchmarkHashIndex(b *testing.B) {
+	const rows, queryHashes = 200000, 1200
+	rng := rand.New(rand.NewSource(1))
+	packed := make([]int32, rows)
+	hexes := make([]string, rows)
+	for i := range packed {
+		a, t, d := rng.Intn(hashFreqMask+1), rng.Intn(hashFreqMask+1), rng.Intn(hashDeltaMask+1)
+		packed[i] = PackHash(a, t, d)
+		sum := sha1.Sum([]byte(fmt.Sprintf("%d|%d|%d", a, t, d)))
+		hexes[i] = hex.EncodeToString(sum[:])
+	}
+
+	b.Run("hex", func(b *testing.B) {
+		index := make(map[string][]int, rows)
+		for i, h := range hexes {
+			index[h] = append(index[h], i)
+		}
+		b.ResetTimer()
+		hits := 0
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < queryHashes; j++ {
+				hits += len(index[hexes[(i*queryHashes+j)%rows]])
+			}
+		}
+		_ = hits
+		// A Go string key is a 16-byte header plus its bytes.
+		b.ReportMetric(float64(16+len(hexes[0])), "key-B")
+	})
+	b.Run("packed", func(b *testing.B) {
+		index := make(map[int32][]int, rows)
+		for i, h := range packed {
+			index[h] = append(index[h], i)
+		}
+		b.ResetTimer()
+		hits := 0
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < queryHashes; j++ {
+				hits += len(index[packed[(i*queryHashes+j)%rows]])
+			}
+		}
+		_ = hits
+		b.ReportMetric(4, "key-B")
+	})
+}
@@ -1,10 +1,6 @@
 package fingerprint
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
-	"encoding/hex"
 	"log"
 	"math"
 	"math/cmplx"
@@ -19,68 +15,115 @@ const (
 	PEAK_NEIGHBORHOOD_SIZE = 5
 )
 
-func ExtractRobustPeaks(spectrogram [][]complex128, songID string) []Peak {
+func ExtractRobustPeaks(spectrogram [][]complex128, songID uint, cfg FingerprintConfig) []Peak {
 	if len(spectrogram) == 0 || len(spectrogram[0]) == 0 {
 		return nil
 	}
 
 	numFrames := len(spectrogram)
-	numBins := len(spectrogram[0])
 	magnitudes := getMagnitudes(spectrogram)
 
-	half := PEAK_NEIGHBORHOOD_SIZE / 2
-	candidatePeaks := []Peak{}
+	half := cfg.PeakNeighborhoodSize / 2
+	picker := newPeakPicker(cfg)
 
 	// Loop through each time-frequency point
 	for t := half; t < numFrames-half; t++ {
-		for f := half; f < numBins-half; f++ {
-			currentAmp := magnitudes[t][f]
-			if isLocalMax(magnitudes, t, f, half, currentAmp) {
-				candidatePeaks = append(candidatePeaks, Peak{
-					Time: float64(t),
-					Freq: float64(f),
-					Amp:  currentAmp,
-				})
-			}
-		}
+		frameCandidates(magnitudes, t, t, half, picker.add)
 	}
+	picker.flush()
 
-	// Chunk-wise filtering
-	finalPeaks := make([]Peak, 0)
-	framesPerChunk := float64(SampleRate) * SECONDS_PER_CHUNK / float64(HopSize)
-	peaksPerChunk := int(PEAK_TARGET_DENSITY * SECONDS_PER_CHUNK)
+	log.Printf("Found %d robust peaks for song %d.\n", len(picker.peaks), songID)
+	return picker.peaks
+}
 
-	for chunkStart := 0; chunkStart < len(candidatePeaks); {
-		chunkEnd := chunkStart
-		startTime := candidatePeaks[chunkStart].Time
-		for chunkEnd < len(candidatePeaks) && candidatePeaks[chunkEnd].Time < startTime+framesPerChunk {
-			chunkEnd++
+// frameCandidates calls add for every local maximum in frame t of
+// magnitudes, in order of frequency. The frame is reported as being at
+// absolute frame index frame, which differs from t when magnitudes is a
+// sliding window over a longer stream.
+func frameCandidates(magnitudes [][]float64, t, frame, half int, add func(Peak)) {
+	numBins := len(magnitudes[t])
+	for f := half; f < numBins-half; f++ {
+		currentAmp := magnitudes[t][f]
+		if isLocalMax(magnitudes, t, f, half, currentAmp) {
+			add(Peak{
+				Time: float64(frame),
+				Freq: float64(f),
+				Amp:  currentAmp,
+			})
 		}
+	}
+}
 
-		chunk := candidatePeaks[chunkStart:chunkEnd]
+// peakPicker keeps the strongest candidates of each chunk of
+// cfg.SecondsPerChunk. Candidates must be added in time order; a chunk is
+// decided as soon as a candidate past its end arrives.
+type peakPicker struct {
+	cfg            FingerprintConfig
+	framesPerChunk float64
+	peaksPerChunk  int
+
+	chunk      []Peak
+	chunkStart float64
+	// peaks holds the selected peaks in time, then frequency order, with
+	// Time in seconds and Freq in Hz.
+	peaks []Peak
+}
 
-		// Sort chunk by amplitude and pick top-N
-		sort.Slice(chunk, func(i, j int) bool {
-			return chunk[i].Amp > chunk[j].Amp
-		})
-		limit := min(len(chunk), peaksPerChunk)
-		for _, peak := range chunk[:limit] {
-			finalPeaks = append(finalPeaks, Peak{
-				Time: float64(peak.Time*float64(HopSize)) / float64(SampleRate),
-				Freq: float64(peak.Freq*float64(SampleRate)) / float64(WindowSize),
-				Amp:  peak.Amp,
-			})
-		}
+func newPeakPicker(cfg FingerprintConfig) *peakPicker {
+	return &peakPicker{
+		cfg:            cfg,
+		framesPerChunk: cfg.FramesPerSecond() * cfg.SecondsPerChunk,
+		peaksPerChunk:  int(float64(cfg.PeakTargetDensity) * cfg.SecondsPerChunk),
+	}
+}
+
+// add takes a candidate with Time in frames and Freq in bins.
+func (p *peakPicker) add(candidate Peak) {
+	if len(p.chunk) > 0 && candidate.Time >= p.chunkStart+p.framesPerChunk {
+		p.flush()
+	}
+	if len(p.chunk) == 0 {
+		p.chunkStart = candidate.Time
+	}
+	p.chunk = append(p.chunk, candidate)
+}
 
-		chunkStart = chunkEnd
+// flush selects the peaks of the pending chunk.
+func (p *peakPicker) flush() {
+	chunk := p.chunk
+	if len(chunk) == 0 {
+		return
 	}
 
-	sort.Slice(finalPeaks, func(i, j int) bool {
-		return finalPeaks[i].Time < finalPeaks[j].Time
+	// Sort chunk by amplitude and pick top-N. Ties are broken by position
+	// so the selection does not depend on the sort algorithm.
+	sort.Slice(chunk, func(i, j int) bool {
+		if chunk[i].Amp != chunk[j].Amp {
+			return chunk[i].Amp > chunk[j].Amp
+		}
+		return peakBefore(chunk[i], chunk[j])
 	})
+	limit := min(len(chunk), p.peaksPerChunk)
+	selected := chunk[:limit]
+	sort.Slice(selected, func(i, j int) bool {
+		return peakBefore(selected[i], selected[j])
+	})
+	for _, peak := range selected {
+		p.peaks = append(p.peaks, Peak{
+			Time: peak.Time / p.cfg.FramesPerSecond(),
+			Freq: peak.Freq * p.cfg.BinHz(),
+			Amp:  peak.Amp,
+		})
+	}
 
-	log.Printf("Found %d robust peaks for song '%s'.\n", len(finalPeaks), songID)
-	return finalPeaks
+	p.chunk = p.chunk[:0]
+}
+
+func peakBefore(a, b Peak) bool {
+	if a.Time != b.Time {
+		return a.Time < b.Time
+	}
+	return a.Freq < b.Freq
 }
 
 func isLocalMax(magnitudes [][]float64, t, f, half int, currentAmp float64) bool {
@@ -99,89 +142,137 @@ func isLocalMax(magnitudes [][]float64, t, f, half int, currentAmp float64) bool
 
 func getMagnitudes(spectrogram [][]complex128) [][]float64 {
 	numFrames := len(spectrogram)
-	numBins := len(spectrogram[0])
 	mags := make([][]float64, numFrames)
 	for t := 0; t < numFrames; t++ {
-		mags[t] = make([]float64, numBins)
-		for f := 0; f < numBins; f++ {
-			mags[t][f] = cmplx.Abs(spectrogram[t][f])
-		}
+		mags[t] = frameMagnitudes(spectrogram[t])
+	}
+	return mags
+}
+
+func frameMagnitudes(spectrum []complex128) []float64 {
+	mags := make([]float64, len(spectrum))
+	for f, c := range spectrum {
+		mags[f] = cmplx.Abs(c)
 	}
 	return mags
 }
 
-func FindPeakRelationships(peaks []Peak, songID string) []db.Fingerprint {
+func FindPeakRelationships(peaks []Peak, songID uint, cfg FingerprintConfig) []db.Fingerprint {
 	if len(peaks) == 0 {
 		return nil
 	}
 
 	fingerprints := []db.Fingerprint{}
+	for i := range peaks {
+		fingerprints = pairAnchor(fingerprints, peaks, i, songID, cfg)
+	}
+	log.Printf("Created %d fingerprints for song %d.\n", len(fingerprints), songID)
+	return fingerprints
+}
 
-	// Use a bytes.Buffer to efficiently build the data to be hashed for each fingerprint.
-	// This avoids repeated memory allocations for byte slices.
-	buf := new(bytes.Buffer)
-
-	for i, anchorPeak := range peaks {
-		minTime := anchorPeak.Time + DeltaTMin
-		maxTime := anchorPeak.Time + DeltaTMax
-
-		pairCount := 0
-
-		for j := i + 1; j < len(peaks); j++ {
-			targetPeak := peaks[j]
-
-			// Optimization: Peaks are assumed to be sorted by time.
-			// If targetPeak.Time is already less than minTime, continue.
-			if targetPeak.Time < minTime {
-				continue
-			}
-
-			// If targetPeak.Time exceeds maxTime, no further peaks for this anchor will be valid.
-			if targetPeak.Time > maxTime {
-				break
-			}
+// pairAnchor appends the fingerprints pairing peaks[i] with the peaks after
+// it. peaks must be sorted by time.
+func pairAnchor(fingerprints []db.Fingerprint, peaks []Peak, i int, songID uint, cfg FingerprintConfig) []db.Fingerprint {
+	if cfg.RatioHashes() {
+		return tripletAnchor(fingerprints, peaks, i, songID, cfg)
+	}
+	binHz := cfg.BinHz()
+	framesPerSecond := cfg.FramesPerSecond()
 
-			// Apply FAN_OUT limit
-			if pairCount >= FAN_OUT {
-				break
-			}
+	anchorPeak := peaks[i]
+	minTime := anchorPeak.Time + cfg.DeltaTMin
+	maxTime := anchorPeak.Time + cfg.DeltaTMax
 
-			deltaTime := targetPeak.Time - anchorPeak.Time
+	pairCount := 0
 
-			buf.Reset()
+	for j := i + 1; j < len(peaks); j++ {
+		targetPeak := peaks[j]
 
-			const freqScale = 100.0       // 0.01 Hz precision
-			const timeDeltaScale = 1000.0 // 1 ms precision
+		// Optimization: Peaks are assumed to be sorted by time.
+		// If targetPeak.Time is already less than minTime, continue.
+		if targetPeak.Time < minTime {
+			continue
+		}
 
-			quantizedAnchorFreq := int32(math.Round(anchorPeak.Freq * freqScale))
-			quantizedTargetFreq := int32(math.Round(targetPeak.Freq * freqScale))
-			quantizedDeltaTime := int32(math.Round(deltaTime * timeDeltaScale))
+		// If targetPeak.Time exceeds maxTime, no further peaks for this anchor will be valid.
+		if targetPeak.Time > maxTime {
+			break
+		}
 
-			// Write the quantized integer values to the buffer.
-			// Using BigEndian for consistent byte order.
-			binary.Write(buf, binary.BigEndian, quantizedAnchorFreq)
-			binary.Write(buf, binary.BigEndian, quantizedTargetFreq)
-			binary.Write(buf, binary.BigEndian, quantizedDeltaTime)
+		// Apply FAN_OUT limit
+		if pairCount >= cfg.FanOut {
+			break
+		}
 
-			// 3. Compute the SHA-1 hash.
-			hasher := sha1.New()
-			hasher.Write(buf.Bytes())   // Feed the buffer's content to the hasher
-			sha1Hash := hasher.Sum(nil) // Get the 20-byte hash sum
+		deltaTime := targetPeak.Time - anchorPeak.Time
+
+		// Peaks lie on the spectrogram grid, so converting back to bins
+		// and frames is exact up to float rounding.
+		anchorBin := int(math.Round(anchorPeak.Freq / binHz))
+		targetBin := int(math.Round(targetPeak.Freq / binHz))
+		deltaFrames := int(math.Round(deltaTime * framesPerSecond))
+
+		fingerprint := db.Fingerprint{
+			AnchorTime: anchorPeak.Time,
+			TargetFreq: targetPeak.Freq,
+			AnchorFreq: anchorPeak.Freq,
+			TimeDelta:  deltaTime,
+			Hash:       PackHash(anchorBin, targetBin, deltaFrames),
+			SongID:     songID,
+		}
+		fingerprints = append(fingerprints, fingerprint)
+		pairCount++
+	}
+	return fingerprints
+}
 
-			// --- End SHA-1 Hashing Logic ---
+// targets returns the indexes of the up to cfg.FanOut peaks after peaks[i]
+// that lie between DeltaTMin and DeltaTMax after it.
+func targets(peaks []Peak, i int, cfg FingerprintConfig) []int {
+	anchorPeak := peaks[i]
+	minTime := anchorPeak.Time + cfg.DeltaTMin
+	maxTime := anchorPeak.Time + cfg.DeltaTMax
+
+	var found []int
+	for j := i + 1; j < len(peaks) && len(found) < cfg.FanOut; j++ {
+		if peaks[j].Time < minTime {
+			continue
+		}
+		if peaks[j].Time > maxTime {
+			break
+		}
+		found = append(found, j)
+	}
+	return found
+}
 
-			fingerprint := db.Fingerprint{
+// tripletAnchor appends a ratio hash for every pair of targets of peaks[i].
+// TargetFreq and TimeDelta describe the later target, whose distance from
+// the anchor lets the matcher measure the speed of the audio.
+func tripletAnchor(fingerprints []db.Fingerprint, peaks []Peak, i int, songID uint, cfg FingerprintConfig) []db.Fingerprint {
+	anchorPeak := peaks[i]
+	// Ratios to a DC anchor are undefined.
+	if anchorPeak.Freq <= 0 {
+		return fingerprints
+	}
+	found := targets(peaks, i, cfg)
+	for x, b := range found {
+		for _, c := range found[x+1:] {
+			near, far := peaks[b], peaks[c]
+			span := far.Time - anchorPeak.Time
+			if span <= 0 {
+				continue
+			}
+			fingerprints = append(fingerprints, db.Fingerprint{
 				AnchorTime: anchorPeak.Time,
-				TargetFreq: targetPeak.Freq,
 				AnchorFreq: anchorPeak.Freq,
-				TimeDelta:  deltaTime,
-				Hash:       hex.EncodeToString(sha1Hash), // Assign the computed SHA-1 hash (20 bytes)
-				SongID:     songID,
-			}
-			fingerprints = append(fingerprints, fingerprint)
-			pairCount++
+				TargetFreq: far.Freq,
+				TimeDelta:  span,
+				Hash: PackRatioHash((near.Time-anchorPeak.Time)/span,
+					near.Freq/anchorPeak.Freq, far.Freq/anchorPeak.Freq),
+				SongID: songID,
+			})
 		}
 	}
-	log.Printf("Created %d fingerprints for song '%s'.\n", len(fingerprints), songID)
 	return fingerprints
 }
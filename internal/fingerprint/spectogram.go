@@ -8,27 +8,46 @@ import (
 )
 
 const (
-	frameSize  = 4096
-	hopSize    = 2058
-	windowSize = frameSize
-	scaleX     = 4
-	scaleY     = 1
+	scaleX = 4
+	scaleY = 1
 )
 
-func Spectrogram(data []float64) [][]complex128 {
+// Spectrogram returns the short-time Fourier transform of data. Each frame
+// holds the cfg.WindowSize/2 bins below the Nyquist frequency.
+func Spectrogram(data []float64, cfg FingerprintConfig) ([][]complex128, error) {
 	spectrogram := make([][]complex128, 0)
 	Length := len(data)
-	for start := 0; start+windowSize <= Length; start += hopSize {
 
-		frame := data[start : start+windowSize]
-		window := ApplyHanningWindow(frame)
+	plan, err := NewFFTPlan(cfg.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+	hann := hanningWindow(cfg.WindowSize)
+	frame := make([]float64, cfg.WindowSize)
+	numBins := cfg.WindowSize / 2
+
+	for start := 0; start+cfg.WindowSize <= Length; start += cfg.HopSize {
+		for i, w := range hann {
+			frame[i] = data[start+i] * w
+		}
 
-		spectrum := FFT(window)
+		spectrum := make([]complex128, numBins)
+		plan.RealTransform(frame, spectrum)
 
-		spectrogram = append(spectrogram, spectrum[:hopSize])
+		spectrogram = append(spectrogram, spectrum)
 	}
 
-	return spectrogram
+	return spectrogram, nil
+}
+
+// hanningWindow returns the Hann coefficients used by ApplyHanningWindow so
+// they can be computed once per spectrogram instead of once per frame.
+func hanningWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 * (1 - math.Cos(2*math.Pi*float64(i)/float64(n-1)))
+	}
+	return w
 }
 
 func ApplyHanningWindow(frame []float64) []complex128 {
@@ -0,0 +1,249 @@
+package fingerprint
+
+import (
+	"fmt"
+	"io"
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"time"
+)
+
+// StreamBlockFrames is the number of frames FingerprintReader reads at a
+// time.
+const StreamBlockFrames = 1 << 16
+
+// Stream fingerprints mono audio at cfg.SampleRate delivered in blocks. It
+// keeps only the samples, spectrogram frames and peaks that later output
+// still depends on, so memory stays bounded however long the recording is.
+// The fingerprints it emits, in order, are identical to those Fingerprint
+// returns for the concatenated blocks.
+type Stream struct {
+	cfg    FingerprintConfig
+	songID uint
+
+	// Low-pass filter state.
+	lowpass float64
+	prev    float64
+
+	// pending holds filtered samples not yet consumed by a frame.
+	pending []float64
+	plan    *FFTPlan
+	hann    []float64
+	frame   []float64
+	// mags holds the magnitudes of the last 2*half+1 frames; frames counts
+	// every frame computed so far.
+	mags   [][]float64
+	frames int
+
+	picker *peakPicker
+	// paired is the number of peaks in picker.peaks already used as
+	// anchors.
+	paired  int
+	samples int64
+}
+
+// NewStream returns a stream producing fingerprints for songID.
+func NewStream(songID uint, cfg FingerprintConfig) (*Stream, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint config: %w", err)
+	}
+	plan, err := NewFFTPlan(cfg.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		cfg:     cfg,
+		songID:  songID,
+		lowpass: lowpassCoefficient(cfg.LowpassCutoff, float64(cfg.SampleRate)),
+		plan:    plan,
+		hann:    hanningWindow(cfg.WindowSize),
+		frame:   make([]float64, cfg.WindowSize),
+		picker:  newPeakPicker(cfg),
+	}, nil
+}
+
+// Write adds samples and returns the fingerprints they complete.
+func (s *Stream) Write(samples []float64) []db.Fingerprint {
+	a := s.lowpass
+	for _, x := range samples {
+		s.pending = append(s.pending, a*x+(1-a)*s.prev)
+		s.prev = x
+	}
+	s.samples += int64(len(samples))
+
+	consumed := 0
+	for len(s.pending)-consumed >= s.cfg.WindowSize {
+		s.addFrame(s.pending[consumed : consumed+s.cfg.WindowSize])
+		consumed += s.cfg.HopSize
+	}
+	s.pending = s.pending[:copy(s.pending, s.pending[consumed:])]
+
+	return s.pair(false)
+}
+
+// Close returns the fingerprints still held back. Samples after the last
+// full window are dropped, as in Fingerprint.
+func (s *Stream) Close() []db.Fingerprint {
+	s.picker.flush()
+	return s.pair(true)
+}
+
+// Duration returns the length of the audio written so far.
+func (s *Stream) Duration() time.Duration {
+	return time.Duration(s.samples) * time.Second / time.Duration(s.cfg.SampleRate)
+}
+
+func (s *Stream) addFrame(data []float64) {
+	for i, w := range s.hann {
+		s.frame[i] = data[i] * w
+	}
+	spectrum := make([]complex128, s.cfg.WindowSize/2)
+	s.plan.RealTransform(s.frame, spectrum)
+
+	half := s.cfg.PeakNeighborhoodSize / 2
+	if len(s.mags) == 2*half+1 {
+		s.mags = s.mags[:copy(s.mags, s.mags[1:])]
+	}
+	s.mags = append(s.mags, frameMagnitudes(spectrum))
+	s.frames++
+
+	// The frame in the middle of the window now has its full neighborhood.
+	if len(s.mags) == 2*half+1 {
+		frameCandidates(s.mags, half, s.frames-1-half, half, s.picker.add)
+	}
+}
+
+// pair emits the fingerprints of every anchor whose targets are all known:
+// a later peak lies beyond its DeltaTMax, or the stream has ended.
+func (s *Stream) pair(final bool) []db.Fingerprint {
+	peaks := s.picker.peaks
+	if len(peaks) == 0 {
+		return nil
+	}
+	last := peaks[len(peaks)-1].Time
+
+	var fingerprints []db.Fingerprint
+	for ; s.paired < len(peaks); s.paired++ {
+		if !final && last <= peaks[s.paired].Time+s.cfg.DeltaTMax {
+			break
+		}
+		fingerprints = pairAnchor(fingerprints, peaks, s.paired, s.songID, s.cfg)
+	}
+
+	s.picker.peaks = peaks[:copy(peaks, peaks[s.paired:])]
+	s.paired = 0
+	return fingerprints
+}
+
+// FingerprintReader fingerprints headerless PCM in format read from r,
+// passing the fingerprints to emit as they are produced. It returns the
+// duration of the audio read. Any sample rate and channel count are
+// accepted; the audio is mixed down and resampled on the fly.
+func FingerprintReader(r io.Reader, format audio.RawFormat, songID uint, cfg FingerprintConfig, emit func([]db.Fingerprint) error) (time.Duration, error) {
+	pcm, err := audio.NewPCMReader(r, format)
+	if err != nil {
+		return 0, err
+	}
+	return FingerprintPCM(pcm, songID, cfg, emit)
+}
+
+// FingerprintPCM is FingerprintReader for an already opened PCM reader,
+// e.g. one returned by audio.OpenWAV.
+func FingerprintPCM(pcm *audio.PCMReader, songID uint, cfg FingerprintConfig, emit func([]db.Fingerprint) error) (time.Duration, error) {
+	n, err := newNormalizer(songID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		block, err := pcm.ReadBlock(StreamBlockFrames)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n.duration(), err
+		}
+		if err := n.write(block, emit); err != nil {
+			return n.duration(), err
+		}
+	}
+	return n.duration(), n.close(emit)
+}
+
+// FingerprintChannel fingerprints the blocks received from blocks until it
+// is closed, passing the fingerprints to emit as they are produced. Every
+// block must have the same format. It returns the duration of the audio
+// received.
+func FingerprintChannel(blocks <-chan *audio.Buffer, songID uint, cfg FingerprintConfig, emit func([]db.Fingerprint) error) (time.Duration, error) {
+	n, err := newNormalizer(songID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	for block := range blocks {
+		if err := n.write(block, emit); err != nil {
+			return n.duration(), err
+		}
+	}
+	return n.duration(), n.close(emit)
+}
+
+// normalizer mixes blocks down to mono and resamples them to the analysis
+// rate before feeding them to a Stream, as FingerprintAudio does for a
+// whole buffer.
+type normalizer struct {
+	stream    *Stream
+	format    audio.Format
+	resampler *audio.ResampleStream
+	frames    int64
+}
+
+func newNormalizer(songID uint, cfg FingerprintConfig) (*normalizer, error) {
+	stream, err := NewStream(songID, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &normalizer{stream: stream}, nil
+}
+
+func (n *normalizer) write(block *audio.Buffer, emit func([]db.Fingerprint) error) error {
+	if n.resampler == nil {
+		if block.Format.SampleRate <= 0 || block.Format.Channels <= 0 {
+			return fmt.Errorf("invalid audio format %v", block.Format)
+		}
+		r, err := audio.NewResampler(block.Format.SampleRate, n.stream.cfg.SampleRate)
+		if err != nil {
+			return err
+		}
+		n.format = block.Format
+		n.resampler = r.Stream()
+	} else if block.Format != n.format {
+		return fmt.Errorf("audio format changed mid-stream from %v to %v", n.format, block.Format)
+	}
+
+	n.frames += int64(block.Frames())
+	samples := n.resampler.Write(block.Mono().Data)
+	return emitNonEmpty(emit, n.stream.Write(samples))
+}
+
+func (n *normalizer) close(emit func([]db.Fingerprint) error) error {
+	if n.resampler != nil {
+		if err := emitNonEmpty(emit, n.stream.Write(n.resampler.Flush())); err != nil {
+			return err
+		}
+	}
+	return emitNonEmpty(emit, n.stream.Close())
+}
+
+// duration returns the length of the source audio received so far.
+func (n *normalizer) duration() time.Duration {
+	if n.format.SampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(n.frames) * time.Second / time.Duration(n.format.SampleRate)
+}
+
+func emitNonEmpty(emit func([]db.Fingerprint) error, fingerprints []db.Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	return emit(fingerprints)
+}
@@ -0,0 +1,135 @@
+package fingerprint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+)
+
+// synthAudio returns seconds of audio at rate made of two random tones that
+// change every 200ms.
+func synthAudio(seed int64, rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(seconds*float64(rate)))
+	step := rate / 5
+	var f1, f2 float64
+	for i := range samples {
+		if i%step == 0 {
+			f1, f2 = 200+rng.Float64()*1800, 2000+rng.Float64()*2500
+		}
+		t := float64(i) / float64(rate)
+		samples[i] = 0.4*math.Sin(2*math.Pi*f1*t) + 0.3*math.Sin(2*math.Pi*f2*t)
+	}
+	return samples
+}
+
+func hashModes() map[string]FingerprintConfig {
+	pairs := DefaultConfig()
+	ratio := DefaultConfig()
+	ratio.HashMode = HashModeRatio
+	return map[string]FingerprintConfig{"pairs": pairs, "ratio": ratio}
+}
+
+func checkSameFingerprints(t *testing.T, name string, got, want []db.Fingerprint) {
+	t.Helper()
+	if len(want) == 0 {
+		t.Fatalf("%s: the batch pipeline produced no fingerprints", name)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%s: %d fingerprints streamed, %d in one batch", name, len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("%s: fingerprint %d is %+v streamed, %+v in one batch", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestStreamMatchesFingerprint(t *testing.T) {
+	for mode, cfg := range hashModes() {
+		samples := synthAudio(1, cfg.SampleRate, 12)
+		want, err := Fingerprint(&samples, 7, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, block := range []int{1, 333, 4097, 65537, len(samples)} {
+			if block == 1 && mode == "ratio" {
+				continue // one block size of 1 is enough to cover the edges
+			}
+			stream, err := NewStream(7, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []db.Fingerprint
+			for start := 0; start < len(samples); start += block {
+				got = append(got, stream.Write(samples[start:min(len(samples), start+block)])...)
+			}
+			got = append(got, stream.Close()...)
+			checkSameFingerprints(t, mode, got, want)
+		}
+	}
+}
+
+func TestFingerprintPCMMatchesFingerprintAudio(t *testing.T) {
+	// Stereo 16-bit audio at 22050 Hz, so the stream mixes down and
+	// resamples to the analysis rate on the way.
+	const rate = 22050
+	left, right := synthAudio(2, rate, 10), synthAudio(3, rate, 10)
+	var raw bytes.Buffer
+	for i := range left {
+		binary.Write(&raw, binary.LittleEndian, int16(left[i]*32767))
+		binary.Write(&raw, binary.LittleEndian, int16(right[i]*32767))
+	}
+	format := audio.RawFormat{SampleRate: rate, Channels: 2, BitDepth: 16}
+
+	for mode, cfg := range hashModes() {
+		buf, err := audio.ReadRawPCM(bytes.NewReader(raw.Bytes()), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := FingerprintAudio(buf, 3, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pcm, err := audio.NewPCMReader(bytes.NewReader(raw.Bytes()), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []db.Fingerprint
+		duration, err := FingerprintPCM(pcm, 3, cfg, func(fps []db.Fingerprint) error {
+			got = append(got, fps...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duration != buf.Duration() {
+			t.Errorf("%s: streamed duration %v, buffer has %v", mode, duration, buf.Duration())
+		}
+		checkSameFingerprints(t, mode, got, want)
+
+		// Odd block sizes go through the same resampler state.
+		blocks := make(chan *audio.Buffer)
+		go func() {
+			defer close(blocks)
+			const frames = 1001
+			for start := 0; start < len(buf.Data); start += 2 * frames {
+				blocks <- &audio.Buffer{Format: buf.Format, Data: buf.Data[start:min(len(buf.Data), start+2*frames)]}
+			}
+		}()
+		got = got[:0]
+		if _, err := FingerprintChannel(blocks, 3, cfg, func(fps []db.Fingerprint) error {
+			got = append(got, fps...)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkSameFingerprints(t, mode+" in 1001-frame blocks", got, want)
+	}
+}
@@ -0,0 +1,320 @@
+// Package ingest fingerprints many audio files concurrently and writes them
+// to a FingerprintStore.
+//
+// Files are decoded and fingerprinted by a bounded pool of workers. A single
+// writer stores each song with its fingerprints in one AddSong call, so an
+// interrupted run leaves no half-written songs behind. A failure only
+// affects the file it came from, and files whose source path or content
+// checksum is already in the catalog are skipped, so an interrupted run can
+// simply be restarted and re-ingesting a file under another name does not
+// store it twice.
+//
+// Writing song by song trades some speed for that atomicity: the writer no
+// longer gathers the fingerprints of several songs into one large batch,
+// so a catalog of many short files takes more, smaller writes. In return
+// there are no songs without fingerprints to clean up, and a run no longer
+// deletes such songs at startup, where they could belong to another
+// writer still adding them.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"runtime"
+	"time"
+
+	"shazam/internal/audio"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+// Job is one file to ingest. Empty Song fields are filled in from the file.
+type Job struct {
+	Path string
+	Song db.Song
+}
+
+// Result is the outcome of one Job.
+type Result struct {
+	Path         string `json:"path"`
+	SongID       uint   `json:"song_id,omitempty"`
+	Fingerprints int    `json:"fingerprints"`
+	Skipped      bool   `json:"skipped,omitempty"`
+	Err          error  `json:"-"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Progress is reported after every finished file.
+type Progress struct {
+	Total        int
+	Done         int
+	Failed       int
+	Skipped      int
+	Fingerprints int
+	Elapsed      time.Duration
+	// ETA estimates the time left from the rate of files processed so far.
+	// It is zero until the first file has been processed.
+	ETA  time.Duration
+	Last Result
+}
+
+// Pipeline ingests files into Store. The zero value of Workers selects
+// runtime.NumCPU().
+type Pipeline struct {
+	Store   db.FingerprintStore
+	Config  fingerprint.FingerprintConfig
+	Workers int
+	// OnProgress, if set, is called from a single goroutine after each file.
+	OnProgress func(Progress)
+}
+
+type fingerprinted struct {
+	index        int
+	song         db.Song
+	fingerprints []db.Fingerprint
+	err          error
+}
+
+// stored identifies the song a content checksum was ingested as.
+type stored struct {
+	songID       uint
+	fingerprints int
+}
+
+// Run ingests jobs and returns one Result per job, in job order. The error
+// is non-nil only if the run could not start or ctx was cancelled; per-file
+// failures are reported in the results.
+func (p *Pipeline) Run(ctx context.Context, jobs []Job) ([]Result, error) {
+	if err := p.Config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint config: %w", err)
+	}
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	results := make([]Result, len(jobs))
+	for i, job := range jobs {
+		results[i].Path = job.Path
+	}
+	progress := Progress{Total: len(jobs)}
+	start := time.Now()
+	report := func(i int) {
+		r := &results[i]
+		if r.Err != nil {
+			r.Error = r.Err.Error()
+		}
+		switch {
+		case r.Skipped:
+			progress.Skipped++
+		case r.Err != nil:
+			progress.Failed++
+		default:
+			progress.Done++
+			progress.Fingerprints += r.Fingerprints
+		}
+		progress.Elapsed = time.Since(start)
+		processed := progress.Done + progress.Failed
+		remaining := progress.Total - processed - progress.Skipped
+		if processed > 0 {
+			progress.ETA = progress.Elapsed / time.Duration(processed) * time.Duration(remaining)
+		}
+		progress.Last = *r
+		if p.OnProgress != nil {
+			p.OnProgress(progress)
+		}
+	}
+
+	pending, checksums, err := p.skipIngested(jobs, results, report)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan int)
+	out := make(chan fingerprinted, workers)
+	go func() {
+		defer close(queue)
+		for _, i := range pending {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := range queue {
+				fp := p.fingerprintJob(i, jobs[i], checksums)
+				select {
+				case out <- fp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		for w := 0; w < workers; w++ {
+			<-done
+		}
+		close(out)
+	}()
+
+	w := writer{store: p.Store, results: results, report: report, checksums: maps.Clone(checksums)}
+	for fp := range out {
+		w.add(fp)
+	}
+
+	return results, ctx.Err()
+}
+
+// skipIngested marks jobs whose source path is already stored as skipped and
+// returns the indexes of the jobs left to do, along with the checksums of
+// the stored songs. Songs without fingerprints do not count as ingested, but
+// are left alone: another writer may still be adding them.
+func (p *Pipeline) skipIngested(jobs []Job, results []Result, report func(int)) ([]int, map[string]stored, error) {
+	songs, err := p.Store.ListSongs()
+	if err != nil {
+		return nil, nil, err
+	}
+	counts, err := p.Store.CountPerSong()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ingested := make(map[string]db.Song, len(songs))
+	checksums := make(map[string]stored)
+	for _, song := range songs {
+		if counts[song.ID] == 0 {
+			continue
+		}
+		if song.SourcePath != "" {
+			ingested[song.SourcePath] = song
+		}
+		if _, ok := checksums[song.Checksum]; song.Checksum != "" && !ok {
+			checksums[song.Checksum] = stored{songID: song.ID, fingerprints: counts[song.ID]}
+		}
+	}
+
+	pending := make([]int, 0, len(jobs))
+	for i, job := range jobs {
+		if song, ok := ingested[job.Path]; ok {
+			results[i].SongID = song.ID
+			results[i].Fingerprints = counts[song.ID]
+			results[i].Skipped = true
+			report(i)
+			continue
+		}
+		pending = append(pending, i)
+	}
+	return pending, checksums, nil
+}
+
+// fingerprintJob decodes and fingerprints one file. The returned fingerprints
+// have no song ID yet; the writer assigns it. A file whose checksum is in
+// checksums is not decoded at all and comes back without fingerprints.
+func (p *Pipeline) fingerprintJob(index int, job Job, checksums map[string]stored) fingerprinted {
+	result := fingerprinted{index: index, song: job.Song}
+
+	f, err := os.Open(job.Path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer f.Close()
+
+	if result.song.Checksum, result.err = db.FileChecksum(f); result.err != nil {
+		return result
+	}
+	if _, ok := checksums[result.song.Checksum]; ok {
+		return result
+	}
+	if _, result.err = f.Seek(0, io.SeekStart); result.err != nil {
+		return result
+	}
+
+	// WAV files, typically the long recordings, are streamed so only their
+	// fingerprints are held in memory; other formats are decoded whole.
+	var (
+		duration   time.Duration
+		sourceRate int
+	)
+	if name, _ := audio.DefaultRegistry.Sniff(f); name == "wav" {
+		pcm, err := audio.OpenWAV(f)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		sourceRate = pcm.Format.SampleRate
+		duration, result.err = fingerprint.FingerprintPCM(pcm, 0, p.Config, func(fps []db.Fingerprint) error {
+			result.fingerprints = append(result.fingerprints, fps...)
+			return nil
+		})
+	} else {
+		buf, err := audio.Decode(f)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		duration, sourceRate = buf.Duration(), buf.Format.SampleRate
+		result.fingerprints, result.err = fingerprint.FingerprintAudio(buf, 0, p.Config)
+	}
+	if result.err == nil && len(result.fingerprints) == 0 {
+		result.err = errors.New("audio produced no fingerprints")
+	}
+
+	if result.song.Title == "" {
+		result.song.Title = db.TitleFromPath(job.Path)
+	}
+	result.song.SourcePath = job.Path
+	result.song.Duration = duration.Seconds()
+	result.song.ConfigID = p.Config.ID()
+	result.song.SampleRate = p.Config.SampleRate
+	result.song.SourceSampleRate = sourceRate
+	return result
+}
+
+// writer stores each song together with its fingerprints in one AddSong
+// call, so no song is ever visible without them. It skips files whose
+// checksum it has seen before, whether stored before the run or written by
+// it.
+type writer struct {
+	store     db.FingerprintStore
+	results   []Result
+	report    func(int)
+	checksums map[string]stored
+}
+
+func (w *writer) add(fp fingerprinted) {
+	r := &w.results[fp.index]
+	defer w.report(fp.index)
+	if fp.err != nil {
+		r.Err = fp.err
+		return
+	}
+	if prev, ok := w.checksums[fp.song.Checksum]; ok {
+		r.SongID = prev.songID
+		r.Fingerprints = prev.fingerprints
+		r.Skipped = true
+		return
+	}
+
+	if err := w.store.AddSong(&fp.song, fp.fingerprints); err != nil {
+		r.Err = err
+		return
+	}
+	r.SongID = fp.song.ID
+	r.Fingerprints = len(fp.fingerprints)
+	w.checksums[fp.song.Checksum] = stored{songID: r.SongID, fingerprints: r.Fingerprints}
+}
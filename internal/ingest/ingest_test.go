@@ -0,0 +1,101 @@
+package ingest
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+// writeToneWAV writes seconds of 16-bit mono audio made of random tones,
+// one every quarter second, seeded by seed.
+func writeToneWAV(t *testing.T, path string, seed int64, seconds int) {
+	t.Helper()
+	const rate = 11025
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]int16, rate*seconds)
+	var freq float64
+	for i := range samples {
+		if i%(rate/4) == 0 {
+			freq = 300 + rng.Float64()*3000
+		}
+		samples[i] = int16(12000 * math.Sin(2*math.Pi*freq*float64(i)/rate))
+	}
+
+	dataSize := uint32(2 * len(samples))
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(rate), uint32(2 * rate), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, v := range append(header, samples) {
+		if err := binary.Write(f, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunLeavesSongsOfOtherWritersAlone(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav")}
+	for i, path := range paths {
+		writeToneWAV(t, path, int64(i+1), 5)
+	}
+
+	// A song another writer has created but not yet given its fingerprints.
+	store := db.NewMemoryStore()
+	inFlight := db.Song{Title: "in flight", SourcePath: filepath.Join(dir, "c.wav")}
+	if err := store.CreateSong(&inFlight); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := Pipeline{Store: store, Config: fingerprint.DefaultConfig(), Workers: 2}
+	jobs := []Job{{Path: paths[0]}, {Path: paths[1]}}
+	results, err := pipeline.Run(context.Background(), jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := store.CountPerSong()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Skipped {
+			t.Fatalf("%s: err %v, skipped %v; want it ingested", r.Path, r.Err, r.Skipped)
+		}
+		if r.Fingerprints == 0 || counts[r.SongID] != r.Fingerprints {
+			t.Errorf("%s: %d fingerprints reported, %d stored", r.Path, r.Fingerprints, counts[r.SongID])
+		}
+	}
+
+	// A second run skips the ingested files and still leaves the song in
+	// flight alone.
+	results, err = pipeline.Run(context.Background(), jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Skipped {
+			t.Errorf("%s: ingested again, want it skipped", r.Path)
+		}
+	}
+	songs, err := store.Songs([]uint{inFlight.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := songs[inFlight.ID]; !ok {
+		t.Error("song being written by another writer was deleted")
+	}
+}
@@ -0,0 +1,82 @@
+package monitor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"shazam/internal/db"
+)
+
+// Exporter writes plays to a file or stream as they are reported.
+type Exporter interface {
+	Write(play db.Play) error
+}
+
+// csvHeader names the columns CSVExporter writes.
+var csvHeader = []string{
+	"id", "source", "song_id", "title", "artist",
+	"stream_start_seconds", "stream_end_seconds", "ref_offset_seconds",
+	"speed", "confidence", "windows", "played_at",
+}
+
+// CSVExporter writes plays as CSV rows under a header row, flushing after
+// every play so the file is usable while monitoring continues.
+type CSVExporter struct {
+	w      *csv.Writer
+	header bool
+}
+
+// NewCSVExporter returns an exporter writing to w.
+func NewCSVExporter(w io.Writer) *CSVExporter {
+	return &CSVExporter{w: csv.NewWriter(w)}
+}
+
+func (e *CSVExporter) Write(play db.Play) error {
+	if !e.header {
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+		e.header = true
+	}
+	playedAt := ""
+	if !play.PlayedAt.IsZero() {
+		playedAt = play.PlayedAt.Format(time.RFC3339Nano)
+	}
+	seconds := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	err := e.w.Write([]string{
+		strconv.FormatUint(uint64(play.ID), 10),
+		play.Source,
+		strconv.FormatUint(uint64(play.SongID), 10),
+		play.Title,
+		play.Artist,
+		seconds(play.StreamStart),
+		seconds(play.StreamEnd),
+		seconds(play.RefOffset),
+		strconv.FormatFloat(play.Speed, 'f', 4, 64),
+		strconv.FormatFloat(play.Confidence, 'f', 4, 64),
+		strconv.Itoa(play.Windows),
+		playedAt,
+	})
+	if err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// JSONExporter writes plays as JSON lines, one object per play.
+type JSONExporter struct {
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns an exporter writing to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *JSONExporter) Write(play db.Play) error {
+	return e.enc.Encode(play)
+}
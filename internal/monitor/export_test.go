@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"shazam/internal/db"
+)
+
+var testPlays = []db.Play{
+	{
+		ID: 1, Source: "radio", SongID: 7, Title: "Song, with a comma", Artist: "Band",
+		StreamStart: 12.5, StreamEnd: 190.25, RefOffset: 3.0004, Speed: 1.02, Confidence: 0.87654, Windows: 36,
+		PlayedAt:   time.Date(2024, 5, 1, 20, 0, 12, 500000000, time.UTC),
+		DetectedAt: time.Date(2024, 5, 1, 20, 3, 30, 0, time.UTC),
+	},
+	{ID: 2, Source: "radio", SongID: 9, Title: `"Quoted"`, StreamStart: 200, StreamEnd: 230, Speed: 1, Confidence: 1, Windows: 5},
+}
+
+func TestCSVExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exp := NewCSVExporter(&buf)
+	for i, play := range testPlays {
+		if err := exp.Write(play); err != nil {
+			t.Fatal(err)
+		}
+		// Every play is flushed as it is written.
+		if lines := strings.Count(buf.String(), "\n"); lines != i+2 {
+			t.Errorf("%d lines after %d plays, want %d", lines, i+1, i+2)
+		}
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"1", "radio", "7", "Song, with a comma", "Band", "12.500", "190.250", "3.000", "1.0200", "0.8765", "36", "2024-05-01T20:00:12.5Z"},
+		{"2", "radio", "9", `"Quoted"`, "", "200.000", "230.000", "0.000", "1.0000", "1.0000", "5", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("CSV rows\n%q\nwant\n%q", rows, want)
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exp := NewJSONExporter(&buf)
+	for _, play := range testPlays {
+		if err := exp.Write(play); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One object per line, which decodes back to the play.
+	scanner := bufio.NewScanner(&buf)
+	var got []db.Play
+	for scanner.Scan() {
+		var play db.Play
+		if err := json.Unmarshal(scanner.Bytes(), &play); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, play)
+	}
+	if !reflect.DeepEqual(got, testPlays) {
+		t.Errorf("JSON lines decode to\n%+v\nwant\n%+v", got, testPlays)
+	}
+}
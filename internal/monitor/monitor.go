@@ -0,0 +1,241 @@
+// Package monitor logs the catalog songs played in a long recording or live
+// stream, such as a radio or club feed.
+//
+// A Monitor slides a query window over the stream's fingerprints and
+// matches each window on its own. Consecutive windows that match the same
+// song at a consistent position are merged into one play, which is reported
+// once the song stops matching.
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+const (
+	// WINDOW_SECONDS and HOP_SECONDS are the default length of a query
+	// window and the distance between the starts of consecutive windows.
+	WINDOW_SECONDS = 10.0
+	HOP_SECONDS    = 5.0
+	// MAX_GAP_SECONDS is how long a play may go without a matching window
+	// before it is considered over.
+	MAX_GAP_SECONDS = 10.0
+	// OFFSET_TOLERANCE_SECONDS is how far a window's position in the song
+	// may be from where the play predicts it and still continue the play.
+	OFFSET_TOLERANCE_SECONDS = 1.0
+	// MIN_WINDOWS is the number of matching windows a play needs to be
+	// reported, so one stray window is not logged as a play.
+	MIN_WINDOWS = 2
+)
+
+// Config controls windowing and how window matches are merged into plays.
+// Which windows match at all is decided by the search.MatchConfig.
+type Config struct {
+	WindowSeconds          float64 `yaml:"window_seconds" toml:"window_seconds"`
+	HopSeconds             float64 `yaml:"hop_seconds" toml:"hop_seconds"`
+	MaxGapSeconds          float64 `yaml:"max_gap_seconds" toml:"max_gap_seconds"`
+	OffsetToleranceSeconds float64 `yaml:"offset_tolerance_seconds" toml:"offset_tolerance_seconds"`
+	MinWindows             int     `yaml:"min_windows" toml:"min_windows"`
+}
+
+// DefaultConfig returns the configuration used when none is supplied.
+func DefaultConfig() Config {
+	return Config{
+		WindowSeconds:          WINDOW_SECONDS,
+		HopSeconds:             HOP_SECONDS,
+		MaxGapSeconds:          MAX_GAP_SECONDS,
+		OffsetToleranceSeconds: OFFSET_TOLERANCE_SECONDS,
+		MinWindows:             MIN_WINDOWS,
+	}
+}
+
+// Validate reports the first setting outside its range.
+func (c Config) Validate() error {
+	switch {
+	case c.WindowSeconds <= 0:
+		return fmt.Errorf("window must be positive, got %gs", c.WindowSeconds)
+	case c.HopSeconds <= 0 || c.HopSeconds > c.WindowSeconds:
+		return fmt.Errorf("hop must be in (0, %g], got %gs", c.WindowSeconds, c.HopSeconds)
+	case c.MaxGapSeconds < 0:
+		return fmt.Errorf("max gap must not be negative, got %gs", c.MaxGapSeconds)
+	case c.OffsetToleranceSeconds < 0:
+		return fmt.Errorf("offset tolerance must not be negative, got %gs", c.OffsetToleranceSeconds)
+	case c.MinWindows < 1:
+		return fmt.Errorf("min windows must be positive, got %d", c.MinWindows)
+	}
+	return nil
+}
+
+// Monitor turns the fingerprints of a stream into plays. Set the exported
+// fields, then feed it fingerprints in stream order with Add and call Finish
+// when the stream ends. A Monitor is not safe for concurrent use.
+type Monitor struct {
+	Store       db.FingerprintStore
+	Fingerprint fingerprint.FingerprintConfig // config the stream is fingerprinted with
+	Match       search.MatchConfig
+	Config      Config
+	// Source names the stream in the plays.
+	Source string
+	// Origin is the wall-clock time of the start of the stream, used for
+	// Play.PlayedAt. The zero value leaves PlayedAt unset.
+	Origin time.Time
+	// OnPlay receives every play once it is over. An error stops the
+	// monitor.
+	OnPlay func(db.Play) error
+
+	pending   []db.Fingerprint // fingerprints from nextStart on
+	nextStart float64          // start of the next window, in stream seconds
+	windows   int              // windows matched so far
+	current   *play
+}
+
+// play is the play being extended by matching windows.
+type play struct {
+	db.Play
+	lastWindow float64 // start of the last window that matched
+}
+
+// Add passes the next fingerprints of the stream, with anchor times in
+// seconds from its start, and matches every window they complete.
+func (m *Monitor) Add(fingerprints []db.Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	m.pending = append(m.pending, fingerprints...)
+	// Fingerprints arrive in anchor order, so a window is complete once a
+	// fingerprint past its end has arrived.
+	for m.pending[len(m.pending)-1].AnchorTime >= m.nextStart+m.Config.WindowSeconds {
+		if err := m.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish matches the windows left at the end of a stream of duration and
+// reports the play still open.
+func (m *Monitor) Finish(duration time.Duration) error {
+	end := duration.Seconds()
+	// Slide on until a window reaches the end, but always match at least
+	// one window, however short the stream.
+	for m.windows == 0 || m.nextStart+m.Config.WindowSeconds-m.Config.HopSeconds < end {
+		if err := m.advance(); err != nil {
+			return err
+		}
+	}
+	if m.current != nil {
+		m.current.StreamEnd = min(m.current.StreamEnd, end)
+	}
+	return m.close()
+}
+
+// advance matches the window at nextStart and moves it on by a hop.
+func (m *Monitor) advance() error {
+	start := m.nextStart
+	end := start + m.Config.WindowSeconds
+	var query []db.Fingerprint
+	for _, fp := range m.pending {
+		if fp.AnchorTime >= end {
+			break
+		}
+		fp.AnchorTime -= start
+		query = append(query, fp)
+	}
+
+	m.nextStart += m.Config.HopSeconds
+	m.windows++
+	drop := 0
+	for drop < len(m.pending) && m.pending[drop].AnchorTime < m.nextStart {
+		drop++
+	}
+	m.pending = m.pending[drop:]
+
+	if len(query) == 0 {
+		return m.observe(start, nil)
+	}
+	result, err := search.Search(query, m.Fingerprint, m.Match, m.Store)
+	if errors.Is(err, search.ErrIncompatibleConfig) {
+		return m.observe(start, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("matching window at %.1fs: %w", start, err)
+	}
+	return m.observe(start, result.Match)
+}
+
+// observe merges the match of the window starting at start, nil if it did
+// not match, into the current play.
+func (m *Monitor) observe(start float64, match *search.MatchedSongOptimized) error {
+	if match == nil {
+		if m.current != nil && start-m.current.lastWindow > m.Config.MaxGapSeconds {
+			return m.close()
+		}
+		return nil
+	}
+
+	// ref is the song position at the start of the window; it is
+	// negative when the song begins inside the window.
+	ref := float64(match.MatchOffset) / 1000
+	speed := match.Speed
+	playStart := start + max(0, -ref)/speed
+	playEnd := start + (float64(match.TrackEnd)/1000-ref)/speed
+	confidence := match.Confidence
+
+	if cur := m.current; cur != nil && cur.SongID == match.Song.ID {
+		predicted := cur.RefOffset + cur.Speed*(start-cur.StreamStart)
+		if math.Abs(ref-predicted) <= m.Config.OffsetToleranceSeconds {
+			cur.StreamEnd = max(cur.StreamEnd, playEnd)
+			cur.Confidence = max(cur.Confidence, confidence)
+			cur.Windows++
+			cur.lastWindow = start
+			return nil
+		}
+	}
+
+	// The window may reach into the next song, so the play it ends stops
+	// where this one starts.
+	if m.current != nil {
+		m.current.StreamEnd = max(m.current.StreamStart, min(m.current.StreamEnd, playStart))
+	}
+	if err := m.close(); err != nil {
+		return err
+	}
+	m.current = &play{
+		Play: db.Play{
+			Source:      m.Source,
+			SongID:      match.Song.ID,
+			Title:       match.Song.Title,
+			Artist:      match.Song.Artist,
+			StreamStart: playStart,
+			StreamEnd:   playEnd,
+			RefOffset:   max(0, ref),
+			Speed:       speed,
+			Confidence:  confidence,
+			Windows:     1,
+		},
+		lastWindow: start,
+	}
+	return nil
+}
+
+// close reports the current play if enough windows matched it.
+func (m *Monitor) close() error {
+	cur := m.current
+	m.current = nil
+	if cur == nil || cur.Windows < m.Config.MinWindows {
+		return nil
+	}
+	if !m.Origin.IsZero() {
+		cur.PlayedAt = m.Origin.Add(time.Duration(cur.StreamStart * float64(time.Second)))
+	}
+	if m.OnPlay == nil {
+		return nil
+	}
+	return m.OnPlay(cur.Play)
+}
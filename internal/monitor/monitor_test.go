@@ -0,0 +1,293 @@
+package monitor
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"shazam/internal/api/search"
+	"shazam/internal/db"
+	"shazam/internal/fingerprint"
+)
+
+const songSeconds = 30.0
+
+// synthSong returns seconds of audio at rate made of two tones that jump to
+// random frequencies five times a second, seeded by seed.
+func synthSong(seed int64, rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(seconds*float64(rate)))
+	step := rate / 5
+	var f1, f2 float64
+	for i := range samples {
+		if i%step == 0 {
+			f1, f2 = 200+rng.Float64()*1800, 2000+rng.Float64()*2500
+		}
+		t := float64(i) / float64(rate)
+		samples[i] = 0.4*math.Sin(2*math.Pi*f1*t) + 0.3*math.Sin(2*math.Pi*f2*t)
+	}
+	return samples
+}
+
+// catalog is a MemoryStore of three synthetic songs, with their audio by ID.
+type catalog struct {
+	store *db.MemoryStore
+	cfg   fingerprint.FingerprintConfig
+	audio map[uint][]float64
+}
+
+func newCatalog(t *testing.T) *catalog {
+	t.Helper()
+	c := &catalog{store: db.NewMemoryStore(), cfg: fingerprint.DefaultConfig(), audio: make(map[uint][]float64)}
+	for i, title := range []string{"a", "b", "c"} {
+		samples := synthSong(int64(i+1), c.cfg.SampleRate, songSeconds)
+		fps, err := fingerprint.Fingerprint(&samples, 0, c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		song := db.Song{Title: title, ConfigID: c.cfg.ID(), SampleRate: c.cfg.SampleRate, Duration: songSeconds}
+		if err := c.store.AddSong(&song, fps); err != nil {
+			t.Fatal(err)
+		}
+		c.audio[song.ID] = samples
+	}
+	return c
+}
+
+// segment is a stretch of a stream: seconds of song from from, or of
+// silence for song 0.
+type segment struct {
+	song          uint
+	from, seconds float64
+}
+
+// stream returns the samples of segments played back to back.
+func (c *catalog) stream(segments ...segment) []float64 {
+	rate := float64(c.cfg.SampleRate)
+	var samples []float64
+	for _, s := range segments {
+		n := int(s.seconds * rate)
+		if s.song == 0 {
+			samples = append(samples, make([]float64, n)...)
+			continue
+		}
+		from := int(s.from * rate)
+		samples = append(samples, c.audio[s.song][from:from+n]...)
+	}
+	return samples
+}
+
+// monitor returns a Monitor over c with config, and the plays it reports.
+func (c *catalog) monitor(config Config) (*Monitor, *[]db.Play) {
+	plays := new([]db.Play)
+	m := &Monitor{
+		Store:       c.store,
+		Fingerprint: c.cfg,
+		Match:       search.DefaultMatchConfig(),
+		Config:      config,
+		Source:      "test",
+		OnPlay: func(play db.Play) error {
+			*plays = append(*plays, play)
+			return nil
+		},
+	}
+	return m, plays
+}
+
+// feed passes the fingerprints of samples to m a second of anchors at a
+// time, as a live stream would, calling after with the stream time each
+// chunk reaches.
+func feed(t *testing.T, m *Monitor, samples []float64, after func(seconds float64)) {
+	t.Helper()
+	fps, err := fingerprint.Fingerprint(&samples, 0, m.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for second := 1.0; len(fps) > 0; second++ {
+		n := 0
+		for n < len(fps) && fps[n].AnchorTime < second {
+			n++
+		}
+		if err := m.Add(fps[:n]); err != nil {
+			t.Fatal(err)
+		}
+		fps = fps[n:]
+		if after != nil {
+			after(second)
+		}
+	}
+	duration := time.Duration(float64(len(samples)) / float64(m.Fingerprint.SampleRate) * float64(time.Second))
+	if err := m.Finish(duration); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wantPlay is a play expected in a stream, with its times in seconds.
+type wantPlay struct {
+	song                  uint
+	start, end, refOffset float64
+}
+
+func checkPlays(t *testing.T, got []db.Play, want []wantPlay) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d plays %+v, want %d", len(got), got, len(want))
+	}
+	// A play starts within a frame of its first hash, and ends at the last
+	// peak the final window matched, which may be some way before the
+	// audio stops.
+	near := func(got, want, tolerance float64) bool { return math.Abs(got-want) <= tolerance }
+	for i, w := range want {
+		p := got[i]
+		if p.SongID != w.song || !near(p.StreamStart, w.start, 0.5) || !near(p.StreamEnd, w.end, 1) ||
+			!near(p.RefOffset, w.refOffset, 0.5) {
+			t.Errorf("play %d is song %d at %.2f-%.2fs from %.2fs, want song %d at %g-%gs from %gs",
+				i, p.SongID, p.StreamStart, p.StreamEnd, p.RefOffset, w.song, w.start, w.end, w.refOffset)
+		}
+		if math.Abs(p.Speed-1) > 0.01 {
+			t.Errorf("play %d at speed %g, want 1", i, p.Speed)
+		}
+		if p.Source != "test" {
+			t.Errorf("play %d from source %q, want test", i, p.Source)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	c := newCatalog(t)
+	cases := []struct {
+		name     string
+		segments []segment
+		config   func(*Config)
+		want     []wantPlay
+	}{
+		{
+			name:     "back to back, then a gap",
+			segments: []segment{{1, 0, 20}, {2, 5, 20}, {0, 0, 20}, {3, 0, 15}},
+			want:     []wantPlay{{1, 0, 20, 0}, {2, 20, 40, 5}, {3, 60, 75, 0}},
+		},
+		{
+			// The song restarts, so the windows after the jump are not
+			// where the play predicts and start a play of their own.
+			name:     "song restarted",
+			segments: []segment{{1, 0, 20}, {1, 2, 20}},
+			want:     []wantPlay{{1, 0, 20, 0}, {1, 20, 40, 2}},
+		},
+		{
+			name:     "song starting inside a window",
+			segments: []segment{{0, 0, 7}, {2, 0, 20}},
+			want:     []wantPlay{{2, 7, 27, 0}},
+		},
+		{
+			// A snippet only a couple of windows match.
+			name:     "snippet below MinWindows",
+			segments: []segment{{0, 0, 20}, {1, 0, 6}, {0, 0, 20}},
+			config:   func(c *Config) { c.MinWindows = 4 },
+		},
+		{
+			name:     "snippet with MinWindows 1",
+			segments: []segment{{0, 0, 20}, {1, 0, 6}, {0, 0, 20}},
+			config:   func(c *Config) { c.MinWindows = 1 },
+			want:     []wantPlay{{1, 20, 26, 0}},
+		},
+		{
+			// Shorter than a window: Finish still matches one, and clips
+			// the play to the end of the stream.
+			name:     "stream shorter than a window",
+			segments: []segment{{3, 4, 6}},
+			config:   func(c *Config) { c.MinWindows = 1 },
+			want:     []wantPlay{{3, 0, 6, 4}},
+		},
+		{
+			name:     "silence",
+			segments: []segment{{0, 0, 30}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultConfig()
+			if tc.config != nil {
+				tc.config(&config)
+			}
+			m, plays := c.monitor(config)
+			samples := c.stream(tc.segments...)
+			feed(t, m, samples, nil)
+			checkPlays(t, *plays, tc.want)
+			for _, p := range *plays {
+				if p.Windows < config.MinWindows {
+					t.Errorf("play of song %d with %d windows reported, MinWindows is %d", p.SongID, p.Windows, config.MinWindows)
+				}
+				if end := float64(len(samples)) / float64(c.cfg.SampleRate); p.StreamEnd > end {
+					t.Errorf("play of song %d ends at %.2fs, after the stream at %gs", p.SongID, p.StreamEnd, end)
+				}
+			}
+		})
+	}
+}
+
+func TestMonitorClosesPlayAfterGap(t *testing.T) {
+	c := newCatalog(t)
+	m, plays := c.monitor(DefaultConfig())
+	samples := c.stream(segment{1, 0, 20}, segment{0, 0, 30}, segment{2, 0, 20})
+	var afterGap int
+	feed(t, m, samples, func(seconds float64) {
+		if seconds == 52 {
+			afterGap = len(*plays)
+		}
+	})
+	// Silence adds no fingerprints, so the windows over the gap complete
+	// when song 2 begins. The play of song 1 is reported then, as it went
+	// more than MaxGapSeconds without a match.
+	if afterGap != 1 {
+		t.Errorf("%d plays reported as song 2 begins, want 1", afterGap)
+	}
+	checkPlays(t, *plays, []wantPlay{{1, 0, 20, 0}, {2, 50, 70, 0}})
+}
+
+func TestMonitorPlayedAt(t *testing.T) {
+	c := newCatalog(t)
+	m, plays := c.monitor(DefaultConfig())
+	m.Origin = time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	feed(t, m, c.stream(segment{0, 0, 12}, segment{2, 0, 20}), nil)
+	if len(*plays) != 1 {
+		t.Fatalf("%d plays, want 1", len(*plays))
+	}
+	p := (*plays)[0]
+	want := m.Origin.Add(time.Duration(p.StreamStart * float64(time.Second)))
+	if !p.PlayedAt.Equal(want) {
+		t.Errorf("played at %v, want %v", p.PlayedAt, want)
+	}
+}
+
+func TestMonitorEmptyStream(t *testing.T) {
+	c := newCatalog(t)
+	m, plays := c.monitor(DefaultConfig())
+	if err := m.Finish(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(*plays) != 0 {
+		t.Errorf("empty stream reported plays %+v", *plays)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	bad := map[string]func(*Config){
+		"zero window":        func(c *Config) { c.WindowSeconds = 0 },
+		"zero hop":           func(c *Config) { c.HopSeconds = 0 },
+		"hop past window":    func(c *Config) { c.HopSeconds = c.WindowSeconds + 1 },
+		"negative gap":       func(c *Config) { c.MaxGapSeconds = -1 },
+		"negative tolerance": func(c *Config) { c.OffsetToleranceSeconds = -1 },
+		"zero min windows":   func(c *Config) { c.MinWindows = 0 },
+	}
+	for name, change := range bad {
+		c := DefaultConfig()
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}